@@ -0,0 +1,28 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build http3
+// +build http3
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func init() {
+	listenHTTP3 = func(addr, certFile, keyFile string, handler http.Handler) (http.Handler, func() error) {
+		srv := &http3.Server{Addr: addr, Handler: handler}
+		altSvc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// advertise http/3 to tls clients
+			_ = srv.SetQUICHeaders(w.Header())
+			handler.ServeHTTP(w, r)
+		})
+		return altSvc, func() error {
+			return srv.ListenAndServeTLS(certFile, keyFile)
+		}
+	}
+}
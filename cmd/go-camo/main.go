@@ -6,17 +6,16 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cactus/go-camo/pkg/camo"
-	"github.com/cactus/go-camo/pkg/htrie"
 	"github.com/cactus/go-camo/pkg/router"
 
 	"github.com/cactus/mlog"
@@ -33,6 +32,12 @@ var (
 	// ServerVersion holds the server version string
 	ServerVersion = "no-version"
 
+	// listenHTTP3, when non-nil, returns a handler that advertises HTTP/3
+	// support (for use by the tls server), and a func that serves the handler
+	// over HTTP/3 (QUIC) on the udp addr. Only set in builds with the `http3`
+	// build tag.
+	listenHTTP3 func(addr, certFile, keyFile string, handler http.Handler) (http.Handler, func() error)
+
 	responseSize = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: metricNamespace,
@@ -61,7 +66,7 @@ var (
 	)
 )
 
-func loadFilterList(fname string) ([]camo.FilterFunc, error) {
+func loadFilterList(fname string) (*camo.Ruleset, error) {
 	// #nosec
 	file, err := os.Open(fname)
 	if err != nil {
@@ -70,89 +75,119 @@ func loadFilterList(fname string) ([]camo.FilterFunc, error) {
 	// #nosec
 	defer file.Close()
 
-	allowFilter := htrie.NewURLMatcher()
-	denyFilter := htrie.NewURLMatcher()
-	hasAllow := false
-	hasDeny := false
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		if strings.HasPrefix(line, "allow|") {
-			line = strings.TrimPrefix(line, "allow")
-			err = allowFilter.AddRule(line)
-			if err != nil {
-				break
-			}
-			hasAllow = true
-		} else if strings.HasPrefix(line, "deny|") {
-			line = strings.TrimPrefix(line, "deny")
-			err = denyFilter.AddRule(line)
-			if err != nil {
-				break
-			}
-			hasDeny = true
-		} else {
-			fmt.Println("ignoring line: ", line)
-		}
-
-		err = scanner.Err()
-		if err != nil {
-			break
-		}
-	}
-	if err != nil {
-		return nil, fmt.Errorf("error building filter ruleset: %s", err)
-	}
-
-	// append in order. allow first, then deny filters.
-	// first false value aborts the request.
-	filterFuncs := make([]camo.FilterFunc, 0)
-
-	if hasAllow {
-		filterFuncs = append(filterFuncs, allowFilter.CheckURL)
-	}
-
-	// denyFilter returns true on a match. we want a "false" value to abort processing.
-	// so just wrap and invert the bool.
-	if hasDeny {
-		denyF := func(u *url.URL) bool {
-			return !denyFilter.CheckURL(u)
-		}
-		filterFuncs = append(filterFuncs, denyF)
-	}
-
-	if hasAllow && hasDeny {
-		mlog.Printf("Warning! Allow and Deny rules both supplied. Having Allow rules means anything not matching an allow rule is denied. THEN deny rules are evaluated. Be sure this is what you want!")
-	}
-
-	return filterFuncs, nil
+	return camo.ParseFilterRules(file)
 }
 
 func main() {
 	// command line flags
 	var opts struct {
 		HMACKey             string        `short:"k" long:"key" description:"HMAC key"`
+		InsecureNoAuth      bool          `long:"insecure-no-auth" description:"Accept unsigned urls, for local development only. NEVER use in production"`
+		FallbackHMACKeys    []string      `long:"fallback-key" description:"Additional HMAC key accepted for verification, for key rotation. This option can be used multiple times to add multiple keys"`
+		SunsetLegacyKeys    string        `long:"sunset-legacy-key-urls" description:"Date (YYYY-MM-DD, or RFC3339) sent as a Sunset header on responses to urls verified by a fallback key"`
+		HMACKeyEncoding     string        `long:"key-encoding" default:"raw" choice:"raw" choice:"hex" choice:"base64" description:"Encoding of the HMAC key (and fallback keys)"`
+		HMACMessage         string        `long:"hmac-message" default:"url" choice:"url" choice:"path" description:"Message the url HMAC is computed over, for interop with other camo implementations"`
+		MinKeyLength        int           `long:"min-key-length" default:"16" description:"Minimum HMAC key length in bytes (0 to disable)"`
 		AddHeaders          []string      `short:"H" long:"header" description:"Add additional header to each response. This option can be used multiple times to add multiple headers"`
 		BindAddress         string        `long:"listen" default:"0.0.0.0:8080" description:"Address:Port to bind to for HTTP"`
 		BindAddressSSL      string        `long:"ssl-listen" description:"Address:Port to bind to for HTTPS/SSL/TLS"`
+		ReusePort           bool          `long:"reuse-port" description:"Set SO_REUSEPORT on listeners, allowing multiple processes to share a port"`
+		ClientKeepAlive     time.Duration `long:"client-keepalive" description:"TCP keepalive period for client connections, negative to disable (default 30s)"`
 		SSLKey              string        `long:"ssl-key" description:"ssl private key (key.pem) path"`
 		SSLCert             string        `long:"ssl-cert" description:"ssl cert (cert.pem) path"`
+		HTTP3               bool          `long:"http3" description:"Additionally serve HTTP/3 (QUIC) on the ssl-listen address (requires http3 build)"`
+		HTTP3Fetch          bool          `long:"http3-fetch" description:"Fetch from origins over HTTP/3 (QUIC) when advertised (requires http3 build)"`
 		MaxSize             int64         `long:"max-size" description:"Max allowed response size (KB)"`
 		ReqTimeout          time.Duration `long:"timeout" default:"4s" description:"Upstream request timeout"`
+		ConnectTimeout      time.Duration `long:"connect-timeout" description:"Upstream connect timeout (default 3s)"`
+		TLSTimeout          time.Duration `long:"tls-timeout" description:"Upstream TLS handshake timeout (default 3s)"`
+		HeaderTimeout       time.Duration `long:"header-timeout" description:"Upstream response header timeout"`
+		BodyTimeout         time.Duration `long:"body-timeout" description:"Upstream response body timeout"`
+		ClientWriteTimeout  time.Duration `long:"client-write-timeout" description:"Timeout for writing the response to the client"`
+		HostTimeouts        []string      `long:"host-timeout" description:"Upstream request timeout override for a host, as host=duration (eg. example.com=10s). This option can be used multiple times to add multiple hosts"`
+		CategoryTimeouts    []string      `long:"category-timeout" description:"Upstream request timeout override for a content category, as category=duration (eg. video=60s), replacing timeout once the content type is known. This option can be used multiple times to add multiple categories"`
 		MaxRedirects        int           `long:"max-redirects" default:"3" description:"Maximum number of redirects to follow"`
+		RedirectLoopStatus  int           `long:"too-many-redirects-status" description:"Status code returned when max-redirects is exceeded (default 404)"`
+		MaxHostChanges      int           `long:"max-host-changes" description:"Maximum number of host changes across a redirect chain"`
+		MaxLocationLength   int           `long:"max-location-length" description:"Max allowed length of an upstream redirect Location header (default 8192)"`
+		MaxRedirectBody     int64         `long:"max-redirect-body-size" description:"Max bytes of an upstream redirect response body read before following the redirect (default 2048)"`
+		RedirectBodyTimeout time.Duration `long:"redirect-body-timeout" description:"Max time spent reading an upstream redirect response body before following the redirect (default 1s)"`
+		MaxRetries          int           `long:"max-retries" description:"Maximum number of retries for upstream 429 and 503 responses"`
+		NegativeCacheTTL    time.Duration `long:"negative-cache-ttl" description:"How long to cache upstream failures for, answering repeated requests without fetching"`
+		BlockCacheTTL       time.Duration `long:"block-cache-ttl" description:"How long to remember hosts rejected by ip filtering, blocking repeated requests without re-resolving (max 30s)"`
+		MaxHostsInFlight    int           `long:"max-hosts-in-flight" description:"Maximum number of distinct origin hosts with in-flight requests"`
+		MaxHandshakes       int           `long:"max-concurrent-handshakes" description:"Maximum number of concurrent outbound TLS handshakes"`
+		MaxPerURL           int           `long:"max-concurrent-per-url" description:"Maximum number of concurrent in-flight requests for a single url"`
+		MaxPerURLWait       time.Duration `long:"max-concurrent-per-url-wait" description:"How long requests over max-concurrent-per-url wait for a free slot before being rejected"`
+		ClientBandwidth     int64         `long:"client-bandwidth-limit" description:"Maximum bytes sent to a single client per client-bandwidth-window"`
+		ClientBandwidthWin  time.Duration `long:"client-bandwidth-window" description:"Sliding window client-bandwidth-limit applies over (default 1m)"`
+		TrustedProxies      []string      `long:"trusted-proxy" description:"Proxy IP or CIDR trusted to set X-Forwarded-For. Can be specified multiple times"`
 		Metrics             bool          `long:"metrics" description:"Enable Prometheus compatible metrics endpoint"`
 		NoLogTS             bool          `long:"no-log-ts" description:"Do not add a timestamp to logging"`
 		DisableKeepAlivesFE bool          `long:"no-fk" description:"Disable frontend http keep-alive support"`
 		DisableKeepAlivesBE bool          `long:"no-bk" description:"Disable backend http keep-alive support"`
 		AllowContentVideo   bool          `long:"allow-content-video" description:"Additionally allow 'video/*' content"`
 		AllowContentAudio   bool          `long:"allow-content-audio" description:"Additionally allow 'audio/*' content"`
+		AllowMJPEG          bool          `long:"allow-mjpeg" description:"Additionally allow 'multipart/x-mixed-replace' (MJPEG) streams"`
+		AcceptCH            []string      `long:"accept-ch" description:"Client hint (eg. DPR or Width) to advertise in an Accept-CH header, and forward to origins. This option can be used multiple times to add multiple hints"`
+		ForwardHeaders      []string      `long:"forward-header" description:"Additional client request header to forward to origins. This option can be used multiple times to add multiple headers"`
+		NoConditional       bool          `long:"no-conditional-requests" description:"Do not forward If-None-Match and If-Modified-Since client request headers"`
+		NoRange             bool          `long:"no-range-requests" description:"Do not forward Range client request headers"`
+		RequireAcceptImage  bool          `long:"require-accept-image" description:"Reject requests with a 406, unless their Accept header accepts an allowed content type"`
+		CORP                string        `long:"cross-origin-resource-policy" description:"Cross-Origin-Resource-Policy header value to send on successful responses (same-site, same-origin, or cross-origin)"`
+		UpstreamClientCert  string        `long:"upstream-client-cert" description:"Path to a PEM client certificate presented to origins requiring mutual TLS"`
+		UpstreamClientKey   string        `long:"upstream-client-key" description:"Path to the PEM private key for upstream-client-cert"`
+		UpstreamRootCAs     string        `long:"upstream-root-cas" description:"Path to a PEM bundle of additional CA certificates trusted for origin connections"`
+		TimingAllowOrigin   string        `long:"timing-allow-origin" description:"Timing-Allow-Origin header value to send on successful responses"`
+		SuspiciousHeaders   int           `long:"suspicious-header-threshold" description:"Reject and log origin responses with more than this many dangerous headers (eg. Set-Cookie, Refresh)"`
+		CanonicalHeaders    bool          `long:"canonicalize-headers" description:"Rewrite upstream response header names to canonical casing"`
+		CSPReportOnly       bool          `long:"csp-report-only" description:"Send the Content-Security-Policy header as Content-Security-Policy-Report-Only on proxied responses"`
+		CSPReportURI        string        `long:"csp-report-uri" description:"report-uri to add to the report-only Content-Security-Policy"`
+		DefaultAccept       string        `long:"default-accept" description:"Accept header to send upstream, instead of the list of allowed content types"`
+		DefaultAcceptLang   string        `long:"default-accept-language" description:"Accept-Language header to send upstream when the client did not send one"`
 		AllowCredetialURLs  bool          `long:"allow-credential-urls" description:"Allow urls to contain user/pass credentials"`
+		OriginBasicAuth     []string      `long:"origin-basic-auth" description:"Basic auth credentials added to upstream requests for an origin, as [scheme://]host[:port]=user:pass (https if no scheme). This option can be used multiple times to add multiple origins"`
+		DisallowQuery       bool          `long:"disallow-query-strings" description:"Reject origin urls with a query string"`
+		CollapseSlashes     bool          `long:"collapse-slashes" description:"Collapse duplicate slashes in origin url paths before fetching"`
+		QueryStringURLs     bool          `long:"query-string-urls" description:"Also accept query string format urls (/?url=<url>&digest=<hmac>)"`
+		HTMLResponseStatus  int           `long:"html-response-status" description:"Status code returned when an origin responds with an html page (default 400)"`
+		EmptyResponseMode   string        `long:"empty-response-mode" default:"reject" choice:"reject" choice:"strict" choice:"empty" description:"Handling of origin 200 responses with no content-type and no body"`
+		DisallowAnimated    bool          `long:"disallow-animated" description:"Reject animated gif, png, and webp images"`
+		MinResponseBytes    int           `long:"min-response-bytes" description:"Reject responses smaller than this many bytes (eg. tracking pixels)"`
+		AllowedExtensions   []string      `long:"allow-extension" description:"Only allow origin urls with this file extension (eg. png). This option can be used multiple times to allow multiple extensions"`
+		AllowedHosts        []string      `long:"allow-host" description:"Only serve requests for this Host (eg. img.example.com), rejecting others with a 421. This option can be used multiple times to allow multiple hosts"`
+		SelfHosts           []string      `long:"self-host" description:"Hostname of this camo instance (eg. img.example.com). Origin redirects to it are refused with a 508. This option can be used multiple times to add multiple hosts"`
+		EnforceExtType      bool          `long:"enforce-extension-type" description:"Reject responses where the content-type does not match the url file extension"`
+		StrictContentLength bool          `long:"strict-content-length" description:"Respond with a 502 if an upstream body is shorter than its declared Content-Length"`
+		RelabelExtType      bool          `long:"relabel-extension-type" description:"Relabel (instead of reject) responses where the content-type does not match the url file extension"`
 		FilterRuleset       string        `long:"filter-ruleset" description:"Text file containing filtering rules (one per line)"`
+		LegalBlockNotice    string        `long:"legal-block-notice" description:"Response body (eg. a link to the legal notice) for urls matching legal filter rules, which are rejected with a 451"`
+		RulesFiles          []string      `long:"rules-file" description:"Text file containing filtering rules (one per line). Can be specified multiple times, later files take precedence"`
+		RulesURL            string        `long:"rules-url" description:"URL of filtering rules (one per line), refreshed periodically"`
+		RulesRefresh        time.Duration `long:"rules-refresh-interval" default:"5m" description:"Interval between refreshes of rules-url"`
+		PathPrefix          string        `long:"path-prefix" description:"Base path (eg. /camo) to serve camo urls under"`
 		ServerName          string        `long:"server-name" default:"go-camo" description:"Value to use for the HTTP server field"`
 		ExposeServerVersion bool          `long:"expose-server-version" description:"Include the server version in the HTTP server response header"`
 		EnableXFwdFor       bool          `long:"enable-xfwd4" description:"Enable x-forwarded-for passthrough/generation"`
+		AdminToken          string        `long:"admin-token" description:"Bearer token required for admin endpoints. Admin endpoints are disabled if unset"`
+		StartInMaintenance  bool          `long:"start-in-maintenance" description:"Start in maintenance mode, responding to all requests with a 503"`
+		EgressIPs           []string      `long:"egress-ip" description:"Local IP address to use for upstream connections. This option can be used multiple times to rotate between addresses"`
+		ParentCamoURL       string        `long:"parent-camo" description:"Base URL of a parent camo instance to fetch origin urls through"`
+		ParentCamoKey       string        `long:"parent-camo-key" description:"HMAC key of the parent camo instance"`
+		DoHEndpoint         string        `long:"doh-endpoint" description:"DNS-over-HTTPS endpoint URL to use for upstream name resolution"`
+		DoHFallback         bool          `long:"doh-fallback" description:"Fall back to the system resolver if a DNS-over-HTTPS lookup fails"`
+		SelfTestImagePath   string        `long:"self-test-path" description:"Path (eg. /selftest.png) that, when signed as a url, is answered with a built-in image"`
+		StealthBlocks       bool          `long:"stealth-blocks" description:"Respond to blocked requests with a uniform transparent pixel"`
+		OutcomeHeader       bool          `long:"outcome-header" description:"Add an X-Camo-Outcome header, categorizing the outcome, to every response"`
+		ContentTypeParams   []string      `long:"content-type-param" description:"Content type parameter (eg. charset) to relay to clients, dropping any others. This option can be used multiple times to add multiple parameters"`
+		JSONErrors          bool          `long:"json-errors" description:"Send json error responses to clients that accept application/json"`
+		BlockJitter         time.Duration `long:"block-jitter" description:"Upper bound of a random delay added to blocked responses (max 1s)"`
+		RelayEarlyHints     bool          `long:"relay-early-hints" description:"Relay Link headers from upstream 103 Early Hints responses"`
+		RewriteLinkHeader   bool          `long:"rewrite-link-header" description:"Relay upstream Link headers, rewritten to signed camo urls"`
+		ExposeOriginHeader  bool          `long:"expose-origin-header" description:"Set an X-Camo-Origin response header to the decoded origin url (debugging)"`
+		CopyBufferSize      int           `long:"copy-buffer-size" default:"32" description:"Buffer size (KB) used when streaming responses to clients"`
+		MaxDecompressRatio  int           `long:"max-decompress-ratio" description:"Max allowed decompressed to compressed size ratio for content-encoded responses"`
+		MaxDecompressedSize int64         `long:"max-decompressed-size" description:"Max allowed decompressed size (KB) for content-encoded responses"`
 		Verbose             bool          `short:"v" long:"verbose" description:"Show verbose (debug) log level output"`
 		Version             []bool        `short:"V" long:"version" description:"Print version and exit; specify twice to show license information"`
 	}
@@ -202,10 +237,37 @@ func main() {
 		config.HMACKey = []byte(opts.HMACKey)
 	}
 
-	if len(config.HMACKey) == 0 {
+	config.HMACKeyEncoding = opts.HMACKeyEncoding
+	config.HMACMessage = opts.HMACMessage
+	config.MinKeyLength = opts.MinKeyLength
+
+	config.InsecureNoAuth = opts.InsecureNoAuth
+	if config.InsecureNoAuth {
+		if opts.BindAddressSSL != "" {
+			mlog.Fatal("insecure-no-auth can not be used with ssl-listen")
+		}
+	} else if len(config.HMACKey) == 0 {
 		mlog.Fatal("HMAC key required")
 	}
 
+	for _, key := range opts.FallbackHMACKeys {
+		if key == "" {
+			mlog.Fatal("Empty fallback-key supplied")
+		}
+		config.FallbackHMACKeys = append(config.FallbackHMACKeys, []byte(key))
+	}
+
+	if opts.SunsetLegacyKeys != "" {
+		sunset, err := time.Parse("2006-01-02", opts.SunsetLegacyKeys)
+		if err != nil {
+			sunset, err = time.Parse(time.RFC3339, opts.SunsetLegacyKeys)
+		}
+		if err != nil {
+			mlog.Fatalf("Invalid sunset-legacy-key-urls date: %s", opts.SunsetLegacyKeys)
+		}
+		config.SunsetLegacyKeyURLs = sunset
+	}
+
 	if opts.BindAddress == "" && opts.BindAddressSSL == "" {
 		mlog.Fatal("One of listen or ssl-listen required")
 	}
@@ -216,6 +278,12 @@ func main() {
 	if opts.BindAddressSSL != "" && opts.SSLCert == "" {
 		mlog.Fatal("ssl-cert is required when specifying ssl-listen")
 	}
+	if opts.HTTP3 && opts.BindAddressSSL == "" {
+		mlog.Fatal("ssl-listen is required when specifying http3")
+	}
+	if (opts.HTTP3 && listenHTTP3 == nil) || (opts.HTTP3Fetch && !camo.HTTP3Supported()) {
+		mlog.Fatal("http3 support not compiled in (build with -tags http3)")
+	}
 
 	// set keepalive options
 	config.DisableKeepAlivesBE = opts.DisableKeepAlivesBE
@@ -224,14 +292,84 @@ func main() {
 	// other options
 	config.EnableXFwdFor = opts.EnableXFwdFor
 	config.AllowCredetialURLs = opts.AllowCredetialURLs
+	// flags are added to (and for the same origin, override) the env var
+	originAuth := strings.Fields(os.Getenv("GOCAMO_ORIGIN_BASIC_AUTH"))
+	originAuth = append(originAuth, opts.OriginBasicAuth...)
+	if len(originAuth) > 0 {
+		config.OriginBasicAuth = make(map[string]camo.BasicAuth, len(originAuth))
+		for _, oa := range originAuth {
+			parts := strings.SplitN(oa, "=", 2)
+			if len(parts) != 2 || !strings.Contains(parts[1], ":") {
+				mlog.Fatalf("Invalid origin-basic-auth for origin: %s", parts[0])
+			}
+			creds := strings.SplitN(parts[1], ":", 2)
+			config.OriginBasicAuth[parts[0]] = camo.BasicAuth{
+				Username: creds[0],
+				Password: creds[1],
+			}
+		}
+	}
+	config.DisallowQueryStrings = opts.DisallowQuery
+	config.CollapseSlashes = opts.CollapseSlashes
+	config.QueryStringURLs = opts.QueryStringURLs
+	config.PathPrefix = opts.PathPrefix
+	config.EgressIPs = opts.EgressIPs
+	config.RulesFiles = opts.RulesFiles
+	config.RulesURL = opts.RulesURL
+	config.RulesRefreshInterval = opts.RulesRefresh
+	config.SelfTestImagePath = opts.SelfTestImagePath
+	config.ParentCamoURL = opts.ParentCamoURL
+	if opts.ParentCamoKey != "" {
+		config.ParentCamoKey = []byte(opts.ParentCamoKey)
+	}
+	config.DoHEndpoint = opts.DoHEndpoint
+	config.DoHFallback = opts.DoHFallback
+	config.StealthBlocks = opts.StealthBlocks
+	config.EmitOutcomeHeader = opts.OutcomeHeader
+	config.ContentTypeParams = opts.ContentTypeParams
+	config.JSONErrors = opts.JSONErrors
+	config.BlockResponseJitter = opts.BlockJitter
+	config.RelayEarlyHints = opts.RelayEarlyHints
+	config.RewriteLinkHeader = opts.RewriteLinkHeader
+	config.ExposeOriginHeader = opts.ExposeOriginHeader
 
 	// additional content types to allow
 	config.AllowContentVideo = opts.AllowContentVideo
 	config.AllowContentAudio = opts.AllowContentAudio
-
-	var filters []camo.FilterFunc
+	config.AllowMJPEG = opts.AllowMJPEG
+	config.DefaultAcceptHeader = opts.DefaultAccept
+	config.DefaultAcceptLanguage = opts.DefaultAcceptLang
+	config.AcceptCH = opts.AcceptCH
+	config.ForwardHeaders = opts.ForwardHeaders
+	config.DisableConditionalRequests = opts.NoConditional
+	config.DisableRangeRequests = opts.NoRange
+	config.RequireAcceptImage = opts.RequireAcceptImage
+	config.CORP = opts.CORP
+	config.UpstreamClientCert = opts.UpstreamClientCert
+	config.UpstreamClientKey = opts.UpstreamClientKey
+	config.UpstreamRootCAs = opts.UpstreamRootCAs
+	config.TimingAllowOrigin = opts.TimingAllowOrigin
+	config.SuspiciousHeaderThreshold = opts.SuspiciousHeaders
+	config.CanonicalizeHeaders = opts.CanonicalHeaders
+	config.ResponseCSPReportOnly = opts.CSPReportOnly
+	config.ResponseCSPReportURI = opts.CSPReportURI
+	config.DisallowAnimated = opts.DisallowAnimated
+	config.MinResponseBytes = opts.MinResponseBytes
+	config.HTMLResponseStatus = opts.HTMLResponseStatus
+	config.EmptyResponseMode = opts.EmptyResponseMode
+	config.StartInMaintenance = opts.StartInMaintenance
+	config.AllowedExtensions = opts.AllowedExtensions
+	config.AllowedHosts = opts.AllowedHosts
+	config.SelfHosts = opts.SelfHosts
+	config.EnforceExtensionContentTypeMatch = opts.EnforceExtType || opts.RelabelExtType
+	config.RelabelExtensionContentType = opts.RelabelExtType
+	config.StrictContentLength = opts.StrictContentLength
+	config.LegalBlockNotice = opts.LegalBlockNotice
+	config.EnableHTTP3 = opts.HTTP3Fetch
+
+	var ruleset *camo.Ruleset
 	if opts.FilterRuleset != "" {
-		filters, err = loadFilterList(opts.FilterRuleset)
+		ruleset, err = loadFilterList(opts.FilterRuleset)
 		if err != nil {
 			mlog.Fatal("Could not read filter-ruleset", err)
 		}
@@ -274,8 +412,61 @@ func main() {
 
 	// convert from KB to Bytes
 	config.MaxSize = opts.MaxSize * 1024
+	config.CopyBufferSize = opts.CopyBufferSize * 1024
+	config.MaxDecompressRatio = opts.MaxDecompressRatio
+	config.MaxDecompressedSize = opts.MaxDecompressedSize * 1024
 	config.RequestTimeout = opts.ReqTimeout
+	config.ConnectTimeout = opts.ConnectTimeout
+	config.TLSHandshakeTimeout = opts.TLSTimeout
+	config.ResponseHeaderTimeout = opts.HeaderTimeout
+	config.BodyTimeout = opts.BodyTimeout
+	config.ClientWriteTimeout = opts.ClientWriteTimeout
+	if len(opts.HostTimeouts) > 0 {
+		config.PerHostTimeouts = make(map[string]time.Duration, len(opts.HostTimeouts))
+		for _, ht := range opts.HostTimeouts {
+			parts := strings.SplitN(ht, "=", 2)
+			if len(parts) != 2 {
+				mlog.Fatalf("Invalid host-timeout: %s", ht)
+			}
+			timeout, err := time.ParseDuration(parts[1])
+			if err != nil {
+				mlog.Fatalf("Invalid host-timeout: %s", ht)
+			}
+			config.PerHostTimeouts[parts[0]] = timeout
+		}
+	}
+	if len(opts.CategoryTimeouts) > 0 {
+		config.CategoryTimeouts = make(map[string]time.Duration, len(opts.CategoryTimeouts))
+		for _, ct := range opts.CategoryTimeouts {
+			parts := strings.SplitN(ct, "=", 2)
+			if len(parts) != 2 {
+				mlog.Fatalf("Invalid category-timeout: %s", ct)
+			}
+			timeout, err := time.ParseDuration(parts[1])
+			if err != nil {
+				mlog.Fatalf("Invalid category-timeout: %s", ct)
+			}
+			config.CategoryTimeouts[parts[0]] = timeout
+		}
+	}
 	config.MaxRedirects = opts.MaxRedirects
+	config.TooManyRedirectsStatus = opts.RedirectLoopStatus
+	config.MaxHostChanges = opts.MaxHostChanges
+	config.MaxRetries = opts.MaxRetries
+	config.NegativeCacheTTL = opts.NegativeCacheTTL
+	config.BlockCacheTTL = opts.BlockCacheTTL
+	config.MaxDistinctHostsInFlight = opts.MaxHostsInFlight
+	config.MaxConcurrentHandshakes = opts.MaxHandshakes
+	config.MaxConcurrentPerURL = opts.MaxPerURL
+	config.MaxConcurrentPerURLWait = opts.MaxPerURLWait
+	config.ClientBandwidthLimit = opts.ClientBandwidth
+	config.ClientBandwidthWindow = opts.ClientBandwidthWin
+	config.TrustedProxies = opts.TrustedProxies
+	config.ReusePort = opts.ReusePort
+	config.ClientKeepAlive = opts.ClientKeepAlive
+	config.MaxLocationLength = opts.MaxLocationLength
+	config.MaxRedirectBodySize = opts.MaxRedirectBody
+	config.RedirectBodyTimeout = opts.RedirectBodyTimeout
 	config.ServerName = ServerName
 
 	// configure metrics collection in camo
@@ -283,15 +474,49 @@ func main() {
 		config.CollectMetrics = true
 	}
 
-	proxy, err := camo.NewWithFilters(config, filters)
+	proxy, err := camo.NewWithRuleset(config, ruleset)
 	if err != nil {
 		mlog.Fatal("Error creating camo", err)
 	}
+	if config.StartInMaintenance {
+		mlog.Printf("Starting in maintenance mode")
+	}
+
+	// reload the upstream tls files on SIGHUP (eg. after a client certificate
+	// rotation), rebuilding the upstream transport (and the parent camo
+	// client) and draining connections made with the old files. flags and env
+	// vars are not re-read, so nothing else is reloaded.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := proxy.ReloadTransport(config); err != nil {
+				mlog.Printm("could not reload upstream tls files", mlog.Map{"err": err})
+				continue
+			}
+			mlog.Printf("Reloaded upstream tls files")
+		}
+	}()
+
+	adminToken := os.Getenv("GOCAMO_ADMIN_TOKEN")
+	// flags override env var
+	if opts.AdminToken != "" {
+		adminToken = opts.AdminToken
+	}
+	if adminToken != "" {
+		mlog.Printf("Enabling admin endpoints at /admin/")
+	}
 
 	var router http.Handler = &router.DumbRouter{
 		ServerName:  ServerResponse,
 		AddHeaders:  AddHeaders,
 		CamoHandler: proxy,
+		AdminToken:  adminToken,
+		Maintenance: proxy,
+		Stats:       func() interface{} { return proxy.Stats() },
+
+		QueryStringURLs: opts.QueryStringURLs,
+		PathPrefix:      opts.PathPrefix,
 	}
 
 	// configure router endpoint for rendering metrics
@@ -313,26 +538,49 @@ func main() {
 		router = promhttp.InstrumentHandlerDuration(responseDuration, router)
 		router = promhttp.InstrumentHandlerCounter(responseCount, router)
 		router = promhttp.InstrumentHandlerResponseSize(responseSize, router)
+		// keep write deadlines reachable through the instrumentation
+		router = camo.PreserveResponseController(router)
 	}
 
 	http.Handle("/", router)
 
 	if opts.BindAddress != "" {
+		ln, err := camo.Listen(config, "tcp", opts.BindAddress)
+		if err != nil {
+			mlog.Fatal(err)
+		}
 		mlog.Printf("Starting server on: %s", opts.BindAddress)
 		go func() {
 			srv := &http.Server{
 				Addr:        opts.BindAddress,
 				ReadTimeout: 30 * time.Second}
-			mlog.Fatal(srv.ListenAndServe())
+			mlog.Fatal(srv.Serve(ln))
 		}()
 	}
 	if opts.BindAddressSSL != "" {
+		var tlsHandler http.Handler
+		if opts.HTTP3 {
+			var serveH3 func() error
+			tlsHandler, serveH3 = listenHTTP3(
+				opts.BindAddressSSL, opts.SSLCert, opts.SSLKey, http.DefaultServeMux,
+			)
+			mlog.Printf("Starting HTTP/3 server on: %s", opts.BindAddressSSL)
+			go func() {
+				mlog.Fatal(serveH3())
+			}()
+		}
+
+		ln, err := camo.Listen(config, "tcp", opts.BindAddressSSL)
+		if err != nil {
+			mlog.Fatal(err)
+		}
 		mlog.Printf("Starting TLS server on: %s", opts.BindAddressSSL)
 		go func() {
 			srv := &http.Server{
 				Addr:        opts.BindAddressSSL,
+				Handler:     tlsHandler,
 				ReadTimeout: 30 * time.Second}
-			mlog.Fatal(srv.ListenAndServeTLS(opts.SSLCert, opts.SSLKey))
+			mlog.Fatal(srv.ServeTLS(ln, opts.SSLCert, opts.SSLKey))
 		}()
 	}
 
@@ -6,8 +6,10 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"strings"
@@ -19,8 +21,11 @@ import (
 
 // EncodeCommand holds command options for the encode command
 type EncodeCommand struct {
-	Base   string `short:"b" long:"base" default:"hex" description:"Encode/Decode base. Either hex or base64"`
-	Prefix string `short:"p" long:"prefix" default:"" description:"Optional url prefix used by encode output"`
+	Base        string `short:"b" long:"base" default:"hex" description:"Encode/Decode base. Either hex or base64"`
+	Prefix      string `short:"p" long:"prefix" default:"" description:"Optional url prefix used by encode output"`
+	ContentType string `short:"t" long:"content-type" default:"" description:"Optional content type (eg. image/*) the origin response must match"`
+	Referer     string `short:"r" long:"referer" default:"" description:"Optional host the Referer of requests must be on"`
+	Message     string `short:"m" long:"message" default:"url" choice:"url" choice:"path" description:"Message the HMAC is computed over"`
 }
 
 // Execute runs the encode command
@@ -33,27 +38,85 @@ func (c *EncodeCommand) Execute(args []string) error {
 		return errors.New("no url argument provided")
 	}
 
-	oURL := args[0]
-	if oURL == "" {
-		return errors.New("no url argument provided")
+	// a single "-" argument reads urls from stdin, one per line
+	oURLs := args
+	if len(args) == 1 && args[0] == "-" {
+		var err error
+		oURLs, err = readURLs(os.Stdin)
+		if err != nil {
+			return err
+		}
 	}
 
-	hmacKeyBytes := []byte(opts.HmacKey)
-	var outURL string
-	switch c.Base {
+	for i, oURL := range oURLs {
+		if oURL == "" {
+			return errors.New("no url argument provided")
+		}
+		if c.ContentType != "" {
+			oURLs[i] = encoding.PinContentType(oURL, c.ContentType)
+		}
+		if c.Referer != "" {
+			oURLs[i] = encoding.PinReferer(oURLs[i], c.Referer)
+		}
+	}
+
+	outURLs, err := encodeURLs(c.Base, encoding.MessageFormat(c.Message), []byte(opts.HmacKey), oURLs)
+	if err != nil {
+		return err
+	}
+	for _, outURL := range outURLs {
+		fmt.Println(c.Prefix + outURL)
+	}
+	return nil
+}
+
+// encodeURLs signs and encodes a batch of urls.
+func encodeURLs(base string, format encoding.MessageFormat, hmacKey []byte, oURLs []string) ([]string, error) {
+	var encoder func(encoding.MessageFormat, []byte, string) string
+	switch base {
 	case "base64":
-		outURL = encoding.B64EncodeURL(hmacKeyBytes, oURL)
+		if format == encoding.MessageURL {
+			return encoding.B64EncodeURLs(hmacKey, oURLs), nil
+		}
+		encoder = encoding.B64EncodeURLFormat
 	case "hex":
-		outURL = encoding.HexEncodeURL(hmacKeyBytes, oURL)
+		if format == encoding.MessageURL {
+			return encoding.HexEncodeURLs(hmacKey, oURLs), nil
+		}
+		encoder = encoding.HexEncodeURLFormat
 	default:
-		return errors.New("invalid base provided")
+		return nil, errors.New("invalid base provided")
 	}
-	fmt.Println(c.Prefix + outURL)
-	return nil
+
+	outURLs := make([]string, len(oURLs))
+	for i, oURL := range oURLs {
+		outURLs[i] = encoder(format, hmacKey, oURL)
+	}
+	return outURLs, nil
+}
+
+// readURLs reads urls from r, one per line. Blank lines are skipped.
+func readURLs(r io.Reader) ([]string, error) {
+	var oURLs []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			oURLs = append(oURLs, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(oURLs) == 0 {
+		return nil, errors.New("no url argument provided")
+	}
+	return oURLs, nil
 }
 
 // DecodeCommand holds command options for the decode command
-type DecodeCommand struct{}
+type DecodeCommand struct {
+	Message string `short:"m" long:"message" default:"url" choice:"url" choice:"path" description:"Message the HMAC is computed over"`
+}
 
 // Execute runs the decode command
 func (c *DecodeCommand) Execute(args []string) error {
@@ -77,11 +140,21 @@ func (c *DecodeCommand) Execute(args []string) error {
 		return err
 	}
 	comp := strings.SplitN(u.Path, "/", 3)
-	decURL, valid := encoding.DecodeURL(hmacKeyBytes, comp[1], comp[2])
-	if !valid {
+	decURL, keyIdx := encoding.DecodeURLMultiFormat(
+		encoding.MessageFormat(c.Message), [][]byte{hmacKeyBytes}, comp[1], comp[2],
+	)
+	if keyIdx < 0 {
 		return errors.New("hmac is invalid")
 	}
+	decURL, referer := encoding.SplitReferer(decURL)
+	decURL, contentType := encoding.SplitContentType(decURL)
 	fmt.Println(decURL)
+	if contentType != "" {
+		fmt.Println("content-type:", contentType)
+	}
+	if referer != "" {
+		fmt.Println("referer:", referer)
+	}
 	return nil
 }
 
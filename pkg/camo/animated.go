@@ -0,0 +1,127 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// animationSniffLen is the number of leading body bytes inspected when
+// detecting animated images. Detection is best effort: animation markers
+// (or additional frames) past this point are not seen.
+const animationSniffLen = 64 * 1024
+
+// isAnimatable returns true if the media type is an image format that may
+// contain an animation.
+func isAnimatable(mediatype string) bool {
+	switch mediatype {
+	case "image/gif", "image/png", "image/apng", "image/webp":
+		return true
+	}
+	return false
+}
+
+// isAnimated inspects the leading bytes of an image, and returns true if it
+// appears to be an animated gif, png (apng), or webp.
+func isAnimated(prefix []byte) bool {
+	switch {
+	case bytes.HasPrefix(prefix, []byte("GIF87a")), bytes.HasPrefix(prefix, []byte("GIF89a")):
+		return isAnimatedGIF(prefix)
+	case bytes.HasPrefix(prefix, []byte("\x89PNG\r\n\x1a\n")):
+		return isAnimatedPNG(prefix)
+	case len(prefix) >= 12 && bytes.Equal(prefix[0:4], []byte("RIFF")) && bytes.Equal(prefix[8:12], []byte("WEBP")):
+		return isAnimatedWebP(prefix)
+	}
+	return false
+}
+
+// skipSubBlocks returns the index just past a gif data sub-block sequence
+// starting at i.
+func skipSubBlocks(b []byte, i int) int {
+	for i < len(b) {
+		n := int(b[i])
+		i++
+		if n == 0 {
+			break
+		}
+		i += n
+	}
+	return i
+}
+
+// isAnimatedGIF walks the gif block structure, looking for either a looping
+// application extension or more than one image.
+func isAnimatedGIF(b []byte) bool {
+	// header (6) + logical screen descriptor (7)
+	if len(b) < 13 {
+		return false
+	}
+	i := 13
+	if b[10]&0x80 != 0 {
+		i += 3 * (1 << ((b[10] & 0x07) + 1))
+	}
+
+	frames := 0
+	for i < len(b) {
+		switch b[i] {
+		case 0x21: // extension
+			if i+2 >= len(b) {
+				return false
+			}
+			if b[i+1] == 0xff && i+14 <= len(b) && b[i+2] == 11 {
+				app := b[i+3 : i+14]
+				if bytes.Equal(app, []byte("NETSCAPE2.0")) || bytes.Equal(app, []byte("ANIMEXTS1.0")) {
+					return true
+				}
+			}
+			i = skipSubBlocks(b, i+2)
+		case 0x2c: // image descriptor
+			frames++
+			if frames > 1 {
+				return true
+			}
+			if i+10 > len(b) {
+				return false
+			}
+			packed := b[i+9]
+			i += 10
+			if packed&0x80 != 0 {
+				i += 3 * (1 << ((packed & 0x07) + 1))
+			}
+			// lzw minimum code size, then image data
+			i = skipSubBlocks(b, i+1)
+		default: // trailer, or garbage
+			return false
+		}
+	}
+	return false
+}
+
+// isAnimatedPNG looks for an apng animation control chunk, which must appear
+// before the first image data chunk.
+func isAnimatedPNG(b []byte) bool {
+	i := 8
+	for i+8 <= len(b) {
+		length := int(binary.BigEndian.Uint32(b[i : i+4]))
+		switch string(b[i+4 : i+8]) {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+		// length + type + data + crc
+		i += 12 + length
+	}
+	return false
+}
+
+// isAnimatedWebP checks the animation flag of an extended format webp.
+func isAnimatedWebP(b []byte) bool {
+	if len(b) < 21 || !bytes.Equal(b[12:16], []byte("VP8X")) {
+		return false
+	}
+	return b[20]&0x02 != 0
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeGIF(t *testing.T, frames int, loop bool) []byte {
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+		img.SetColorIndex(i%4, i%4, 1)
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+	}
+	if !loop {
+		// -1 means play once, and omits the looping extension
+		g.LoopCount = -1
+	}
+	var b bytes.Buffer
+	assert.Nil(t, gif.EncodeAll(&b, g))
+	return b.Bytes()
+}
+
+func makePNG(t *testing.T) []byte {
+	var b bytes.Buffer
+	assert.Nil(t, png.Encode(&b, image.NewGray(image.Rect(0, 0, 4, 4))))
+	return b.Bytes()
+}
+
+// makeAPNG injects an (unchecked crc) acTL chunk after IHDR.
+func makeAPNG(t *testing.T) []byte {
+	p := makePNG(t)
+	// signature (8) + IHDR (4 + 4 + 13 + 4)
+	ihdrEnd := 8 + 25
+	actl := []byte{0, 0, 0, 8, 'a', 'c', 'T', 'L', 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0}
+	out := append([]byte{}, p[:ihdrEnd]...)
+	out = append(out, actl...)
+	return append(out, p[ihdrEnd:]...)
+}
+
+func makeWebP(animated bool) []byte {
+	var flags byte
+	if animated {
+		flags = 0x02
+	}
+	b := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00")
+	b = append(b, flags, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	return b
+}
+
+func TestIsAnimated(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		name     string
+		data     []byte
+		animated bool
+	}{
+		{"static gif", makeGIF(t, 1, false), false},
+		{"looping gif", makeGIF(t, 3, true), true},
+		{"play once gif", makeGIF(t, 3, false), true},
+		{"static png", makePNG(t), false},
+		{"apng", makeAPNG(t), true},
+		{"static webp", makeWebP(false), false},
+		{"animated webp", makeWebP(true), true},
+		{"truncated gif", []byte("GIF89a\x01"), false},
+		{"garbage", []byte("not an image"), false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.animated, isAnimated(tt.data), tt.name)
+	}
+}
+
+func TestAnimatedImages(t *testing.T) {
+	t.Parallel()
+
+	animated := makeGIF(t, 3, true)
+	static := makeGIF(t, 1, false)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		switch r.URL.Path {
+		case "/animated.gif":
+			w.Write(animated) // #nosec G104
+		case "/static.gif":
+			w.Write(static) // #nosec G104
+		}
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+
+	// allowed by default, and relayed untouched (all frames intact)
+	resp, err := makeTestReq(ts.URL+"/animated.gif", 200, c)
+	if assert.Nil(t, err) {
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, animated, body)
+		g, err := gif.DecodeAll(bytes.NewReader(body))
+		if assert.Nil(t, err) {
+			assert.Equal(t, 3, len(g.Image))
+		}
+	}
+
+	c.DisallowAnimated = true
+	resp, err = makeTestReq(ts.URL+"/animated.gif", 400, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "Animated image rejected\n", resp)
+	}
+
+	// static images still pass, and peeked bytes are not lost
+	resp, err = makeTestReq(ts.URL+"/static.gif", 200, c)
+	if assert.Nil(t, err) {
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, static, body)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum number of clients tracked by the bandwidth limiter. once reached,
+// idle clients are dropped, then arbitrary ones.
+const maxBandwidthClients = 10000
+
+// parseTrustedProxies parses Config.TrustedProxies, as cidrs or single ips.
+// Returns nil if none are configured.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, s := range proxies {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %q", s)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func (p *Proxy) isTrustedProxy(ip net.IP) bool {
+	for _, ipnet := range p.trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the ip of the client. When the request comes from a
+// trusted proxy, it is the right most X-Forwarded-For address that is not
+// itself a trusted proxy. Returns nil if no valid ip is found.
+func (p *Proxy) clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !p.isTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// a malformed entry can not be trusted past
+			break
+		}
+		ip = hop
+		if !p.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// bandwidthKey returns the key clients are tracked by. IPv6 clients are
+// grouped by /64, as a single host is commonly assigned a whole /64.
+func bandwidthKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+type bandwidthEntry struct {
+	start time.Time
+	// bytes in the current and previous windows
+	cur, prev int64
+}
+
+// bandwidthLimiter tracks the bytes sent to each client, over a sliding
+// window. The window is approximated by weighting the previous fixed window
+// by its overlap with the sliding one.
+type bandwidthLimiter struct {
+	limit  int64
+	window time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*bandwidthEntry
+}
+
+func newBandwidthLimiter(limit int64, window time.Duration) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string]*bandwidthEntry),
+	}
+}
+
+// roll advances e to the fixed window containing now.
+func (l *bandwidthLimiter) roll(e *bandwidthEntry, now time.Time) {
+	switch elapsed := now.Sub(e.start); {
+	case elapsed >= 2*l.window:
+		e.start, e.cur, e.prev = now, 0, 0
+	case elapsed >= l.window:
+		e.start, e.cur, e.prev = e.start.Add(l.window), 0, e.cur
+	}
+}
+
+// used returns the bytes sent to key over the sliding window ending at now.
+// l.mu must be held.
+func (l *bandwidthLimiter) used(key string, now time.Time) int64 {
+	e, ok := l.clients[key]
+	if !ok {
+		return 0
+	}
+	l.roll(e, now)
+	overlap := l.window - now.Sub(e.start)
+	return e.cur + int64(float64(e.prev)*float64(overlap)/float64(l.window))
+}
+
+// allow returns false if key has used up its budget.
+func (l *bandwidthLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used(key, time.Now()) < l.limit
+}
+
+// add records n bytes sent to key.
+func (l *bandwidthLimiter) add(key string, n int64) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.clients[key]
+	if !ok {
+		l.evict(now)
+		e = &bandwidthEntry{start: now}
+		l.clients[key] = e
+	}
+	l.roll(e, now)
+	e.cur += n
+}
+
+// evict makes room for a new client, once the limit of tracked clients is
+// reached. l.mu must be held.
+func (l *bandwidthLimiter) evict(now time.Time) {
+	if len(l.clients) < maxBandwidthClients {
+		return
+	}
+	for k, e := range l.clients {
+		if now.Sub(e.start) >= 2*l.window {
+			delete(l.clients, k)
+		}
+	}
+	// still full, so drop arbitrary clients
+	for k := range l.clients {
+		if len(l.clients) < maxBandwidthClients {
+			break
+		}
+		delete(l.clients, k)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BasicAuth is a username and password for HTTP Basic authentication.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// parseOriginBasicAuth validates and normalizes Config.OriginBasicAuth,
+// keying credentials by origin (scheme://host:port). Returns nil if no
+// credentials are configured.
+func parseOriginBasicAuth(creds map[string]BasicAuth) (map[string]BasicAuth, error) {
+	if len(creds) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[string]BasicAuth, len(creds))
+	for origin, auth := range creds {
+		key, err := parseOrigin(strings.TrimSpace(origin))
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin basic auth origin: %q", origin)
+		}
+		if auth.Username == "" || strings.Contains(auth.Username, ":") {
+			return nil, fmt.Errorf("invalid origin basic auth username for %s", key)
+		}
+		parsed[key] = auth
+	}
+	return parsed, nil
+}
+
+// parseOrigin normalizes an origin to scheme://host:port. Without a scheme,
+// the origin is https, so credentials are only sent over plain http when
+// explicitly configured. Without a port, the scheme default is used.
+func parseOrigin(origin string) (string, error) {
+	if !strings.Contains(origin, "://") {
+		origin = "https://" + origin
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Hostname() == "" ||
+		u.User != nil || u.RawQuery != "" || u.Fragment != "" || (u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("invalid origin: %q", origin)
+	}
+	return originKey(u), nil
+}
+
+// originKey returns the normalized scheme://host:port origin of u.
+func originKey(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if scheme == "http" {
+			port = "80"
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(normalizeHost(u.Hostname()), port)
+}
+
+// basicAuthTransport adds configured Basic auth credentials to requests for
+// their origin. Being applied per request (rather than on the initial
+// request), credentials are never sent to another origin a redirect points
+// to.
+type basicAuthTransport struct {
+	next  http.RoundTripper
+	creds map[string]BasicAuth
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	auth, ok := t.creds[originKey(req.URL)]
+	// credentials from a (signed) userinfo url take precedence
+	if ok && req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	// echoes the received Authorization header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Www-Authenticate", `Basic realm="test"`)
+		w.Write([]byte(r.Header.Get("Authorization"))) // #nosec G104
+	})
+	tsA := httptest.NewServer(handler)
+	defer tsA.Close()
+	// same host, on another port
+	tsB := httptest.NewServer(handler)
+	defer tsB.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.OriginBasicAuth = map[string]BasicAuth{
+		tsA.URL: {Username: "user", Password: "secret"},
+	}
+	expected := "Basic dXNlcjpzZWNyZXQ="
+
+	resp, err := makeTestReq(tsA.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, expected, resp)
+		// never relayed to the client
+		assert.Empty(t, resp.Header.Get("Authorization"))
+		assert.Empty(t, resp.Header.Get("Www-Authenticate"))
+	}
+
+	// other origins (ports) get no credentials
+	resp, err = makeTestReq(tsB.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "", resp)
+	}
+
+	// including on redirect from a credentialed origin
+	resp, err = makeTestReq(tsA.URL+"/redirect?to="+tsB.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "", resp)
+	}
+
+	// while redirects to a credentialed origin get them
+	resp, err = makeTestReq(tsB.URL+"/redirect?to="+tsA.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, expected, resp)
+	}
+
+	// a host without scheme is https only, so is never sent over plain http
+	c.OriginBasicAuth = map[string]BasicAuth{
+		tsA.Listener.Addr().String(): {Username: "user", Password: "secret"},
+	}
+	resp, err = makeTestReq(tsA.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "", resp)
+	}
+}
+
+func TestParseOriginBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	creds, err := parseOriginBasicAuth(map[string]BasicAuth{
+		" Example.COM. ":      {Username: "user", Password: "pass"},
+		"HTTP://example.org":  {Username: "user2", Password: "pass"},
+		"https://[::1]:8443/": {Username: "user3", Password: "pass"},
+		"example.net:8080":    {Username: "user4", Password: "pass"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]BasicAuth{
+		"https://example.com:443":  {"user", "pass"},
+		"http://example.org:80":    {"user2", "pass"},
+		"https://[::1]:8443":       {"user3", "pass"},
+		"https://example.net:8080": {"user4", "pass"},
+	}, creds)
+
+	creds, err = parseOriginBasicAuth(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, creds)
+
+	for _, bad := range []map[string]BasicAuth{
+		{"": {Username: "user"}},
+		{"ftp://example.com": {Username: "user"}},
+		{"https://example.com/path": {Username: "user"}},
+		{"https://u:p@example.com": {Username: "user"}},
+		{"example.com": {}},
+		{"example.com": {Username: "us:er"}},
+	} {
+		_, err := parseOriginBasicAuth(bad)
+		assert.NotNil(t, err, "%v", bad)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// cacheKey returns a canonical form of u, for use as a cache key, so that
+// urls differing only in insignificant ways map to the same entry. The scheme
+// and host are lowercased, default ports, the fragment, and an empty query
+// are dropped, and an empty path becomes "/". The query itself is kept
+// verbatim, as parameter order and encoding may be significant to the origin
+// (eg. presigned urls).
+//
+// The key is never used for fetching; the original url is.
+func cacheKey(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		// ipv6 literal
+		host = "[" + host + "]"
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	key := scheme + "://" + host + path
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheKeyEquivalent(t *testing.T) {
+	t.Parallel()
+
+	var equivalent = []struct {
+		want string
+		urls []string
+	}{
+		{"http://example.com/", []string{
+			"http://example.com",
+			"http://example.com/",
+			"http://example.com:80/",
+			"HTTP://Example.COM/",
+			"http://example.com/?",
+			"http://example.com/#frag",
+			"http://EXAMPLE.com:80?#",
+		}},
+		{"https://example.com/a.png?b=1&a=2", []string{
+			"https://example.com/a.png?b=1&a=2",
+			"https://example.com:443/a.png?b=1&a=2",
+			"https://Example.com/a.png?b=1&a=2#x",
+		}},
+		{"http://[::1]/a.png", []string{
+			"http://[::1]/a.png",
+			"http://[::1]:80/a.png",
+		}},
+	}
+
+	for _, tt := range equivalent {
+		for _, raw := range tt.urls {
+			u, err := url.Parse(raw)
+			if assert.Nil(t, err) {
+				assert.Equal(t, tt.want, cacheKey(u), "url %s", raw)
+			}
+		}
+	}
+}
+
+func TestCacheKeyDistinct(t *testing.T) {
+	t.Parallel()
+
+	var distinct = []string{
+		"http://example.com/a.png",
+		"https://example.com/a.png",
+		"http://example.com:8080/a.png",
+		"https://example.com:80/a.png",
+		"http://example.com/A.png",
+		"http://example.com/a.png?a=2&b=1",
+		"http://example.com/a.png?b=1&a=2",
+		"http://example.com/a%2Fb.png",
+		"http://example.com/a/b.png",
+		"http://[::1]:8080/a.png",
+	}
+
+	seen := make(map[string]string)
+	for _, raw := range distinct {
+		u, err := url.Parse(raw)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		key := cacheKey(u)
+		if other, ok := seen[key]; ok {
+			t.Errorf("%s and %s share cache key %s", raw, other, key)
+		}
+		seen[key] = raw
+	}
+}
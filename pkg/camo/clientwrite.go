@@ -0,0 +1,34 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// context key for the server's ResponseWriter
+type responseWriterKey struct{}
+
+// PreserveResponseController returns a handler that records the server's
+// ResponseWriter in the request context, before calling h. Handlers that
+// wrap the ResponseWriter without an Unwrap method (eg. the prometheus
+// instrumentation handlers) hide its write deadline support, which
+// Config.ClientWriteTimeout requires. Wrap the outermost handler with it.
+func PreserveResponseController(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), responseWriterKey{}, w)))
+	})
+}
+
+// setWriteDeadline sets the write deadline of the response to req, through
+// the server's ResponseWriter when recorded by PreserveResponseController.
+func setWriteDeadline(w http.ResponseWriter, req *http.Request, deadline time.Time) error {
+	if sw, ok := req.Context().Value(responseWriterKey{}).(http.ResponseWriter); ok {
+		w = sw
+	}
+	return http.NewResponseController(w).SetWriteDeadline(deadline)
+}
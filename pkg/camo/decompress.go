@@ -0,0 +1,94 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// decompressLimit returns the maximum allowed decompressed size for a
+// compressed body of length n. A zero value for either maxRatio or maxSize
+// disables that limit.
+func decompressLimit(n int, maxRatio int, maxSize int64) int64 {
+	limit := maxSize
+	if maxRatio > 0 {
+		ratioLimit := int64(n) * int64(maxRatio)
+		if limit <= 0 || ratioLimit < limit {
+			limit = ratioLimit
+		}
+	}
+	return limit
+}
+
+// hasInspectableBody returns true if resp has a full body to inspect for
+// decompression bombs.
+func hasInspectableBody(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || resp.ContentLength == 0 {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	return true
+}
+
+// inspectEncodedBody reads a content-encoded body from r (up to readLimit
+// bytes), and decompresses it to verify the decompressed size stays within
+// the configured ratio and absolute limits. The compressed body is returned
+// so it can then be sent to the client as is.
+func inspectEncodedBody(contentEncoding string, r io.Reader, readLimit int64, maxRatio int, maxSize int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, readLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	// compressed body alone is already too large
+	if int64(len(body)) > readLimit {
+		return nil, fmt.Errorf("encoded body too large: %w", ErrCompressionBomb)
+	}
+	// nothing to decompress
+	if len(body) == 0 {
+		return body, nil
+	}
+
+	var zr io.Reader
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		gzr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrBadEncoding)
+		}
+		zr = gzr
+	case "deflate":
+		zlr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", err, ErrBadEncoding)
+		}
+		zr = zlr
+	default:
+		// includes stacked encodings (eg. `gzip, gzip`), which would
+		// otherwise be a convenient way to nest bombs.
+		return nil, fmt.Errorf("%s: %w", contentEncoding, ErrBadEncoding)
+	}
+
+	limit := decompressLimit(len(body), maxRatio, maxSize)
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(zr, limit+1))
+	if n > limit {
+		return nil, fmt.Errorf("decompressed %d bytes from %d: %w", n, len(body), ErrCompressionBomb)
+	}
+	// tolerate truncated streams (eg. partial content), as the bytes that
+	// were decompressed are still within limits.
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%s: %w", err, ErrBadEncoding)
+	}
+	return body, nil
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// egressDialer wraps a net.Dialer, binding each outgoing connection to the
+// next local address from a fixed set in round robin order. ipv4 and ipv6
+// addresses are rotated separately, and picked by the family of the target
+// address.
+type egressDialer struct {
+	dialer *net.Dialer
+	addrs4 []*net.TCPAddr
+	addrs6 []*net.TCPAddr
+	next4  uint32
+	next6  uint32
+}
+
+// nextAddr returns the next local address in the rotation for the family of
+// ip, or nil if there are no egress ips of that family.
+func (ed *egressDialer) nextAddr(ip net.IP) *net.TCPAddr {
+	addrs, next := ed.addrs6, &ed.next6
+	if ip.To4() != nil {
+		addrs, next = ed.addrs4, &ed.next4
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	n := atomic.AddUint32(next, 1) - 1
+	return addrs[n%uint32(len(addrs))]
+}
+
+// DialContext dials the address using the next local address in the
+// rotation as the source address. Hostnames are resolved first, and each
+// address with egress ips of its family is tried in order. Addresses of a
+// family without egress ips are never dialed, failing with ErrNoEgressIP.
+func (ed *egressDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s is not a valid host/port pair: %w", address, err, ErrInvalidHostPort)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ipNetwork := "ip"
+		switch network {
+		case "tcp4":
+			ipNetwork = "ip4"
+		case "tcp6":
+			ipNetwork = "ip6"
+		}
+		resolver := ed.dialer.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		ips, err = resolver.LookupIP(ctx, ipNetwork, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		laddr := ed.nextAddr(ip)
+		if laddr == nil {
+			continue
+		}
+		// shallow copy the template dialer, so that setting LocalAddr is
+		// safe for concurrent use.
+		d := *ed.dialer
+		d.LocalAddr = laddr
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("%s: %w", address, ErrNoEgressIP)
+	}
+	return nil, firstErr
+}
+
+// parseEgressIPs validates and converts a list of ip address strings into
+// local tcp addresses suitable for use as a net.Dialer LocalAddr.
+func parseEgressIPs(ips []string) ([]*net.TCPAddr, error) {
+	addrs := make([]*net.TCPAddr, 0, len(ips))
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid egress ip: %s", s)
+		}
+		if ip.IsUnspecified() || ip.IsMulticast() {
+			return nil, fmt.Errorf("unusable egress ip: %s", s)
+		}
+		addrs = append(addrs, &net.TCPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+func newEgressDialer(dialer *net.Dialer, ips []string) (*egressDialer, error) {
+	addrs, err := parseEgressIPs(ips)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no egress ips supplied")
+	}
+	ed := &egressDialer{dialer: dialer}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ed.addrs4 = append(ed.addrs4, addr)
+		} else {
+			ed.addrs6 = append(ed.addrs6, addr)
+		}
+	}
+	return ed, nil
+}
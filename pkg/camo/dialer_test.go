@@ -0,0 +1,144 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEgressDialerRotation(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("unable to listen on loopback")
+	}
+	defer ln.Close()
+
+	seen := make(chan string, 6)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			seen <- host
+			conn.Close()
+		}
+	}()
+
+	ed, err := newEgressDialer(
+		&net.Dialer{Timeout: 1 * time.Second},
+		[]string{"127.0.0.1", "127.0.0.2", "127.0.0.3"},
+	)
+	assert.Nil(t, err)
+
+	expected := []string{
+		"127.0.0.1", "127.0.0.2", "127.0.0.3",
+		"127.0.0.1", "127.0.0.2", "127.0.0.3",
+	}
+	for _, want := range expected {
+		conn, err := ed.DialContext(context.Background(), "tcp4", ln.Addr().String())
+		if err != nil {
+			t.Skipf("unable to bind loopback alias: %s", err)
+		}
+		conn.Close()
+		select {
+		case got := <-seen:
+			assert.Equal(t, want, got)
+		case <-time.After(1 * time.Second):
+			t.Fatal("timed out waiting for connection")
+		}
+	}
+}
+
+func TestEgressDialerMixedFamilies(t *testing.T) {
+	t.Parallel()
+
+	ed, err := newEgressDialer(
+		&net.Dialer{Timeout: 1 * time.Second},
+		[]string{"127.0.0.1", "2001:db8::1", "192.0.2.1"},
+	)
+	assert.Nil(t, err)
+
+	// each family rotates on its own
+	v4, v6 := net.ParseIP("198.51.100.1"), net.ParseIP("2001:db8::2")
+	assert.Equal(t, "127.0.0.1", ed.nextAddr(v4).IP.String())
+	assert.Equal(t, "2001:db8::1", ed.nextAddr(v6).IP.String())
+	assert.Equal(t, "192.0.2.1", ed.nextAddr(v4).IP.String())
+	assert.Equal(t, "2001:db8::1", ed.nextAddr(v6).IP.String())
+	assert.Equal(t, "127.0.0.1", ed.nextAddr(v4).IP.String())
+
+	// a target with no egress ips of its family is not dialed
+	ed, err = newEgressDialer(&net.Dialer{Timeout: 1 * time.Second}, []string{"127.0.0.1"})
+	assert.Nil(t, err)
+	assert.Nil(t, ed.nextAddr(v6))
+	_, err = ed.DialContext(context.Background(), "tcp", "[::1]:80")
+	assert.True(t, errors.Is(err, ErrNoEgressIP), "err: %v", err)
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("unable to listen on loopback")
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// an ipv4 target is dialed from the ipv4 egress ip
+	ed, err = newEgressDialer(&net.Dialer{Timeout: 1 * time.Second}, []string{"::1", "127.0.0.1"})
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		conn, err := ed.DialContext(context.Background(), "tcp", ln.Addr().String())
+		if assert.Nil(t, err) {
+			assert.Equal(t, "127.0.0.1", conn.LocalAddr().(*net.TCPAddr).IP.String())
+			conn.Close()
+		}
+	}
+}
+
+func TestEgressIPsValidation(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		ips   []string
+		valid bool
+	}{
+		{[]string{"192.0.2.1"}, true},
+		{[]string{"192.0.2.1", "2001:db8::1"}, true},
+		{[]string{"192.0.2.1", "bogus"}, false},
+		{[]string{"0.0.0.0"}, false},
+		{[]string{"::"}, false},
+		{[]string{"224.0.0.1"}, false},
+		{[]string{}, false},
+	}
+
+	for _, tt := range tests {
+		_, err := newEgressDialer(&net.Dialer{}, tt.ips)
+		if tt.valid {
+			assert.Nil(t, err, "expected valid: %v", tt.ips)
+		} else {
+			assert.NotNil(t, err, "expected invalid: %v", tt.ips)
+		}
+	}
+
+	c := camoConfig
+	c.EgressIPs = []string{"not-an-ip"}
+	_, err := New(c)
+	assert.NotNil(t, err)
+}
@@ -22,10 +22,46 @@ type DecoderFunc func([]byte, string, string) (string, error)
 // EncoderFunc is a function type that defines a url encoder.
 type EncoderFunc func([]byte, string) string
 
-func validateURL(hmackey *[]byte, macbytes *[]byte, urlbytes *[]byte) error {
-	mac := hmac.New(sha1.New, *hmackey)
-	mac.Write(*urlbytes) // #nosec G104 -- doesn't apply to hmac
-	macSum := mac.Sum(nil)
+// MessageFormat selects the message a url signature is computed over.
+// Different camo implementations sign different messages, so go-camo can be
+// configured to validate urls produced by any of them.
+type MessageFormat string
+
+const (
+	// MessageURL signs the origin url. This is the format used by the
+	// original camo, and the default.
+	MessageURL MessageFormat = "url"
+	// MessagePath signs the encoded url path component, including its
+	// leading slash (eg. "/687474..."), as done by path signing
+	// implementations.
+	MessagePath MessageFormat = "path"
+)
+
+// ValidMessageFormat reports whether f is a supported message format.
+func ValidMessageFormat(f MessageFormat) bool {
+	switch f {
+	case MessageURL, MessagePath:
+		return true
+	}
+	return false
+}
+
+// message returns the bytes signed for an origin url, and its encoded form.
+func (f MessageFormat) message(urlBytes []byte, encURL string) []byte {
+	if f == MessagePath {
+		return []byte("/" + encURL)
+	}
+	return urlBytes
+}
+
+func sign(hmacKey []byte, msg []byte) []byte {
+	mac := hmac.New(sha1.New, hmacKey)
+	mac.Write(msg) // #nosec G104 -- doesn't apply to hmac
+	return mac.Sum(nil)
+}
+
+func validateURL(hmackey *[]byte, macbytes *[]byte, msgbytes *[]byte) error {
+	macSum := sign(*hmackey, *msgbytes)
 
 	// ensure lengths are equal. if not, return false
 	if len(macSum) != len(*macbytes) {
@@ -55,6 +91,10 @@ func b64decode(str string) ([]byte, error) {
 // unencodes the url, returning the url (if valid) and whether the
 // HMAC was verified.
 func HexDecodeURL(hmackey []byte, hexdig string, hexURL string) (string, error) {
+	return hexDecodeURL(MessageURL, hmackey, hexdig, hexURL)
+}
+
+func hexDecodeURL(f MessageFormat, hmackey []byte, hexdig string, hexURL string) (string, error) {
 	urlBytes, err := hex.DecodeString(hexURL)
 	if err != nil {
 		return "", fmt.Errorf("bad url decode")
@@ -64,7 +104,8 @@ func HexDecodeURL(hmackey []byte, hexdig string, hexURL string) (string, error)
 		return "", fmt.Errorf("bad mac decode")
 	}
 
-	if err = validateURL(&hmackey, &macBytes, &urlBytes); err != nil {
+	msgBytes := f.message(urlBytes, hexURL)
+	if err = validateURL(&hmackey, &macBytes, &msgBytes); err != nil {
 		return "", fmt.Errorf("invalid signature: %s", err)
 	}
 	return string(urlBytes), nil
@@ -73,19 +114,44 @@ func HexDecodeURL(hmackey []byte, hexdig string, hexURL string) (string, error)
 // HexEncodeURL takes an HMAC key and a url, and returns url
 // path partial consisitent of signature and encoded url.
 func HexEncodeURL(hmacKey []byte, oURL string) string {
+	return HexEncodeURLFormat(MessageURL, hmacKey, oURL)
+}
+
+// HexEncodeURLFormat is like HexEncodeURL, but signs the message selected by
+// the given format.
+func HexEncodeURLFormat(f MessageFormat, hmacKey []byte, oURL string) string {
 	oBytes := []byte(oURL)
-	mac := hmac.New(sha1.New, hmacKey)
-	mac.Write(oBytes) // #nosec G104 -- doesn't apply to hmac
-	macSum := hex.EncodeToString(mac.Sum(nil))
 	encodedURL := hex.EncodeToString(oBytes)
+	macSum := hex.EncodeToString(sign(hmacKey, f.message(oBytes, encodedURL)))
 	hexURL := "/" + macSum + "/" + encodedURL
 	return hexURL
 }
 
+// HexEncodeURLs is like HexEncodeURL, but signs a batch of urls, returning
+// the encoded url path partials in the same order. The HMAC state is reused
+// between urls, which avoids rekeying for each url.
+func HexEncodeURLs(hmacKey []byte, oURLs []string) []string {
+	mac := hmac.New(sha1.New, hmacKey)
+	sum := make([]byte, 0, mac.Size())
+	out := make([]string, len(oURLs))
+	for i, oURL := range oURLs {
+		oBytes := []byte(oURL)
+		mac.Reset()
+		mac.Write(oBytes) // #nosec G104 -- doesn't apply to hmac
+		sum = mac.Sum(sum[:0])
+		out[i] = "/" + hex.EncodeToString(sum) + "/" + hex.EncodeToString(oBytes)
+	}
+	return out
+}
+
 // B64DecodeURL ensures the url is properly verified via HMAC, and then
 // unencodes the url, returning the url (if valid) and whether the
 // HMAC was verified.
 func B64DecodeURL(hmackey []byte, encdig string, encURL string) (string, error) {
+	return b64DecodeURL(MessageURL, hmackey, encdig, encURL)
+}
+
+func b64DecodeURL(f MessageFormat, hmackey []byte, encdig string, encURL string) (string, error) {
 	urlBytes, err := b64decode(encURL)
 	if err != nil {
 		return "", fmt.Errorf("bad url decode")
@@ -95,24 +161,56 @@ func B64DecodeURL(hmackey []byte, encdig string, encURL string) (string, error)
 		return "", fmt.Errorf("bad mac decode")
 	}
 
-	if err := validateURL(&hmackey, &macBytes, &urlBytes); err != nil {
+	msgBytes := f.message(urlBytes, encURL)
+	if err := validateURL(&hmackey, &macBytes, &msgBytes); err != nil {
 		return "", fmt.Errorf("invalid signature: %s", err)
 	}
 	return string(urlBytes), nil
 }
 
+// B64DecodeURLUnsigned unencodes a base64 encoded url, without any HMAC
+// verification. It must only be used for insecure (development) setups.
+func B64DecodeURLUnsigned(encURL string) (string, error) {
+	urlBytes, err := b64decode(encURL)
+	if err != nil {
+		return "", fmt.Errorf("bad url decode")
+	}
+	return string(urlBytes), nil
+}
+
 // B64EncodeURL takes an HMAC key and a url, and returns url
 // path partial consisitent of signature and encoded url.
 func B64EncodeURL(hmacKey []byte, oURL string) string {
+	return B64EncodeURLFormat(MessageURL, hmacKey, oURL)
+}
+
+// B64EncodeURLFormat is like B64EncodeURL, but signs the message selected by
+// the given format.
+func B64EncodeURLFormat(f MessageFormat, hmacKey []byte, oURL string) string {
 	oBytes := []byte(oURL)
-	mac := hmac.New(sha1.New, hmacKey)
-	mac.Write(oBytes) // #nosec G104 -- doesn't apply to hmac
-	macSum := b64encode(mac.Sum(nil))
 	encodedURL := b64encode(oBytes)
+	macSum := b64encode(sign(hmacKey, f.message(oBytes, encodedURL)))
 	encURL := "/" + macSum + "/" + encodedURL
 	return encURL
 }
 
+// B64EncodeURLs is like B64EncodeURL, but signs a batch of urls, returning
+// the encoded url path partials in the same order. The HMAC state is reused
+// between urls, which avoids rekeying for each url.
+func B64EncodeURLs(hmacKey []byte, oURLs []string) []string {
+	mac := hmac.New(sha1.New, hmacKey)
+	sum := make([]byte, 0, mac.Size())
+	out := make([]string, len(oURLs))
+	for i, oURL := range oURLs {
+		oBytes := []byte(oURL)
+		mac.Reset()
+		mac.Write(oBytes) // #nosec G104 -- doesn't apply to hmac
+		sum = mac.Sum(sum[:0])
+		out[i] = "/" + b64encode(sum) + "/" + b64encode(oBytes)
+	}
+	return out
+}
+
 // DecodeURL ensures the url is properly verified via HMAC, and then
 // unencodes the url, returning the url (if valid) and whether the
 // HMAC was verified. Tries either HexDecode or B64Decode, depending on the
@@ -134,3 +232,117 @@ func DecodeURL(hmackey []byte, encdig string, encURL string) (string, bool) {
 	}
 	return urlBytes, true
 }
+
+// DecodeURLMulti is like DecodeURL, but verifies the HMAC against each of the
+// provided keys in order, returning the url and the index of the first key
+// that verified it. Returns an index of -1 if no key verified the url.
+func DecodeURLMulti(hmackeys [][]byte, encdig string, encURL string) (string, int) {
+	return DecodeURLMultiFormat(MessageURL, hmackeys, encdig, encURL)
+}
+
+// DecodeURLMultiFormat is like DecodeURLMulti, but verifies the HMAC over the
+// message selected by the given format.
+func DecodeURLMultiFormat(f MessageFormat, hmackeys [][]byte, encdig string, encURL string) (string, int) {
+	decoder := b64DecodeURL
+	if len(encdig) == 40 {
+		decoder = hexDecodeURL
+	}
+
+	for i, hmackey := range hmackeys {
+		urlBytes, err := decoder(f, hmackey, encdig, encURL)
+		if err == nil {
+			return urlBytes, i
+		}
+		if mlog.HasDebug() {
+			mlog.Debugf("Bad Decode of URL with key %d: %s", i, err)
+		}
+	}
+	return "", -1
+}
+
+// HexDigest returns the hex encoded HMAC of an unencoded origin url, as used
+// by the query string url format (eg. `/?url=<url>&digest=<hmac>`).
+func HexDigest(hmacKey []byte, oURL string) string {
+	return hex.EncodeToString(sign(hmacKey, []byte(oURL)))
+}
+
+// VerifyURLMulti verifies the HMAC (hex or base64 encoded) of an unencoded
+// origin url, as used by the query string url format (eg.
+// `/?url=<url>&digest=<hmac>`), against each of the provided keys in order.
+// Returns the index of the first key that verified it, or -1 if none did.
+func VerifyURLMulti(hmackeys [][]byte, encdig string, oURL string) int {
+	var macBytes []byte
+	var err error
+	if len(encdig) == 40 {
+		macBytes, err = hex.DecodeString(encdig)
+	} else {
+		macBytes, err = b64decode(encdig)
+	}
+	if err != nil {
+		if mlog.HasDebug() {
+			mlog.Debugf("Bad Decode of URL: bad mac decode")
+		}
+		return -1
+	}
+
+	urlBytes := []byte(oURL)
+	for i, hmackey := range hmackeys {
+		err = validateURL(&hmackey, &macBytes, &urlBytes)
+		if err == nil {
+			return i
+		}
+		if mlog.HasDebug() {
+			mlog.Debugf("Bad Decode of URL with key %d: invalid signature: %s", i, err)
+		}
+	}
+	return -1
+}
+
+// payloadSep separates the origin url from the optional constraints (a
+// pinned content type, then an allowed referer host) in a signed payload.
+// urls can not contain NUL bytes, so unconstrained payloads are unaffected.
+const payloadSep = "\x00"
+
+// PinContentType returns a payload that, once signed by one of the encoders,
+// restricts origin responses to content types matching pattern (eg.
+// `image/*` or `image/png`).
+func PinContentType(oURL string, pattern string) string {
+	return oURL + payloadSep + pattern
+}
+
+// PinReferer returns a payload that, once signed by one of the encoders, is
+// only served to requests with a Referer on host (without port). payload may
+// be a plain url, or already pin a content type.
+func PinReferer(payload string, host string) string {
+	if !strings.Contains(payload, payloadSep) {
+		// no pinned content type
+		payload += payloadSep
+	}
+	return payload + payloadSep + strings.ToLower(host)
+}
+
+// SplitReferer splits a decoded payload into the remaining payload, and the
+// allowed referer host (empty if the payload is not pinned to a referer).
+// It must be called before SplitContentType.
+func SplitReferer(payload string) (string, string) {
+	i := strings.Index(payload, payloadSep)
+	if i < 0 {
+		return payload, ""
+	}
+	j := strings.Index(payload[i+len(payloadSep):], payloadSep)
+	if j < 0 {
+		return payload, ""
+	}
+	j += i + len(payloadSep)
+	return payload[:j], payload[j+len(payloadSep):]
+}
+
+// SplitContentType splits a decoded payload into the origin url, and the
+// pinned content type pattern (empty if the payload is not pinned).
+func SplitContentType(payload string) (string, string) {
+	i := strings.Index(payload, payloadSep)
+	if i < 0 {
+		return payload, ""
+	}
+	return payload[:i], payload[i+len(payloadSep):]
+}
@@ -6,6 +6,7 @@ package encoding
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -77,6 +78,150 @@ func TestDecoder(t *testing.T) {
 	}
 }
 
+func TestMultiKeyDecoder(t *testing.T) {
+	t.Parallel()
+	for _, p := range dectests {
+		for i, keys := range [][][]byte{
+			{[]byte(p.hmac)},
+			{[]byte("other"), []byte(p.hmac)},
+			{[]byte("other"), []byte("another"), []byte(p.hmac)},
+		} {
+			decodedURL, idx := DecodeURLMulti(keys, p.edig, p.eURL)
+			assert.Equal(t, i, idx, "wrong key index")
+			assert.Equal(t, p.sURL, decodedURL, "decoded url does not match")
+		}
+
+		decodedURL, idx := DecodeURLMulti([][]byte{[]byte("other"), []byte("another")}, p.edig, p.eURL)
+		assert.Equal(t, -1, idx, "decoded url verfied when it shouldn't have")
+		assert.Equal(t, "", decodedURL, "decoded url result not empty")
+	}
+}
+
+// path message signatures, computed with a reference implementation:
+// printf '%s' "/<encoded url>" | openssl dgst -sha1 -hmac test
+var pathtests = []struct {
+	encoder func(MessageFormat, []byte, string) string
+	edig    string
+	eURL    string
+}{
+	{HexEncodeURLFormat, "681220c2566846130fdb97de729104793ea7d4d8",
+		"687474703a2f2f676f6c616e672e6f72672f646f632f676f706865722f66726f6e74706167652e706e67"},
+	{B64EncodeURLFormat, "S4U4d4w0STUnzaVNagKIQnH4sT4",
+		"aHR0cDovL2dvbGFuZy5vcmcvZG9jL2dvcGhlci9mcm9udHBhZ2UucG5n"},
+}
+
+func TestMessageFormat(t *testing.T) {
+	t.Parallel()
+	sURL := "http://golang.org/doc/gopher/frontpage.png"
+	hmacKey := []byte("test")
+	for _, p := range pathtests {
+		encodedURL := p.encoder(MessagePath, hmacKey, sURL)
+		assert.Equal(t, fmt.Sprintf("/%s/%s", p.edig, p.eURL), encodedURL, "encoded url does not match")
+
+		decodedURL, idx := DecodeURLMultiFormat(MessagePath, [][]byte{hmacKey}, p.edig, p.eURL)
+		assert.Equal(t, 0, idx, "decoded url failed to verify")
+		assert.Equal(t, sURL, decodedURL, "decoded url does not match")
+
+		// signatures are not interchangeable between formats
+		_, idx = DecodeURLMulti([][]byte{hmacKey}, p.edig, p.eURL)
+		assert.Equal(t, -1, idx, "path signature verified as url signature")
+	}
+
+	for _, p := range dectests {
+		_, idx := DecodeURLMultiFormat(MessagePath, [][]byte{[]byte(p.hmac)}, p.edig, p.eURL)
+		assert.Equal(t, -1, idx, "url signature verified as path signature")
+	}
+
+	assert.True(t, ValidMessageFormat(MessageURL))
+	assert.True(t, ValidMessageFormat(MessagePath))
+	assert.False(t, ValidMessageFormat("digest"))
+}
+
+// legacy camo (node.js) 'Path Format' urls, as generated by camo with the
+// key from its test suite.
+var legacyCamoKey = []byte("0x24FEEDFACEDEADBEEFCAFE")
+
+var legacyCamoTests = []struct {
+	edig string
+	eURL string
+	sURL string
+}{
+	{"9f9a6cee23e2f8b9e281f6ee4b6f70d0877c4306",
+		"687474703a2f2f6d656469612e656261756d73776f726c642e636f6d2f706963747572652f4d696e63656d6561742f50696d702e6a7067",
+		"http://media.ebaumsworld.com/picture/Mincemeat/Pimp.jpg"},
+	{"b51a07e54d187d072eb404c25f73454b243cb9d3",
+		"68747470733a2f2f6578616d706c652e6f72672f696d616765732f6361742e706e673f73697a653d6c6172676526666d743d706e67",
+		"https://example.org/images/cat.png?size=large&fmt=png"},
+	{"0e2745529720d1d1074de235a969d0d1e15ad3ff",
+		"687474703a2f2f6578616d706c652e6f72672f2545362539372541352545362539432541432e676966",
+		"http://example.org/%E6%97%A5%E6%9C%AC.gif"},
+}
+
+func TestLegacyCamoURLs(t *testing.T) {
+	t.Parallel()
+	for _, p := range legacyCamoTests {
+		decodedURL, ok := DecodeURL(legacyCamoKey, p.edig, p.eURL)
+		assert.True(t, ok, "legacy url failed to verify")
+		assert.Equal(t, p.sURL, decodedURL, "decoded url does not match")
+
+		// with the key in any rotation position
+		decodedURL, idx := DecodeURLMulti([][]byte{[]byte("other"), legacyCamoKey}, p.edig, p.eURL)
+		assert.Equal(t, 1, idx, "wrong key index")
+		assert.Equal(t, p.sURL, decodedURL, "decoded url does not match")
+
+		// encoding produces the identical legacy url
+		assert.Equal(t, "/"+p.edig+"/"+p.eURL, HexEncodeURL(legacyCamoKey, p.sURL))
+
+		// tampered digest or url are rejected
+		_, ok = DecodeURL(legacyCamoKey, strings.Repeat("0", 40), p.eURL)
+		assert.False(t, ok, "tampered digest verified")
+		_, ok = DecodeURL(legacyCamoKey, p.edig, p.eURL[:len(p.eURL)-2])
+		assert.False(t, ok, "tampered url verified")
+	}
+}
+
+func TestVerifyURLMulti(t *testing.T) {
+	t.Parallel()
+	for _, p := range dectests {
+		for i, keys := range [][][]byte{
+			{[]byte(p.hmac)},
+			{[]byte("other"), []byte(p.hmac)},
+		} {
+			assert.Equal(t, i, VerifyURLMulti(keys, p.edig, p.sURL), "wrong key index")
+		}
+		assert.Equal(t, -1, VerifyURLMulti([][]byte{[]byte("other")}, p.edig, p.sURL))
+		assert.Equal(t, -1, VerifyURLMulti([][]byte{[]byte(p.hmac)}, p.edig, p.sURL+"x"))
+	}
+	assert.Equal(t, -1, VerifyURLMulti([][]byte{[]byte("test")}, "", "http://example.com/"))
+	assert.Equal(t, -1, VerifyURLMulti([][]byte{[]byte("test")}, "!!", "http://example.com/"))
+}
+
+func batchURLs(n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://golang.org/doc/gopher/frontpage-%d.png", i)
+	}
+	return urls
+}
+
+func TestBatchEncoder(t *testing.T) {
+	t.Parallel()
+	hmacKey := []byte("test")
+	urls := append(batchURLs(50), "", "http://golang.org/doc/gopher/frontpage.png")
+
+	hexURLs := HexEncodeURLs(hmacKey, urls)
+	b64URLs := B64EncodeURLs(hmacKey, urls)
+	assert.Len(t, hexURLs, len(urls))
+	assert.Len(t, b64URLs, len(urls))
+	for i, u := range urls {
+		assert.Equal(t, HexEncodeURL(hmacKey, u), hexURLs[i], "hex batch url does not match")
+		assert.Equal(t, B64EncodeURL(hmacKey, u), b64URLs[i], "base64 batch url does not match")
+	}
+
+	assert.Empty(t, HexEncodeURLs(hmacKey, nil))
+	assert.Empty(t, B64EncodeURLs(hmacKey, nil))
+}
+
 func BenchmarkHexEncoder(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		HexEncodeURL([]byte("test"), "http://golang.org/doc/gopher/frontpage.png")
@@ -89,6 +234,42 @@ func BenchmarkB64Encoder(b *testing.B) {
 	}
 }
 
+func BenchmarkB64EncoderLoop100(b *testing.B) {
+	urls := batchURLs(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, u := range urls {
+			B64EncodeURL([]byte("test"), u)
+		}
+	}
+}
+
+func BenchmarkB64EncoderBatch100(b *testing.B) {
+	urls := batchURLs(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		B64EncodeURLs([]byte("test"), urls)
+	}
+}
+
+func BenchmarkHexEncoderLoop100(b *testing.B) {
+	urls := batchURLs(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, u := range urls {
+			HexEncodeURL([]byte("test"), u)
+		}
+	}
+}
+
+func BenchmarkHexEncoderBatch100(b *testing.B) {
+	urls := batchURLs(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		HexEncodeURLs([]byte("test"), urls)
+	}
+}
+
 func BenchmarkHexDecoder(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		HexDecodeURL([]byte("test"), "0f6def1cb147b0e84f39cbddc5ea10c80253a6f3", "687474703a2f2f676f6c616e672e6f72672f646f632f676f706865722f66726f6e74706167652e706e67")
@@ -153,3 +334,59 @@ func TestBadDecodes(t *testing.T) {
 		assert.Equal(t, encodedURL, "", "decoded url result not empty")
 	}
 }
+
+func TestPinContentType(t *testing.T) {
+	t.Parallel()
+
+	oURL := "http://golang.org/doc/gopher/frontpage.png"
+	hmacKey := []byte("test")
+
+	encodedURL := B64EncodeURL(hmacKey, PinContentType(oURL, "image/*"))
+	comp := strings.Split(encodedURL, "/")
+	payload, ok := DecodeURL(hmacKey, comp[1], comp[2])
+	assert.True(t, ok)
+	sURL, pattern := SplitContentType(payload)
+	assert.Equal(t, oURL, sURL)
+	assert.Equal(t, "image/*", pattern)
+
+	// pinned and unpinned urls have different signatures
+	assert.NotEqual(t, B64EncodeURL(hmacKey, oURL), encodedURL)
+
+	sURL, pattern = SplitContentType(oURL)
+	assert.Equal(t, oURL, sURL)
+	assert.Equal(t, "", pattern)
+}
+
+func TestPinReferer(t *testing.T) {
+	t.Parallel()
+
+	oURL := "http://golang.org/doc/gopher/frontpage.png"
+	hmacKey := []byte("test")
+
+	var tests = []struct {
+		payload string
+		pattern string
+	}{
+		{PinReferer(oURL, "Example.com"), ""},
+		{PinReferer(PinContentType(oURL, "image/*"), "example.com"), "image/*"},
+	}
+
+	for _, tt := range tests {
+		encodedURL := B64EncodeURL(hmacKey, tt.payload)
+		comp := strings.Split(encodedURL, "/")
+		payload, ok := DecodeURL(hmacKey, comp[1], comp[2])
+		assert.True(t, ok)
+		payload, host := SplitReferer(payload)
+		assert.Equal(t, "example.com", host)
+		sURL, pattern := SplitContentType(payload)
+		assert.Equal(t, oURL, sURL)
+		assert.Equal(t, tt.pattern, pattern)
+	}
+
+	// unpinned, and content type only payloads
+	for _, payload := range []string{oURL, PinContentType(oURL, "image/*")} {
+		rest, host := SplitReferer(payload)
+		assert.Equal(t, payload, rest)
+		assert.Equal(t, "", host)
+	}
+}
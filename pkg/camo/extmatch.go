@@ -0,0 +1,50 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"path"
+	"strings"
+)
+
+// extensionMediaTypes maps well known file extensions to the media types
+// considered a match. The first entry is the canonical type, used when
+// relabeling.
+var extensionMediaTypes = map[string][]string{
+	".apng": {"image/apng", "image/png"},
+	".avif": {"image/avif"},
+	".bmp":  {"image/bmp", "image/x-ms-bmp"},
+	".gif":  {"image/gif"},
+	".ico":  {"image/x-icon", "image/vnd.microsoft.icon"},
+	".jfif": {"image/jpeg"},
+	".jpeg": {"image/jpeg", "image/pjpeg"},
+	".jpg":  {"image/jpeg", "image/pjpeg"},
+	".png":  {"image/png", "image/apng"},
+	".svg":  {"image/svg+xml"},
+	".tif":  {"image/tiff"},
+	".tiff": {"image/tiff"},
+	".webp": {"image/webp"},
+	".mp4":  {"video/mp4"},
+	".webm": {"video/webm", "audio/webm"},
+	".mp3":  {"audio/mpeg", "audio/mp3"},
+	".ogg":  {"audio/ogg", "video/ogg"},
+	".wav":  {"audio/wav", "audio/x-wav", "audio/wave"},
+}
+
+// extensionMediaType checks the media type against the extension of the url
+// path. Returns the canonical media type for the extension, and whether the
+// media type matches. Unknown (or missing) extensions always match.
+func extensionMediaType(urlPath, mediatype string) (string, bool) {
+	types, ok := extensionMediaTypes[strings.ToLower(path.Ext(urlPath))]
+	if !ok {
+		return "", true
+	}
+	for _, t := range types {
+		if t == mediatype {
+			return types[0], true
+		}
+	}
+	return types[0], false
+}
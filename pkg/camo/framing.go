@@ -0,0 +1,217 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// framingLinePrefix is the number of bytes of each response header line
+// kept while scanning, enough for the status code and the header names of
+// interest.
+const framingLinePrefix = 32
+
+// framingConn scans the raw header block of each http/1.x response read from
+// a connection, recording whether it has both a Transfer-Encoding and a
+// Content-Length header. The transport silently drops the Content-Length of
+// such a response (rfc7230 3.3.3), leaving no trace of the ambiguous framing
+// on the parsed response.
+//
+// Scanning restarts whenever a request is written, as responses are never
+// pipelined. Interim 1xx responses are skipped.
+type framingConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	done      bool
+	statusOK  bool // status line has been read
+	status    int
+	line      []byte
+	lineLen   int
+	sawTE     bool
+	sawCL     bool
+	ambiguous bool
+}
+
+func newFramingConn(conn net.Conn) *framingConn {
+	return &framingConn{Conn: conn, line: make([]byte, 0, framingLinePrefix)}
+}
+
+func (c *framingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.resetBlock()
+	c.done = false
+	c.ambiguous = false
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *framingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		if !c.done {
+			c.scan(b[:n])
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// resetBlock prepares for the next response header block.
+func (c *framingConn) resetBlock() {
+	c.statusOK = false
+	c.status = 0
+	c.line = c.line[:0]
+	c.lineLen = 0
+	c.sawTE = false
+	c.sawCL = false
+}
+
+func (c *framingConn) scan(b []byte) {
+	for i, ch := range b {
+		if ch != '\n' {
+			if len(c.line) < framingLinePrefix {
+				c.line = append(c.line, ch)
+			}
+			c.lineLen++
+			continue
+		}
+
+		line := strings.TrimSuffix(string(c.line), "\r")
+		empty := c.lineLen == 0 || c.lineLen == 1 && line == ""
+		c.line = c.line[:0]
+		c.lineLen = 0
+
+		switch {
+		case !c.statusOK:
+			c.statusOK = true
+			if fields := strings.Fields(line); len(fields) > 1 {
+				c.status, _ = strconv.Atoi(fields[1])
+			}
+		case empty:
+			// interim responses are followed by the final one
+			if c.status >= 100 && c.status < 200 && c.status != http.StatusSwitchingProtocols {
+				c.resetBlock()
+				c.scan(b[i+1:])
+				return
+			}
+			c.ambiguous = c.sawTE && c.sawCL
+			c.done = true
+			return
+		default:
+			if colon := strings.IndexByte(line, ':'); colon > 0 {
+				switch strings.ToLower(strings.TrimSpace(line[:colon])) {
+				case "transfer-encoding":
+					c.sawTE = true
+				case "content-length":
+					c.sawCL = true
+				}
+			}
+		}
+	}
+}
+
+// isAmbiguous returns true if the last response header block had both a
+// Transfer-Encoding and a Content-Length header.
+func (c *framingConn) isAmbiguous() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ambiguous
+}
+
+// tlsFramingConn is a framingConn over a tls connection. It exposes the
+// connection state, so the transport still reports it on responses.
+type tlsFramingConn struct {
+	*framingConn
+	tlsConn *tls.Conn
+}
+
+func (c *tlsFramingConn) ConnectionState() tls.ConnectionState {
+	return c.tlsConn.ConnectionState()
+}
+
+// framingDial wraps the connections dialed by dial in a framingConn.
+func framingDial(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return newFramingConn(conn), nil
+	}
+}
+
+// framingDialTLS wraps the tls connections dialed by dial in a
+// tlsFramingConn. Connections that negotiated http2 (which has no
+// Transfer-Encoding) are returned as is, as the transport only uses http2 on
+// a *tls.Conn.
+func framingDialTLS(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok || tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			return conn, nil
+		}
+		return &tlsFramingConn{framingConn: newFramingConn(tlsConn), tlsConn: tlsConn}, nil
+	}
+}
+
+// framingTransport rejects responses read from a framingConn with both a
+// Transfer-Encoding and a Content-Length header, with ErrAmbiguousFraming.
+// Connections tunneled through an https proxy are not inspected.
+type framingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *framingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var fc *framingConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			switch conn := info.Conn.(type) {
+			case *framingConn:
+				fc = conn
+			case *tlsFramingConn:
+				fc = conn.framingConn
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if fc != nil && fc.isAmbiguous() {
+		resp.Body.Close()
+		return nil, ErrAmbiguousFraming
+	}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the next round
+// tripper, if it supports it.
+func (t *framingTransport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if ci, ok := t.next.(closeIdler); ok {
+		ci.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chunkConn reads from r a few bytes at a time, and discards writes.
+type chunkConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *chunkConn) Read(b []byte) (int, error) {
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	return c.r.Read(b)
+}
+
+func (c *chunkConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestFramingConn(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		name      string
+		response  string
+		ambiguous bool
+	}{
+		{"chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false},
+		{"length", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", false},
+		{"both", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", true},
+		{"both bare lf", "HTTP/1.1 200 OK\nTRANSFER-ENCODING: chunked\ncontent-length: 2\n\n0\r\n\r\n", true},
+		{"long header", "HTTP/1.1 200 OK\r\nX-" + strings.Repeat("a", 100) + ": b\r\nContent-Length: 2\r\nTransfer-Encoding: chunked\r\n\r\n", true},
+		{"interim", "HTTP/1.1 103 Early Hints\r\nContent-Length: 2\r\n\r\nHTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", false},
+		{"after interim", "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\nTransfer-Encoding: chunked\r\n\r\n", true},
+		{"in body", "HTTP/1.1 200 OK\r\nContent-Length: 30\r\n\r\nTransfer-Encoding: chunked\r\n\r\n", false},
+	}
+
+	for _, tt := range tests {
+		fc := newFramingConn(&chunkConn{r: strings.NewReader(tt.response)})
+		_, err := fc.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		assert.Nil(t, err)
+		_, err = io.Copy(ioutil.Discard, fc)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.ambiguous, fc.isAmbiguous(), tt.name)
+
+		// reset by the next request
+		_, err = fc.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		assert.Nil(t, err)
+		assert.False(t, fc.isAmbiguous(), tt.name)
+	}
+}
+
+func TestFramingTransportTLS(t *testing.T) {
+	t.Parallel()
+
+	var framing atomic.Value
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString(rawFramingResponse(framing.Load().(string))) // #nosec G104
+		bufrw.Flush()                                                  // #nosec G104
+	}))
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	hl := newHandshakeLimiter((&net.Dialer{}).DialContext, &tls.Config{RootCAs: roots}, time.Second, 0)
+	tr := &http.Transport{DialTLSContext: framingDialTLS(hl.DialTLSContext)}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: &framingTransport{next: tr}}
+
+	framing.Store("Transfer-Encoding: chunked\r\n")
+	resp, err := client.Get(ts.URL)
+	if assert.Nil(t, err) {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", string(body))
+	}
+
+	framing.Store("Content-Length: 3\r\nTransfer-Encoding: chunked\r\n")
+	_, err = client.Get(ts.URL)
+	assert.True(t, errors.Is(err, ErrAmbiguousFraming), "err: %v", err)
+}
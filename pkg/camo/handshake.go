@@ -0,0 +1,103 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// handshakeLimiter dials tls connections, optionally capping the number of
+// concurrent outbound tls handshakes to smooth cpu usage during a flood of
+// fetches to new hosts. A slot is held while dialing and handshaking a
+// connection.
+type handshakeLimiter struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// base tls config. nil uses the defaults.
+	config  *tls.Config
+	timeout time.Duration
+	// nil if handshakes are not limited
+	slots chan struct{}
+}
+
+func newHandshakeLimiter(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	config *tls.Config, timeout time.Duration, max int,
+) *handshakeLimiter {
+	hl := &handshakeLimiter{
+		dial:    dial,
+		config:  config,
+		timeout: timeout,
+	}
+	if max > 0 {
+		hl.slots = make(chan struct{}, max)
+	}
+	return hl
+}
+
+// withDial returns a copy of hl dialing with dial, sharing its handshake
+// slots.
+func (hl *handshakeLimiter) withDial(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+) *handshakeLimiter {
+	c := *hl
+	c.dial = dial
+	return &c
+}
+
+// DialTLSContext dials address, and performs a tls handshake, once a
+// handshake slot is available.
+func (hl *handshakeLimiter) DialTLSContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if hl.slots != nil {
+		select {
+		case hl.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-hl.slots }()
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := hl.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{}
+	if hl.config != nil {
+		cfg = hl.config.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	// the transport only adds alpn protocols to the configs it dials with
+	// itself. without them, custom dials are always http/1.1.
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	// the transport TLSHandshakeTimeout does not apply to custom tls dials
+	deadline, ok := ctx.Deadline()
+	if hl.timeout > 0 && (!ok || time.Until(deadline) > hl.timeout) {
+		deadline = time.Now().Add(hl.timeout)
+	}
+	if !deadline.IsZero() {
+		conn.SetDeadline(deadline) // #nosec G104 -- handshake fails if unset
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{}) // #nosec G104 -- reset for transport use
+	return tlsConn, nil
+}
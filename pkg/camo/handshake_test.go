@@ -0,0 +1,138 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingDialer tracks the number of handshakes in progress, from dial
+// until the handshake is verified.
+type countingDialer struct {
+	active int32
+	max    int32
+	dials  int32
+}
+
+func (cd *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n := atomic.AddInt32(&cd.active, 1)
+	atomic.AddInt32(&cd.dials, 1)
+	for {
+		max := atomic.LoadInt32(&cd.max)
+		if n <= max || atomic.CompareAndSwapInt32(&cd.max, max, n) {
+			break
+		}
+	}
+	// give concurrent handshakes a chance to overlap
+	time.Sleep(20 * time.Millisecond)
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (cd *countingDialer) verified(tls.ConnectionState) error {
+	atomic.AddInt32(&cd.active, -1)
+	return nil
+}
+
+func TestHandshakeLimiter(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	for _, limit := range []int{1, 3} {
+		cd := &countingDialer{}
+		cfg := ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		cfg.ServerName = "example.com"
+		cfg.VerifyConnection = cd.verified
+		hl := newHandshakeLimiter(cd.DialContext, cfg, time.Second, limit)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := hl.DialTLSContext(context.Background(), "tcp", addr)
+				if assert.Nil(t, err) {
+					conn.Close()
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(8), atomic.LoadInt32(&cd.dials))
+		assert.Equal(t, int32(limit), atomic.LoadInt32(&cd.max), "handshake concurrency")
+	}
+}
+
+func TestHandshakeLimiterContext(t *testing.T) {
+	t.Parallel()
+
+	hl := newHandshakeLimiter(nil, nil, time.Second, 1)
+	// occupy the only slot
+	hl.slots <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := hl.DialTLSContext(ctx, "tcp", "example.com:443")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestHandshakeLimiterWithDial(t *testing.T) {
+	t.Parallel()
+
+	var d net.Dialer
+	hl := newHandshakeLimiter(d.DialContext, nil, time.Second, 1)
+	hl.slots <- struct{}{}
+
+	// the copy shares the slots of hl
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := hl.withDial(d.DialContext).DialTLSContext(ctx, "tcp", "127.0.0.1:1")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestHandshakeLimiterHTTP2(t *testing.T) {
+	t.Parallel()
+
+	var proto int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&proto, int32(r.ProtoMajor))
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	rootCAs, cleanup := writeServerCert(t, ts)
+	defer cleanup()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.UpstreamRootCAs = rootCAs
+
+	// http2 is negotiated with and without the handshake limit
+	for _, limit := range []int{0, 1} {
+		c.MaxConcurrentHandshakes = limit
+		atomic.StoreInt32(&proto, 0)
+		resp, err := makeTestReq(ts.URL+"/image.png", 200, c)
+		if assert.Nil(t, err) {
+			bodyAssert(t, "ok", resp)
+		}
+		assert.Equal(t, int32(2), atomic.LoadInt32(&proto), "handshake limit %d", limit)
+	}
+}
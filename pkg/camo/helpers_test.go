@@ -5,15 +5,27 @@
 package camo
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505 -- used for hmac only
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cactus/go-camo/pkg/camo/encoding"
 	"github.com/cactus/go-camo/pkg/router"
-
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,6 +63,9 @@ func processRequest(req *http.Request, status int, camoConfig Config, filters []
 		AddHeaders:  map[string]string{"X-Go-Camo": "test"},
 		ServerName:  camoConfig.ServerName,
 		CamoHandler: camoServer,
+
+		QueryStringURLs: camoConfig.QueryStringURLs,
+		PathPrefix:      camoConfig.PathPrefix,
 	}
 
 	record := httptest.NewRecorder()
@@ -99,3 +114,170 @@ func statusCodeAssert(t *testing.T, expected int, resp *http.Response) {
 		expected, resp.StatusCode,
 	)
 }
+
+func bandwidthServer(size int) *httptest.Server {
+	body := bytes.Repeat([]byte("a"), size)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body) // #nosec G104
+	}))
+}
+
+func serveFrom(t *testing.T, camoServer *Proxy, c Config, testURL, remoteAddr, xff string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := makeReq(c, testURL)
+	assert.Nil(t, err)
+	req.RemoteAddr = remoteAddr
+	if xff != "" {
+		req.Header.Set("X-Forwarded-For", xff)
+	}
+	record := httptest.NewRecorder()
+	camoServer.ServeHTTP(record, req)
+	return record
+}
+
+func rawImageResponse(contentLength, body string) string {
+	return "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Length: " + contentLength + "\r\n" +
+		"Connection: close\r\n\r\n" +
+		body
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	_, err := zw.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, zw.Close())
+	return b.Bytes()
+}
+
+func rawFramingResponse(framing string) string {
+	return "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: image/png\r\n" +
+		framing +
+		"Connection: close\r\n\r\n" +
+		"2\r\nok\r\n0\r\n\r\n"
+}
+
+// writeServerCert writes the certificate of tls server ts to a temporary pem
+// file, for use as Config.UpstreamRootCAs. Returns the path, and a cleanup
+// func.
+func writeServerCert(t *testing.T, ts *httptest.Server) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "go-camo-roots")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	rootCAs := filepath.Join(dir, "roots.pem")
+	err = ioutil.WriteFile(rootCAs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatalf("unable to write cert: %s", err)
+	}
+	return rootCAs, func() { os.RemoveAll(dir) }
+}
+
+// newRawServer starts a tcp server that reads a single request, and replies
+// with the supplied raw response. Returns the server url.
+func newRawServer(t *testing.T, response string) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(response))
+			}(conn)
+		}
+	}()
+	return "http://" + ln.Addr().String(), func() { ln.Close() }
+}
+
+func querySign(key []byte, oURL string) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(oURL)) // #nosec G104 -- doesn't apply to hmac
+	return mac.Sum(nil)
+}
+
+// redirectDepthCount returns the number of fetches recorded with exactly
+// depth redirects.
+func redirectDepthCount(t *testing.T, depth int) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.Nil(t, err)
+	var atDepth, below uint64
+	for _, mf := range families {
+		if mf.GetName() != "camo_proxy_redirect_depth" {
+			continue
+		}
+		for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+			switch b.GetUpperBound() {
+			case float64(depth):
+				atDepth = b.GetCumulativeCount()
+			case float64(depth - 1):
+				below = b.GetCumulativeCount()
+			}
+		}
+	}
+	return atDepth - below
+}
+
+// concurrencyServer serves an image slowly, recording the peak number of
+// concurrent requests.
+func concurrencyServer() (*httptest.Server, *int64) {
+	var cur, peak int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&cur, 1)
+		defer atomic.AddInt64(&cur, -1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	return ts, &peak
+}
+
+func fireConcurrent(t *testing.T, c Config, testURL string, n int) map[int]int {
+	camoServer, err := New(c)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+
+	var mu sync.Mutex
+	codes := make(map[int]int)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := makeReq(c, testURL)
+			if !assert.Nil(t, err) {
+				return
+			}
+			record := httptest.NewRecorder()
+			camoServer.ServeHTTP(record, req)
+			mu.Lock()
+			codes[record.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return codes
+}
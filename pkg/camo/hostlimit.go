@@ -0,0 +1,51 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"sync"
+)
+
+// hostLimiter caps the number of distinct hosts with in-flight requests.
+// Requests to a host that already has requests in flight are always
+// admitted.
+type hostLimiter struct {
+	max int
+
+	mu sync.Mutex
+	// host -> in-flight request count
+	hosts map[string]int
+}
+
+func newHostLimiter(max int) *hostLimiter {
+	return &hostLimiter{
+		max:   max,
+		hosts: make(map[string]int),
+	}
+}
+
+// acquire records an in-flight request for host, returning false if host
+// is new and the limit of distinct hosts is reached. Each successful acquire
+// must be paired with a release.
+func (l *hostLimiter) acquire(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, ok := l.hosts[host]
+	if !ok && len(l.hosts) >= l.max {
+		return false
+	}
+	l.hosts[host] = n + 1
+	return true
+}
+
+func (l *hostLimiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := l.hosts[host]; n > 1 {
+		l.hosts[host] = n - 1
+	} else {
+		delete(l.hosts, host)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// parseHostTimeouts validates and normalizes Config.PerHostTimeouts, lower
+// casing hosts and clamping timeouts to MaxPerHostTimeout. Returns nil if no
+// timeouts are configured.
+func parseHostTimeouts(timeouts map[string]time.Duration) (map[string]time.Duration, error) {
+	if len(timeouts) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[string]time.Duration, len(timeouts))
+	for host, timeout := range timeouts {
+		// hosts are matched without port. ipv6 literals may be bracketed.
+		host = strings.ToLower(strings.Trim(strings.TrimSpace(host), "[]"))
+		if host == "" || strings.Contains(host, "/") ||
+			(strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+			return nil, fmt.Errorf("invalid host timeout host: %q", host)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("invalid host timeout for %s: %s", host, timeout)
+		}
+		if timeout > MaxPerHostTimeout {
+			timeout = MaxPerHostTimeout
+		}
+		parsed[host] = timeout
+	}
+	return parsed, nil
+}
+
+// requestTimeout returns the timeout for a request to u, from the per host
+// timeouts if one is configured for its host, or the RequestTimeout.
+func (p *Proxy) requestTimeout(u *url.URL) time.Duration {
+	if timeout, ok := p.hostTimeouts[strings.ToLower(u.Hostname())]; ok {
+		return timeout
+	}
+	return p.config.RequestTimeout
+}
+
+// parseCategoryTimeouts validates and normalizes Config.CategoryTimeouts,
+// lower casing categories and clamping timeouts to MaxPerHostTimeout.
+// Returns nil if no timeouts are configured.
+func parseCategoryTimeouts(timeouts map[string]time.Duration) (map[string]time.Duration, error) {
+	if len(timeouts) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[string]time.Duration, len(timeouts))
+	for category, timeout := range timeouts {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category == "" || strings.ContainsAny(category, "/*") {
+			return nil, fmt.Errorf("invalid category timeout category: %q", category)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("invalid category timeout for %s: %s", category, timeout)
+		}
+		if timeout > MaxPerHostTimeout {
+			timeout = MaxPerHostTimeout
+		}
+		parsed[category] = timeout
+	}
+	return parsed, nil
+}
+
+// maxTimeout returns the longest of timeouts, or zero if there are none.
+func maxTimeout(timeouts map[string]time.Duration) time.Duration {
+	var max time.Duration
+	for _, timeout := range timeouts {
+		if timeout > max {
+			max = timeout
+		}
+	}
+	return max
+}
+
+// categoryTimeout returns the timeout for responses of the given media type,
+// if one is configured for its category.
+func (p *Proxy) categoryTimeout(mediatype string) (time.Duration, bool) {
+	if p.categoryTimeouts == nil || mediatype == "" {
+		return 0, false
+	}
+	category := mediatype
+	if i := strings.IndexByte(mediatype, '/'); i >= 0 {
+		category = mediatype[:i]
+	}
+	timeout, ok := p.categoryTimeouts[category]
+	return timeout, ok
+}
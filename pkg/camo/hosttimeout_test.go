@@ -0,0 +1,116 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPerHostRequestTimeout(t *testing.T) {
+	t.Parallel()
+
+	c := camoConfig
+	c.RequestTimeout = 4 * time.Second
+	c.PerHostTimeouts = map[string]time.Duration{
+		"Slow.Example.com": 10 * time.Second,
+		"[2001:db8::1]":    6 * time.Second,
+		"huge.example.com": time.Hour,
+	}
+	camoServer, err := New(c)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var timeoutTests = []struct {
+		url  string
+		want time.Duration
+	}{
+		{"http://slow.example.com/a.png", 10 * time.Second},
+		{"https://SLOW.example.com:8443/a.png", 10 * time.Second},
+		{"http://[2001:db8::1]/a.png", 6 * time.Second},
+		{"http://huge.example.com/a.png", MaxPerHostTimeout},
+		{"http://example.com/a.png", 4 * time.Second},
+		{"http://other.slow.example.com/a.png", 4 * time.Second},
+	}
+
+	for _, tt := range timeoutTests {
+		u, err := url.Parse(tt.url)
+		if assert.Nil(t, err) {
+			assert.Equal(t, tt.want, camoServer.requestTimeout(u), tt.url)
+		}
+	}
+}
+
+func TestPerHostTimeoutsInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, timeouts := range []map[string]time.Duration{
+		{"": time.Second},
+		{"example.com:80": time.Second},
+		{"example.com/a": time.Second},
+		{"example.com": 0},
+		{"example.com": -time.Second},
+	} {
+		c := camoConfig
+		c.PerHostTimeouts = timeouts
+		_, err := New(c)
+		assert.NotNil(t, err, "%v", timeouts)
+	}
+}
+
+func TestCategoryTimeoutsClamped(t *testing.T) {
+	t.Parallel()
+
+	c := camoConfig
+	c.CategoryTimeouts = map[string]time.Duration{
+		"image": 10 * time.Second,
+		"video": time.Hour,
+	}
+	camoServer, err := New(c)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	timeout, ok := camoServer.categoryTimeout("image/png")
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, timeout)
+	timeout, ok = camoServer.categoryTimeout("video/mp4")
+	assert.True(t, ok)
+	assert.Equal(t, MaxPerHostTimeout, timeout)
+	assert.Equal(t, MaxPerHostTimeout, camoServer.maxCategoryTimeout)
+}
+
+func TestPerHostTimeoutOverride(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.RequestTimeout = 100 * time.Millisecond
+
+	// other hosts use the default timeout
+	c.PerHostTimeouts = map[string]time.Duration{"example.com": 5 * time.Second}
+	_, err := makeTestReq(ts.URL+"/image.png", 504, c)
+	assert.Nil(t, err)
+
+	// the configured host gets its override
+	c.PerHostTimeouts = map[string]time.Duration{"127.0.0.1": 5 * time.Second}
+	resp, err := makeTestReq(ts.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "ok", resp)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// http3Dialer holds the settings HTTP/3 connections are dialed with, so they
+// match those of tcp connections.
+type http3Dialer struct {
+	// rejectIP returns true for ips that must be refused with ErrRejectIP.
+	// nil disables ip filtering.
+	rejectIP func(net.IP) bool
+	// lookupIP resolves hostnames. nil uses the system resolver.
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	// localIP returns the local address to dial ip from, or nil if there is
+	// none for the family of ip. nil lets the system choose.
+	localIP func(ip net.IP) net.IP
+}
+
+// newHTTP3RoundTripper, when non-nil, returns a RoundTripper that fetches
+// over HTTP/3 (QUIC), dialing with d. A nil tlsConfig uses the defaults.
+//
+// It is only set in builds with the `http3` build tag, which keeps the quic
+// dependency optional.
+var newHTTP3RoundTripper func(d http3Dialer, tlsConfig *tls.Config) http.RoundTripper
+
+// ErrHTTP3Unsupported is returned by New when HTTP/3 fetching is enabled,
+// but support was not compiled in.
+var ErrHTTP3Unsupported = errors.New("http3 support not compiled in (build with -tags http3)")
+
+// HTTP3Supported reports whether HTTP/3 support was compiled in.
+func HTTP3Supported() bool {
+	return newHTTP3RoundTripper != nil
+}
+
+// default Alt-Svc max age, per rfc7838
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// altSvcTransport fetches over tcp by default, and switches to HTTP/3 for
+// https origins that advertise h3 support (on the same port) via an Alt-Svc
+// response header. If an HTTP/3 request fails, the origin is forgotten and
+// the request is retried over tcp.
+type altSvcTransport struct {
+	tcp http.RoundTripper
+	h3  http.RoundTripper
+
+	mu sync.Mutex
+	// host:port -> advertisement expiry
+	hosts map[string]time.Time
+}
+
+func newAltSvcTransport(tcp, h3 http.RoundTripper) *altSvcTransport {
+	return &altSvcTransport{
+		tcp:   tcp,
+		h3:    h3,
+		hosts: make(map[string]time.Time),
+	}
+}
+
+// authority returns the host:port of an https request, or an empty string for
+// other schemes.
+func authority(req *http.Request) string {
+	if req.URL.Scheme != "https" {
+		return ""
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.ToLower(req.URL.Hostname()), port)
+}
+
+func (t *altSvcTransport) useH3(authority string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expiry, ok := t.hosts[authority]
+	if ok && time.Now().After(expiry) {
+		delete(t.hosts, authority)
+		return false
+	}
+	return ok
+}
+
+func (t *altSvcTransport) forget(authority string) {
+	t.mu.Lock()
+	delete(t.hosts, authority)
+	t.mu.Unlock()
+}
+
+// learn records (or clears) h3 support from an Alt-Svc header value.
+func (t *altSvcTransport) learn(authority, altSvc string) {
+	port := authority[strings.LastIndex(authority, ":")+1:]
+	maxAge, ok := parseAltSvcH3(altSvc, port)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !ok {
+		delete(t.hosts, authority)
+		return
+	}
+	t.hosts[authority] = time.Now().Add(maxAge)
+}
+
+// parseAltSvcH3 returns the max age of an h3 alternative on the given port,
+// from an Alt-Svc header value. Alternatives on other hosts or ports are
+// ignored.
+func parseAltSvcH3(altSvc, port string) (time.Duration, bool) {
+	for _, alt := range strings.Split(altSvc, ",") {
+		parts := strings.Split(alt, ";")
+		protoAuth := strings.SplitN(strings.TrimSpace(parts[0]), "=", 2)
+		if len(protoAuth) != 2 || protoAuth[0] != "h3" {
+			continue
+		}
+		if strings.Trim(protoAuth[1], `"`) != ":"+port {
+			continue
+		}
+
+		maxAge := defaultAltSvcMaxAge
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "ma" {
+				if secs, err := strconv.ParseUint(strings.Trim(kv[1], `"`), 10, 32); err == nil {
+					maxAge = time.Duration(secs) * time.Second
+				}
+			}
+		}
+		if maxAge <= 0 {
+			return 0, false
+		}
+		return maxAge, true
+	}
+	return 0, false
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *altSvcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	auth := authority(req)
+	if auth != "" && t.useH3(auth) {
+		resp, err := t.h3.RoundTrip(req)
+		switch {
+		case err == nil:
+			return resp, nil
+		case errors.Is(err, ErrRejectIP), req.Context().Err() != nil:
+			return nil, err
+		}
+		// fall back to tcp. requests never have a body, so a retry is safe.
+		t.forget(auth)
+	}
+
+	resp, err := t.tcp.RoundTrip(req)
+	if err != nil || auth == "" {
+		return resp, err
+	}
+	if altSvc := resp.Header.Get("Alt-Svc"); altSvc != "" {
+		t.learn(auth, altSvc)
+	}
+	return resp, nil
+}
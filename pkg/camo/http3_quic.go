@@ -0,0 +1,105 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build http3
+// +build http3
+
+package camo
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func init() {
+	newHTTP3RoundTripper = func(d http3Dialer, tlsConfig *tls.Config) http.RoundTripper {
+		return &http3.Transport{
+			TLSClientConfig: tlsConfig,
+			Dial:            d.dialEarly,
+		}
+	}
+}
+
+// dialEarly resolves and filters ips before dialing, as there is no
+// dial.control hook for quic connections. Each resolved address is tried in
+// order.
+func (d http3Dialer) dialEarly(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s is not a valid host/port pair: %w", addr, err, ErrInvalidHostPort)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		lookup := d.lookupIP
+		if lookup == nil {
+			lookup = systemLookupIP
+		}
+		ips, err = lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if d.rejectIP != nil {
+		for _, ip := range ips {
+			if d.rejectIP(ip) {
+				return nil, ErrRejectIP
+			}
+		}
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := d.dialIP(ctx, ip, port, tlsCfg, cfg)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// dialIP dials a single address, from the next egress ip if configured.
+func (d http3Dialer) dialIP(ctx context.Context, ip net.IP, port string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return nil, err
+	}
+	laddr := &net.UDPAddr{}
+	if d.localIP != nil {
+		laddr.IP = d.localIP(ip)
+		if laddr.IP == nil {
+			return nil, fmt.Errorf("%s: %w", ip, ErrNoEgressIP)
+		}
+	}
+	pconn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := quic.DialEarly(ctx, pconn, raddr, tlsCfg, cfg)
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+	// the packet conn is not owned by the quic connection
+	go func() {
+		<-conn.Context().Done()
+		pconn.Close()
+	}()
+	return conn, nil
+}
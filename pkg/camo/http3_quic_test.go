@@ -0,0 +1,128 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build http3
+// +build http3
+
+package camo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTP3RoundTripper(t *testing.T) {
+	t.Parallel()
+
+	// borrow the httptest tls certificate for the h3 server
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	cert := ts.TLS.Certificates[0]
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	srv := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(r.Proto)) // #nosec G104
+		}),
+	}
+	go srv.Serve(conn) // #nosec G104
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	u := "https://" + conn.LocalAddr().String() + "/image.png"
+
+	rt := newHTTP3RoundTripper(http3Dialer{}, nil).(*http3.Transport)
+	rt.TLSClientConfig = &tls.Config{RootCAs: pool}
+	defer rt.Close()
+
+	req, _ := http.NewRequest("GET", u, nil)
+	resp, err := rt.RoundTrip(req)
+	if assert.Nil(t, err) {
+		defer resp.Body.Close()
+		assert.Equal(t, 3, resp.ProtoMajor)
+	}
+
+	// loopback is rejected when filtering
+	rt = newHTTP3RoundTripper(http3Dialer{rejectIP: isRejectedIP}, nil).(*http3.Transport)
+	rt.TLSClientConfig = &tls.Config{RootCAs: pool}
+	defer rt.Close()
+	req, _ = http.NewRequest("GET", u, nil)
+	_, err = rt.RoundTrip(req)
+	assert.True(t, errors.Is(err, ErrRejectIP))
+}
+
+func TestHTTP3Dialer(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	cert := ts.TLS.Certificates[0]
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	srv := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			w.Write([]byte(host)) // #nosec G104
+		}),
+	}
+	go srv.Serve(conn) // #nosec G104
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	var lookups []string
+	d := http3Dialer{
+		// the first address has no listener, so the second is tried
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			lookups = append(lookups, host)
+			return []net.IP{net.ParseIP("127.0.0.3"), net.ParseIP("127.0.0.1")}, nil
+		},
+		localIP: func(net.IP) net.IP { return net.ParseIP("127.0.0.2") },
+	}
+	rt := newHTTP3RoundTripper(d, &tls.Config{RootCAs: pool}).(*http3.Transport)
+	rt.QUICConfig = &quic.Config{HandshakeIdleTimeout: 500 * time.Millisecond}
+	defer rt.Close()
+
+	req, _ := http.NewRequest("GET", "https://example.com:"+port+"/image.png", nil)
+	resp, err := rt.RoundTrip(req)
+	if assert.Nil(t, err) {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		// dialed from the egress ip
+		assert.Equal(t, "127.0.0.2", string(body))
+	}
+	assert.Equal(t, []string{"example.com"}, lookups)
+
+	// resolved addresses are filtered
+	d.rejectIP = func(ip net.IP) bool { return ip.Equal(net.ParseIP("127.0.0.3")) }
+	rt = newHTTP3RoundTripper(d, &tls.Config{RootCAs: pool}).(*http3.Transport)
+	defer rt.Close()
+	req, _ = http.NewRequest("GET", "https://example.com:"+port+"/image.png", nil)
+	_, err = rt.RoundTrip(req)
+	assert.True(t, errors.Is(err, ErrRejectIP))
+}
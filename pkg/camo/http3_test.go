@@ -0,0 +1,116 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestParseAltSvcH3(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		altSvc string
+		port   string
+		maxAge time.Duration
+		ok     bool
+	}{
+		{`h3=":443"`, "443", defaultAltSvcMaxAge, true},
+		{`h3=":443"; ma=3600`, "443", time.Hour, true},
+		{`h3-29=":443", h3=":443"; ma=60`, "443", time.Minute, true},
+		{`h3=":8443"`, "443", 0, false},
+		{`h3="other.example.com:443"`, "443", 0, false},
+		{`h2=":443"`, "443", 0, false},
+		{`h3=":443"; ma=0`, "443", 0, false},
+		{`clear`, "443", 0, false},
+	}
+
+	for _, tt := range tests {
+		maxAge, ok := parseAltSvcH3(tt.altSvc, tt.port)
+		assert.Equal(t, tt.ok, ok, tt.altSvc)
+		assert.Equal(t, tt.maxAge, maxAge, tt.altSvc)
+	}
+}
+
+func TestAltSvcTransport(t *testing.T) {
+	t.Parallel()
+
+	var tcpHits, h3Hits int32
+	altSvc := `h3=":443"`
+	tcp := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&tcpHits, 1)
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Alt-Svc", altSvc)
+		return rec.Result(), nil
+	})
+	var h3Fail bool
+	h3 := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&h3Hits, 1)
+		if h3Fail {
+			return nil, errors.New("quic handshake failed")
+		}
+		return httptest.NewRecorder().Result(), nil
+	})
+
+	tr := newAltSvcTransport(tcp, h3)
+	get := func(u string) {
+		req, _ := http.NewRequest("GET", u, nil)
+		_, err := tr.RoundTrip(req)
+		assert.Nil(t, err)
+	}
+
+	// first request is over tcp, and learns of h3 support
+	get("https://example.com/a.png")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tcpHits))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&h3Hits))
+
+	// subsequent requests use h3
+	get("https://EXAMPLE.com/b.png")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tcpHits))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&h3Hits))
+
+	// other ports and plain http are not affected
+	get("https://example.com:8443/a.png")
+	get("http://example.com/a.png")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&tcpHits))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&h3Hits))
+
+	// h3 failures fall back to tcp, and are forgotten until re-advertised
+	h3Fail = true
+	altSvc = "clear"
+	get("https://example.com/c.png")
+	get("https://example.com/d.png")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&tcpHits))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&h3Hits))
+}
+
+func TestHTTP3Config(t *testing.T) {
+	t.Parallel()
+
+	c := camoConfig
+	c.EnableHTTP3 = true
+	p, err := New(c)
+	if !HTTP3Supported() {
+		assert.Equal(t, ErrHTTP3Unsupported, err)
+		return
+	}
+	if assert.Nil(t, err) {
+		_, ok := p.upstreamClient().Transport.(*locationLimitTransport).next.(*redirectBodyTransport).next.(*altSvcTransport)
+		assert.True(t, ok)
+	}
+}
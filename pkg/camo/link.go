@@ -0,0 +1,92 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/url"
+	"strings"
+)
+
+// linkValue is a single link-value of a Link header (rfc8288).
+type linkValue struct {
+	target string
+	// the raw parameters following the target (including the leading ';')
+	params string
+}
+
+// parseLinkHeader splits a Link header value into its link-values.
+// Malformed trailing content is ignored.
+func parseLinkHeader(v string) []linkValue {
+	var links []linkValue
+	for {
+		start := strings.IndexByte(v, '<')
+		if start < 0 {
+			return links
+		}
+		end := strings.IndexByte(v[start:], '>')
+		if end < 0 {
+			return links
+		}
+		end += start
+		link := linkValue{target: v[start+1 : end]}
+		v = v[end+1:]
+
+		// parameters run until the next comma outside of a quoted string
+		i, quoted := 0, false
+	params:
+		for ; i < len(v); i++ {
+			switch v[i] {
+			case '"':
+				quoted = !quoted
+			case '\\':
+				if quoted {
+					i++
+				}
+			case ',':
+				if !quoted {
+					break params
+				}
+			}
+		}
+		if i > len(v) {
+			i = len(v)
+		}
+		link.params = strings.TrimSpace(v[:i])
+		links = append(links, link)
+		if i == len(v) {
+			return links
+		}
+		v = v[i+1:]
+	}
+}
+
+// rewriteLinks rewrites the targets of Link header values to signed camo
+// paths, so the referenced resources are fetched through the proxy. Relative
+// targets are resolved against base. Targets that would be rejected by the
+// proxy (including non http(s) urls) are dropped, so origins can not obtain
+// signed urls for anything the proxy would not fetch.
+func (p *Proxy) rewriteLinks(values []string, base *url.URL) []string {
+	var rewritten []string
+	for _, v := range values {
+		for _, link := range parseLinkHeader(v) {
+			ref, err := url.Parse(link.target)
+			if err != nil {
+				continue
+			}
+			target := base.ResolveReference(ref)
+			target.Fragment = ""
+			if p.checkURL(target) != nil {
+				continue
+			}
+
+			value := "<" + p.signedURL(target.String()) + ">"
+			if link.params != "" {
+				value += "; " + strings.TrimLeft(link.params, "; ")
+			}
+			rewritten = append(rewritten, value)
+		}
+	}
+	return rewritten
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"net"
+)
+
+// Listen announces on the local network address, as net.Listen does.
+// Accepted connections use pc.ClientKeepAlive as their TCP keepalive period.
+// If pc.ReusePort is set, SO_REUSEPORT is set on the socket, allowing several
+// processes to bind the same address, with the kernel balancing incoming
+// connections between them.
+func Listen(pc Config, network, address string) (net.Listener, error) {
+	lc := listenConfig(pc)
+	return lc.Listen(context.Background(), network, address)
+}
+
+func listenConfig(pc Config) *net.ListenConfig {
+	lc := &net.ListenConfig{
+		KeepAlive: pc.ClientKeepAlive,
+	}
+	if lc.KeepAlive == 0 {
+		lc.KeepAlive = DefaultClientKeepAlive
+	}
+	if pc.ReusePort {
+		lc.Control = reusePortControl
+	}
+	return lc
+}
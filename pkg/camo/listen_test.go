@@ -0,0 +1,31 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenConfigKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	var keepAliveTests = []struct {
+		keepAlive time.Duration
+		want      time.Duration
+	}{
+		{0, DefaultClientKeepAlive},
+		{5 * time.Second, 5 * time.Second},
+		{-1, -1},
+	}
+
+	for _, tt := range keepAliveTests {
+		c := camoConfig
+		c.ClientKeepAlive = tt.keepAlive
+		assert.Equal(t, tt.want, listenConfig(c).KeepAlive)
+	}
+}
@@ -7,6 +7,9 @@
 package camo
 
 import (
+	"context"
+	"sync/atomic"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -40,4 +43,79 @@ var (
 			Help:      "The number of responess that were too large to send.",
 		},
 	)
+	metadataBlocked = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "metadata_blocked_total",
+			Help:      "The number of requests blocked for targeting a cloud metadata address.",
+		},
+	)
+	suspiciousOrigins = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "suspicious_origins_total",
+			Help:      "The number of responses rejected for sending too many dangerous headers.",
+		},
+	)
+	keyVerifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "key_verifications_total",
+			Help:      "The number of requests verified, by hmac key fingerprint.",
+		},
+		[]string{"key"},
+	)
+	contentTypeRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "content_type_rejected_total",
+			Help:      "The number of responses rejected for their content type, by reason.",
+		},
+		[]string{"reason"},
+	)
+	redirectDepth = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: MetricNamespace,
+			Subsystem: MetricSubsystem,
+			Name:      "redirect_depth",
+			Help:      "The number of redirects followed per upstream fetch.",
+			Buckets:   prometheus.LinearBuckets(0, 1, 11),
+		},
+	)
+)
+
+// reasons for contentTypeRejected
+const (
+	rejectReasonHTML        = "html"
+	rejectReasonUnsupported = "unsupported"
 )
+
+// context key for the redirect depth of an upstream fetch
+type redirectDepthKey struct{}
+
+// withRedirectDepth returns a context that tracks the redirect depth of the
+// upstream fetch made with it.
+func withRedirectDepth(ctx context.Context) (context.Context, *int32) {
+	depth := new(int32)
+	return context.WithValue(ctx, redirectDepthKey{}, depth), depth
+}
+
+// recordRedirectDepth records following the redirect at depth, for a fetch
+// made with a context from withRedirectDepth. Retried fetches keep the
+// deepest chain.
+func recordRedirectDepth(ctx context.Context, depth int) {
+	p, ok := ctx.Value(redirectDepthKey{}).(*int32)
+	if !ok {
+		return
+	}
+	for {
+		cur := atomic.LoadInt32(p)
+		if int32(depth) <= cur || atomic.CompareAndSwapInt32(p, cur, int32(depth)) {
+			return
+		}
+	}
+}
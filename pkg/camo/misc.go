@@ -5,9 +5,13 @@
 package camo
 
 import (
+	"fmt"
 	"io"
+	"mime"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -26,6 +30,13 @@ func NewLimitReadCloser(r io.ReadCloser, n int64) *LimitReadCloser {
 	return &LimitReadCloser{ReadCloser: r, Reader: io.LimitReader(r, n)}
 }
 
+// readCloser combines a Reader and a separate Closer, such as when wrapping
+// a response body in a buffered reader.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func isBrokenPipe(err error) bool {
 	if opErr, ok := err.(*net.OpError); ok {
 		// >= go1.6
@@ -66,17 +77,105 @@ func mustParseNetmasks(networks []string) []*net.IPNet {
 	return nets
 }
 
+// locationLimitTransport rejects redirect responses with an over long
+// Location header, before the http client parses it.
+type locationLimitTransport struct {
+	next   http.RoundTripper
+	maxLen int
+}
+
+func (t *locationLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	for _, loc := range resp.Header["Location"] {
+		if len(loc) > t.maxLen {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%d bytes: %w", len(loc), ErrLocationTooLong)
+		}
+	}
+	return resp, nil
+}
+
+// countHostChanges returns the number of times the host changes across a
+// redirect chain (via), ending with req. Ports are ignored.
+func countHostChanges(req *http.Request, via []*http.Request) int {
+	changes := 0
+	for i, r := range via {
+		next := req
+		if i+1 < len(via) {
+			next = via[i+1]
+		}
+		if normalizeHost(r.URL.Hostname()) != normalizeHost(next.URL.Hostname()) {
+			changes++
+		}
+	}
+	return changes
+}
+
+// flushWriter flushes after each write, so streams are relayed to the client
+// without buffering.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if n > 0 {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+func mustParseIPs(addrs []string) []net.IP {
+	ips := make([]net.IP, 0, len(addrs))
+	for _, s := range addrs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			panic(`misc: mustParseIPs(` + s + `): invalid ip`)
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// isMetadataIP returns true if the ip is a well known cloud metadata service
+// address.
+func isMetadataIP(ip net.IP) bool {
+	if v4 := embeddedIPv4(ip); v4 != nil {
+		ip = v4
+	}
+	for _, mip := range metadataIPs {
+		if mip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func isRejectedIP(ip net.IP) bool {
 	if !ip.IsGlobalUnicast() {
 		return true
 	}
 
+	if isMetadataIP(ip) {
+		return true
+	}
+
 	// test whether address is ipv4 or ipv6, to pick the proper filter list
 	// (otherwise address may be 16 byte representation in go but not an actual
 	// ipv6 address. this also helps avoid accidentally matching the
 	// "::ffff:0:0/96" netblock
 	checker := rejectIPv4Networks
 	if ip.To4() == nil {
+		// nat64 and 6to4 addresses are filtered by the ipv4 address they
+		// embed. with dns64 on ipv6-only networks, any hostname may resolve
+		// to a nat64 address.
+		if v4 := embeddedIPv4(ip); v4 != nil {
+			return isRejectedIP(v4)
+		}
 		checker = rejectIPv6Networks
 	}
 
@@ -89,6 +188,21 @@ func isRejectedIP(ip net.IP) bool {
 	return false
 }
 
+// embeddedIPv4 returns the ipv4 address embedded in a nat64 (well known
+// prefix) or 6to4 ipv6 address, or nil.
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+	switch {
+	case nat64Network.Contains(ip):
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+	case sixToFourNetwork.Contains(ip):
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5])
+	}
+	return nil
+}
+
 func containsOneOf(s string, substrs ...string) bool {
 	j := len(substrs)
 	for i := 0; i < j; i++ {
@@ -100,13 +214,113 @@ func containsOneOf(s string, substrs ...string) bool {
 	return false
 }
 
-var bufPool = sync.Pool{
-	New: func() interface{} {
-		// note: 32 * 1024 is the size used by io.Copy by default.
-		// Seems like a good starting point, just with a bit less garbage
-		// (using a sync pool) to reduce some GC work.
-		// ref: https://golang.org/src/io/io.go?s=13136:13214#L391
-		buf := make([]byte, 32*1024)
-		return &buf
-	},
+// newBufferPool returns a sync.Pool of *[]byte buffers of the given size.
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// isHTMLMediaType returns true for html (and xhtml) media types.
+func isHTMLMediaType(mediatype string) bool {
+	return mediatype == "text/html" || mediatype == "application/xhtml+xml"
+}
+
+// jsonError is the body of json error responses.
+type jsonError struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+	// machine readable reason code (see X-Camo-Reason), when available
+	Code string `json:"code,omitempty"`
+}
+
+// acceptsJSON returns true if an Accept header value explicitly accepts
+// application/json. Wildcards are ignored, so browsers get plain errors.
+func acceptsJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediatype != "application/json" {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// acceptsMediaTypes returns true if an Accept header value accepts at least
+// one of the allowed media types (which may be wildcards, eg. image/*).
+func acceptsMediaTypes(accept string, allowed []string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		for _, a := range allowed {
+			if mediaRangesOverlap(mediatype, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mediaRangesOverlap returns true if the media ranges a and b have a media
+// type in common.
+func mediaRangesOverlap(a, b string) bool {
+	aType, aSub := splitMediaType(a)
+	bType, bSub := splitMediaType(b)
+	return (aType == "*" || bType == "*" || aType == bType) &&
+		(aSub == "*" || bSub == "*" || aSub == bSub)
+}
+
+func splitMediaType(mediatype string) (string, string) {
+	if i := strings.IndexByte(mediatype, '/'); i >= 0 {
+		return mediatype[:i], mediatype[i+1:]
+	}
+	return mediatype, ""
+}
+
+// collapseSlashes collapses runs of slashes in the path of rawURL. The
+// scheme's `//`, and the query string, are left as is.
+func collapseSlashes(rawURL string) string {
+	i := strings.Index(rawURL, "://")
+	if i < 0 {
+		return rawURL
+	}
+	start := strings.IndexAny(rawURL[i+3:], "/?")
+	if start < 0 || rawURL[i+3+start] == '?' {
+		return rawURL
+	}
+	start += i + 3
+	end := strings.IndexByte(rawURL[start:], '?')
+	if end < 0 {
+		end = len(rawURL)
+	} else {
+		end += start
+	}
+	path := rawURL[start:end]
+	if !strings.Contains(path, "//") {
+		return rawURL
+	}
+
+	var b strings.Builder
+	b.Grow(len(rawURL))
+	b.WriteString(rawURL[:start])
+	for j := 0; j < len(path); j++ {
+		if path[j] == '/' && j > 0 && path[j-1] == '/' {
+			continue
+		}
+		b.WriteByte(path[j])
+	}
+	b.WriteString(rawURL[end:])
+	return b.String()
 }
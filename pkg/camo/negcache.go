@@ -0,0 +1,79 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"sync"
+	"time"
+)
+
+// maximum number of negative cache entries. once reached, failures are not
+// cached until entries expire.
+const maxNegativeCacheEntries = 10000
+
+type negativeEntry struct {
+	code    int
+	msg     string
+	expires time.Time
+}
+
+// negativeCache caches failure responses for a short time, so a failing (or
+// blocked) origin is not repeatedly fetched.
+type negativeCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]negativeEntry
+	hits    uint64
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		entries: make(map[string]negativeEntry),
+	}
+}
+
+// get returns the unexpired failure cached for key, if any.
+func (c *negativeCache) get(key string) (negativeEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return e, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return e, false
+	}
+	c.hits++
+	return e, true
+}
+
+// stats returns a snapshot of the cache counters. Entries may include
+// expired entries not yet removed.
+func (c *negativeCache) stats() *CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &CacheStats{Entries: len(c.entries), Hits: c.hits}
+}
+
+// add caches a failure for key.
+func (c *negativeCache) add(key string, code int, msg string) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxNegativeCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxNegativeCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = negativeEntry{code: code, msg: msg, expires: now.Add(c.ttl)}
+}
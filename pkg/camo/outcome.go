@@ -0,0 +1,53 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/http"
+)
+
+// outcome categories, sent in the X-Camo-Outcome header when
+// Config.EmitOutcomeHeader is set
+const (
+	outcomeServed      = "served"
+	outcomeNotModified = "not-modified"
+	outcomeError       = "error"
+	outcomeBadSig      = "bad-signature"
+	outcomeUpstream    = "upstream-error"
+	outcomeBlocked     = "blocked"
+	outcomeSSRF        = "blocked-ssrf"
+	outcomeFilter      = "blocked-filter"
+	outcomeLegal       = "blocked-legal"
+	outcomeURL         = "blocked-url"
+	outcomeReferer     = "blocked-referer"
+	outcomeRedirect    = "blocked-redirect"
+	outcomeContentType = "blocked-content-type"
+	outcomeSize        = "blocked-size"
+	outcomeContent     = "blocked-content"
+)
+
+// setOutcome sets the X-Camo-Outcome header, when enabled. The first outcome
+// set wins, so specific outcomes can be set before the generic ones set by
+// the error helpers.
+func (p *Proxy) setOutcome(w http.ResponseWriter, outcome string) {
+	if !p.config.EmitOutcomeHeader {
+		return
+	}
+	h := w.Header()
+	if h.Get("X-Camo-Outcome") == "" {
+		h.Set("X-Camo-Outcome", outcome)
+	}
+}
+
+// checkURLOutcome returns the outcome for an error from checkURL.
+func checkURLOutcome(err error) string {
+	switch err {
+	case errBadURLHost:
+		return outcomeSSRF
+	case errFilterRejected:
+		return outcomeFilter
+	}
+	return outcomeURL
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cactus/go-camo/pkg/camo/encoding"
+)
+
+// parentCamo fetches origin urls through a parent camo instance, by signing
+// them with the parent's key.
+type parentCamo struct {
+	// base url, without a trailing slash
+	base   string
+	key    []byte
+	client *http.Client
+}
+
+// newParentCamo returns a parentCamo for the base url and key. Requests use a
+// copy of tr, dialing without ip filtering: the parent is operator configured
+// (and may well be on a private network), and filters origins itself. https
+// connections are dialed with a copy of hl, sharing its handshake slots.
+func newParentCamo(
+	base string, key []byte, tr *http.Transport, hl *handshakeLimiter, connectTimeout time.Duration,
+) (*parentCamo, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parent camo url: %w", err)
+	}
+	if !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid parent camo url: %s", base)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("parent camo key required")
+	}
+
+	dial := (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	ptr := tr.Clone()
+	ptr.DialContext = framingDial(dial)
+	ptr.DialTLSContext = framingDialTLS(hl.withDial(dial).DialTLSContext)
+
+	return &parentCamo{
+		base: strings.TrimRight(base, "/"),
+		key:  key,
+		client: &http.Client{
+			Transport: &framingTransport{next: ptr},
+			// the parent follows origin redirects itself. a redirect from
+			// the parent is relayed (and so, rejected) as is.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// url returns the parent camo url for an origin url.
+func (pc *parentCamo) url(oURL string) string {
+	return pc.base + encoding.B64EncodeURL(pc.key, oURL)
+}
+
+// newViaID returns a random token identifying this instance in Via headers,
+// so request loops are detected without mistaking other instances (with the
+// same server name, eg. a parent camo) for this one.
+func newViaID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating via id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isLoop returns true if req already passed through this instance.
+func (p *Proxy) isLoop(req *http.Request) bool {
+	for _, v := range req.Header["Via"] {
+		if strings.Contains(v, p.via) {
+			return true
+		}
+	}
+	return false
+}
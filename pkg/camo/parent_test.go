@@ -0,0 +1,195 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cactus/go-camo/pkg/camo/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParentCamo(t *testing.T) {
+	t.Parallel()
+
+	parentKey := []byte("parent-camo-test-key")
+	var hits int32
+	fetched := make(chan string, 1)
+	// fake parent, verifying urls with its own key
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 3 {
+			http.NotFound(w, r)
+			return
+		}
+		oURL, err := encoding.B64DecodeURL(parentKey, parts[1], parts[2])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		fetched <- oURL
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("from parent")) // #nosec G104
+	}))
+	defer parent.Close()
+
+	// ip filtering stays enabled. the (loopback) parent is trusted, and the
+	// origin is never dialed by the edge.
+	c := camoConfig
+	c.ParentCamoURL = parent.URL + "/"
+	c.ParentCamoKey = parentKey
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+
+	origin := "http://origin.invalid/image.png?v=1"
+	req, err := makeReq(c, origin)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	camoServer.ServeHTTP(record, req)
+	assert.Equal(t, http.StatusOK, record.Code)
+	assert.Equal(t, "from parent", record.Body.String())
+	assert.Equal(t, origin, <-fetched)
+
+	// the edge still verifies incoming urls with its own key
+	record = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "http://example.com"+encoding.B64EncodeURL(parentKey, origin), nil)
+	camoServer.ServeHTTP(record, req)
+	assert.Equal(t, http.StatusForbidden, record.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestParentCamoTLS(t *testing.T) {
+	t.Parallel()
+
+	var framing atomic.Value
+	framing.Store("Transfer-Encoding: chunked\r\n")
+	parent := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString(rawFramingResponse(framing.Load().(string))) // #nosec G104
+		bufrw.Flush()                                                  // #nosec G104
+	}))
+	defer parent.Close()
+	rootCAs, cleanup := writeServerCert(t, parent)
+	defer cleanup()
+
+	// the (loopback) parent is dialed without ip filtering over https too,
+	// with or without a handshake limit
+	c := camoConfig
+	c.ParentCamoURL = parent.URL
+	c.ParentCamoKey = []byte("parent-camo-test-key")
+	c.UpstreamRootCAs = rootCAs
+	for _, limit := range []int{0, 1} {
+		c.MaxConcurrentHandshakes = limit
+		resp, err := makeTestReq("http://origin.invalid/image.png", 200, c)
+		if assert.Nil(t, err, "handshake limit %d", limit) {
+			bodyAssert(t, "ok", resp)
+		}
+	}
+
+	// parent responses are scanned for ambiguous framing too
+	framing.Store("Content-Length: 3\r\nTransfer-Encoding: chunked\r\n")
+	_, err := makeTestReq("http://origin.invalid/image.png", 502, c)
+	assert.Nil(t, err)
+}
+
+func TestParentCamoConfig(t *testing.T) {
+	t.Parallel()
+
+	c := camoConfig
+	c.ParentCamoURL = "ftp://camo.example.com"
+	c.ParentCamoKey = []byte("key")
+	_, err := New(c)
+	assert.NotNil(t, err)
+
+	c.ParentCamoURL = "https://camo.example.com"
+	c.ParentCamoKey = nil
+	_, err = New(c)
+	assert.NotNil(t, err)
+
+	c.ParentCamoKey = []byte("6b6579")
+	c.HMACKeyEncoding = "hex"
+	c.HMACKey = []byte("0123456789abcdef")
+	camoServer, err := New(c)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("key"), camoServer.upstream.Load().(*upstream).parent.key)
+		assert.True(t, strings.HasPrefix(camoServer.upstream.Load().(*upstream).parent.url("http://example.com/a.png"), "https://camo.example.com/"))
+	}
+}
+
+func TestParentCamoChain(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("from origin")) // #nosec G104
+	}))
+	defer origin.Close()
+
+	// both instances keep the default server name
+	pc := camoConfig
+	pc.noIPFiltering = true
+	pc.HMACKey = []byte("parent-camo-test-key")
+	parentServer, err := New(pc)
+	if !assert.Nil(t, err) {
+		return
+	}
+	parent := httptest.NewServer(parentServer)
+	defer parent.Close()
+
+	c := camoConfig
+	c.ParentCamoURL = parent.URL
+	c.ParentCamoKey = pc.HMACKey
+	camoServer, err := New(c)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, c.ServerName, pc.ServerName)
+
+	req, err := makeReq(c, origin.URL+"/image.png")
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	camoServer.ServeHTTP(record, req)
+	assert.Equal(t, http.StatusOK, record.Code)
+	assert.Equal(t, "from origin", record.Body.String())
+
+	// a request that already passed through the edge is a loop
+	req, err = makeReq(c, origin.URL+"/image.png")
+	assert.Nil(t, err)
+	req.Header.Set("Via", camoServer.via)
+	record = httptest.NewRecorder()
+	camoServer.ServeHTTP(record, req)
+	assert.Equal(t, http.StatusNotFound, record.Code)
+
+	// as is one looping back through the parent
+	var hits int32
+	c.noIPFiltering = true
+	c.ParentCamoURL = parent.URL
+	loopServer, err := New(c)
+	if !assert.Nil(t, err) {
+		return
+	}
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		loopServer.ServeHTTP(w, r)
+	}))
+	defer edge.Close()
+	loopReq, err := makeReq(c, origin.URL+"/image.png")
+	assert.Nil(t, err)
+	req, err = makeReq(c, edge.URL+loopReq.URL.Path)
+	assert.Nil(t, err)
+	record = httptest.NewRecorder()
+	loopServer.ServeHTTP(record, req)
+	assert.NotEqual(t, http.StatusOK, record.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
@@ -7,22 +7,37 @@
 package camo
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cactus/go-camo/pkg/camo/encoding"
 	"github.com/cactus/go-camo/pkg/htrie"
 
 	"github.com/cactus/mlog"
+	"golang.org/x/net/http/httpguts"
 )
 
 //lint:file-ignore ST1005 Ignore string case error to maintain existing responses
@@ -32,14 +47,60 @@ import (
 type Config struct {
 	// HMACKey is a byte slice to be used as the hmac key
 	HMACKey []byte
+	// FallbackHMACKeys are additional keys accepted when verifying urls, to
+	// support key rotation. Keys are tried in order, after HMACKey.
+	FallbackHMACKeys [][]byte
+	// SunsetLegacyKeyURLs, if set, is sent as a Sunset (rfc8594) header on
+	// responses to urls verified by one of the FallbackHMACKeys, so clients
+	// and caches know the url was signed with a deprecated key, and when it
+	// will stop working.
+	SunsetLegacyKeyURLs time.Time
+	// HMACKeyEncoding is the encoding of HMACKey and FallbackHMACKeys, one
+	// of "raw" (the default), "hex", or "base64" (standard encoding, padding
+	// optional). Encoded keys are decoded by New, with surrounding whitespace
+	// ignored.
+	HMACKeyEncoding string
+	// HMACMessage selects the message url signatures are computed over, for
+	// interop with other camo implementations. One of "url" (the origin url,
+	// the default), or "path" (the encoded url path component, including its
+	// leading slash).
+	HMACMessage string
+	// MinKeyLength, if set, is the minimum length (in bytes, after decoding)
+	// of HMACKey and FallbackHMACKeys. New returns an error for shorter keys.
+	MinKeyLength int
 	// Server name used in Headers and Via checks
 	ServerName string
 	// MaxSize is the maximum valid image size response (in bytes).
 	MaxSize int64
 	// MaxRedirects is the maximum number of redirects to follow.
 	MaxRedirects int
+	// TooManyRedirectsStatus is the status code returned when MaxRedirects
+	// is exceeded (eg. 502, or 508 Loop Detected). Must be a 4xx or 5xx
+	// status. Defaults to 404.
+	TooManyRedirectsStatus int
+	// MaxHostChanges is the maximum number of times the host may change
+	// across a redirect chain (regardless of MaxRedirects). Chains hopping
+	// across more hosts are rejected with a 404. Zero disables.
+	MaxHostChanges int
 	// Request timeout is a timeout for fetching upstream data.
 	RequestTimeout time.Duration
+	// Optional per phase timeouts. Each phase timeout applies independently,
+	// while RequestTimeout remains the hard ceiling for the entire request.
+	// ConnectTimeout (default 3s) and TLSHandshakeTimeout (default 3s) bound
+	// establishing a connection, ResponseHeaderTimeout bounds waiting for
+	// response headers after the request is written, and BodyTimeout bounds
+	// reading the response body once headers are received. A zero value
+	// uses the default (or no phase timeout for the latter two).
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	BodyTimeout           time.Duration
+	// ClientWriteTimeout bounds relaying the response (headers and body) to
+	// the client, aborting slow clients that would otherwise hold a
+	// connection and buffer. Requires a ResponseWriter supporting write
+	// deadlines (see http.ResponseController, and
+	// PreserveResponseController). Zero disables.
+	ClientWriteTimeout time.Duration
 	// Keepalive enable/disable
 	DisableKeepAlivesFE bool
 	DisableKeepAlivesBE bool
@@ -48,10 +109,336 @@ type Config struct {
 	// additional content types to allow
 	AllowContentVideo bool
 	AllowContentAudio bool
+	// AllowMJPEG additionally allows `multipart/x-mixed-replace` (MJPEG)
+	// streams, which are relayed without buffering. RequestTimeout and
+	// MaxSize still bound the overall stream.
+	AllowMJPEG bool
+	// DefaultAcceptHeader overrides the Accept header sent upstream (eg.
+	// `image/webp,image/*` to prefer modern formats). Empty uses the list of
+	// allowed content types.
+	DefaultAcceptHeader string
 	// allow URLs to contain user/pass credentials
 	AllowCredetialURLs bool
+	// OriginBasicAuth maps origins (`[scheme://]host[:port]`, matched case
+	// insensitively) to Basic auth credentials added to upstream requests for
+	// them, including redirects to them. Without a scheme the origin is https,
+	// and without a port the scheme default is used. Credentials are never
+	// relayed to clients, and are not sent to other origins. Not used with
+	// ParentCamoURL.
+	OriginBasicAuth map[string]BasicAuth
+	// DisallowQueryStrings rejects origin urls (and redirects) with a
+	// non-empty query string, to avoid proxying dynamic endpoints. Note that
+	// this also rejects presigned (eg. s3/gcs) urls.
+	DisallowQueryStrings bool
+	// CollapseSlashes collapses runs of slashes in the origin url path (eg.
+	// `/a//b.png` to `/a/b.png`) before fetching, for origins that reject
+	// the empty path segments some encoding round trips introduce. Note
+	// that this changes the fetched url.
+	CollapseSlashes bool
+	// QueryStringURLs additionally accepts query string format urls, where
+	// the origin url and its signature are passed as the `url` and `digest`
+	// query parameters (eg. `/?url=<url>&digest=<hmac>`). The digest may
+	// instead be the path (eg. `/<hmac>?url=<url>`), as with the original
+	// camo. The signature is always computed over the origin url.
+	QueryStringURLs bool
 	// Whether to call/increment metrics
 	CollectMetrics bool
+	// EgressIPs is an optional list of local ip addresses to use as the
+	// source address for upstream connections, rotated round robin per
+	// address family. Upstream addresses of a family with no egress ips are
+	// not dialed.
+	EgressIPs []string
+	// DoHEndpoint is an optional DNS-over-HTTPS (rfc8484) endpoint url used
+	// to resolve upstream hostnames instead of the system resolver.
+	DoHEndpoint string
+	// DoHFallback enables falling back to the system resolver if a
+	// DNS-over-HTTPS lookup fails.
+	DoHFallback bool
+	// PathPrefix, if set, is the base path (eg. `/camo`) go-camo is mounted
+	// under. It is stripped from request paths before decoding, and requests
+	// outside of it are rejected with a 404. A trailing slash is ignored.
+	PathPrefix string
+	// SelfTestImagePath, if set, is a path (eg. `/selftest.png`) that, when
+	// signed in place of an origin url, is answered with a built-in image
+	// instead of being fetched. This allows end to end monitoring of the
+	// serving path (including signature verification) without depending on
+	// an origin.
+	SelfTestImagePath string
+	// LegalBlockNotice is the response body sent with the 451 (Unavailable
+	// For Legal Reasons) status for urls matching a legal filter rule, eg. a
+	// pointer to the legal notice. Defaults to "Unavailable For Legal
+	// Reasons".
+	LegalBlockNotice string
+	// StealthBlocks replaces all block responses with a uniform transparent
+	// pixel, so clients can not distinguish why a request was blocked.
+	StealthBlocks bool
+	// BlockResponseJitter is the upper bound of a random delay added to
+	// block responses, to obscure timing differences between block reasons.
+	// Capped at MaxBlockResponseJitter. Zero disables.
+	BlockResponseJitter time.Duration
+	// RelayEarlyHints relays the Link headers of upstream `103 Early Hints`
+	// responses to the client, with each target rewritten to a signed proxy
+	// url, so clients never preload resources directly from origins. Hints
+	// are only relayed if RewriteLinkHeader is also enabled. When disabled,
+	// interim responses are ignored.
+	RelayEarlyHints bool
+	// CopyBufferSize is the size (in bytes) of the buffer used when streaming
+	// the upstream response to the client. Must be between MinCopyBufferSize
+	// and MaxCopyBufferSize. Zero uses DefaultCopyBufferSize.
+	CopyBufferSize int
+	// MaxDecompressRatio is the maximum allowed ratio of decompressed to
+	// compressed size for content-encoded responses. Zero disables.
+	MaxDecompressRatio int
+	// MaxDecompressedSize is the maximum allowed decompressed size (in bytes)
+	// of content-encoded responses. Zero disables.
+	MaxDecompressedSize int64
+	// DisallowAnimated rejects animated gif, png (apng), and webp images.
+	// Detection inspects only the leading bytes of the response.
+	DisallowAnimated bool
+	// MinResponseBytes, if non-zero, rejects full (200) responses with a
+	// body smaller than this many bytes, as tiny images are almost always
+	// tracking pixels. At most 65536.
+	MinResponseBytes int
+	// AllowedExtensions is an optional list of file extensions (eg. `png`
+	// or `.png`) the origin url path must end with. Matching is case
+	// insensitive, and urls without an extension are rejected. Redirect
+	// targets are checked too. Empty allows all.
+	AllowedExtensions []string
+	// JSONErrors enables json error response bodies for clients that accept
+	// application/json. Other clients get plain text errors, as usual.
+	JSONErrors bool
+	// AllowedHosts is an optional list of hostnames (without port) the
+	// incoming request Host header must match, for virtual hosted
+	// deployments. Requests for other hosts are rejected with a 421
+	// (Misdirected Request). Matching is case insensitive. Empty allows all.
+	AllowedHosts []string
+	// SelfHosts is an optional list of hostnames (without port) this camo
+	// instance is reachable at. Origin redirects to one of them are refused
+	// with a 508 (Loop Detected), instead of recursing through the proxy.
+	// Matching is case insensitive.
+	SelfHosts []string
+	// EnforceExtensionContentTypeMatch rejects responses where the content
+	// type does not match a well known extension of the origin url path.
+	// Unknown or missing extensions are not checked.
+	EnforceExtensionContentTypeMatch bool
+	// RelabelExtensionContentType relabels mismatched responses with the
+	// content type of the extension, instead of rejecting them. Requires
+	// EnforceExtensionContentTypeMatch.
+	RelabelExtensionContentType bool
+	// StrictContentLength buffers responses with a declared Content-Length,
+	// and responds with a 502 if the upstream body is shorter than declared.
+	// Bodies longer than declared are always truncated to the declared
+	// length. Responses declaring more than MaxSize (or
+	// DefaultMaxEncodedBodySize if MaxSize is unset) bytes are streamed, as
+	// when disabled.
+	StrictContentLength bool
+	// EnableHTTP3 fetches from https origins over HTTP/3 (QUIC), once they
+	// advertise support via an Alt-Svc response header. Requires a build
+	// with the `http3` build tag.
+	EnableHTTP3 bool
+	// MaxLocationLength is the maximum length of an upstream Location
+	// header. Longer redirects are rejected. Zero uses
+	// DefaultMaxLocationLength.
+	MaxLocationLength int
+	// MaxRedirectBodySize is the maximum number of bytes of a redirect
+	// response body read (and discarded) before following the redirect.
+	// Zero uses DefaultMaxRedirectBodySize.
+	MaxRedirectBodySize int64
+	// RedirectBodyTimeout bounds the time spent reading a redirect response
+	// body before following the redirect. Zero uses
+	// DefaultRedirectBodyTimeout.
+	RedirectBodyTimeout time.Duration
+	// PerHostTimeouts overrides RequestTimeout for requests to the given
+	// origin hosts (matched case insensitively, without port). Values are
+	// clamped to MaxPerHostTimeout. The timeout of the original host also
+	// applies to any redirects.
+	PerHostTimeouts map[string]time.Duration
+	// CategoryTimeouts overrides the request timeout per content category
+	// (the top level media type, eg. "image", "video", or "audio"), applied
+	// once the response content type is known. Timeouts are measured from
+	// the start of the upstream request, and replace RequestTimeout (or the
+	// host's PerHostTimeouts entry), so may be longer or shorter. Values are
+	// clamped to MaxPerHostTimeout. The request timeout still bounds the time
+	// until the response headers are read.
+	CategoryTimeouts map[string]time.Duration
+	// NegativeCacheTTL is how long upstream failures (connection errors,
+	// timeouts, and 5xx responses) are cached for. Requests for the same url
+	// within the window get the cached failure, without fetching, so a
+	// failing origin is not hammered by retries. Zero disables.
+	NegativeCacheTTL time.Duration
+	// BlockCacheTTL is how long hosts that resolved to a rejected ip are
+	// remembered for. Requests for a remembered host are blocked without
+	// re-resolving. Only block decisions are cached (never allows), and the
+	// ttl is clamped to MaxBlockCacheTTL. Zero disables.
+	BlockCacheTTL time.Duration
+	// MaxRetries is the maximum number of times a 429 or 503 upstream
+	// response is retried. A Retry-After header is honored, and retries
+	// are only made within the RequestTimeout budget. Zero disables.
+	MaxRetries int
+	// MaxDistinctHostsInFlight is the maximum number of distinct origin
+	// hosts with in-flight requests. Requests for additional hosts are shed
+	// with a 503, while hosts already in flight continue to be served. Zero
+	// disables.
+	MaxDistinctHostsInFlight int
+	// MaxConcurrentHandshakes caps the number of concurrent outbound tls
+	// handshakes (including the connection dial), to smooth cpu usage
+	// during a flood of fetches to new hosts. Zero disables.
+	MaxConcurrentHandshakes int
+	// MaxConcurrentPerURL caps the number of concurrent in-flight requests
+	// for a single (decoded) url, so one hot url can not be used to hammer
+	// an origin. Additional requests wait up to MaxConcurrentPerURLWait for
+	// a free slot, and are then shed with a 503. Zero disables.
+	MaxConcurrentPerURL int
+	// MaxConcurrentPerURLWait is how long a request over the
+	// MaxConcurrentPerURL limit waits for a free slot. Zero sheds
+	// immediately.
+	MaxConcurrentPerURLWait time.Duration
+	// ClientBandwidthLimit caps the bytes sent to a single client (by ip,
+	// with IPv6 grouped by /64) over a sliding ClientBandwidthWindow.
+	// Requests from clients over budget get a 429. Zero disables.
+	ClientBandwidthLimit int64
+	// ClientBandwidthWindow is the window ClientBandwidthLimit applies
+	// over. Zero uses DefaultClientBandwidthWindow.
+	ClientBandwidthWindow time.Duration
+	// TrustedProxies lists proxy ips or cidrs in front of camo. For
+	// requests from a trusted proxy, the client ip is taken from
+	// X-Forwarded-For, instead of the remote address.
+	TrustedProxies []string
+	// ForwardHeaders lists additional client request headers always
+	// forwarded to origins. Headers the proxy sets itself (eg. Accept,
+	// User-Agent, or X-Forwarded-For) are not allowed.
+	ForwardHeaders []string
+	// DisableConditionalRequests stops forwarding the If-None-Match and
+	// If-Modified-Since client request headers, so origins always return a
+	// full response instead of a 304.
+	DisableConditionalRequests bool
+	// DisableRangeRequests stops forwarding the Range client request header,
+	// so origins always return a full response instead of a 206.
+	DisableRangeRequests bool
+	// RequireAcceptImage rejects requests with a 406 (Not Acceptable),
+	// unless their Accept header accepts one of the allowed content types
+	// (image/*, and video/*, audio/*, or mjpeg streams when allowed).
+	// Requests without an Accept header are rejected too.
+	RequireAcceptImage bool
+	// EmitOutcomeHeader adds an X-Camo-Outcome header to every response,
+	// with a machine readable category of the outcome (eg. served,
+	// blocked-ssrf, or blocked-content-type), for edge debugging
+	// dashboards. It is not sent on blocks when StealthBlocks is set.
+	EmitOutcomeHeader bool
+	// ContentTypeParams, if set, lists the content type parameters (eg.
+	// charset) relayed to clients. Other parameters sent by the origin are
+	// dropped, except the boundary of multipart types. Content types with
+	// malformed parameters are always rejected.
+	ContentTypeParams []string
+	// AcceptCH lists client hints (eg. `DPR`, `Width`, or `Sec-CH-DPR`)
+	// advertised in an Accept-CH header on successful responses. Clients
+	// sending them have them forwarded to the origin, which may use them to
+	// pick (or resize) the image. go-camo does not transcode images itself.
+	AcceptCH []string
+	// CORP, if set, is sent as the Cross-Origin-Resource-Policy header of
+	// successful responses. One of `same-site`, `same-origin`, or
+	// `cross-origin` (needed to embed images on COEP enabled sites).
+	CORP string
+	// UpstreamClientCert and UpstreamClientKey are paths to a PEM encoded
+	// certificate and private key, loaded by New and presented to origins
+	// that request a client certificate (mutual tls). Both must be set.
+	UpstreamClientCert string
+	UpstreamClientKey  string
+	// UpstreamRootCAs is the path to a PEM encoded bundle of CA
+	// certificates trusted for origin connections, in addition to the
+	// system roots. Useful for internal origins with a private CA.
+	UpstreamRootCAs string
+	// AddHeaders are set on every response served by the proxy, both
+	// successful and error responses, so library users get default headers
+	// (eg. a Content-Security-Policy) without using the router. They are
+	// set before the request is handled, as the router does, so headers
+	// set or relayed by the proxy may replace or add to them.
+	AddHeaders map[string]string
+	// TimingAllowOrigin, if set, is sent as the Timing-Allow-Origin header
+	// of successful responses, allowing Resource Timing API access.
+	TimingAllowOrigin string
+	// SuspiciousHeaderThreshold, if non-zero, rejects (and logs) origin
+	// responses with more than this many dangerous header values (such as
+	// Set-Cookie or Refresh), as a heuristic for detecting malicious or
+	// compromised origins.
+	SuspiciousHeaderThreshold int
+	// CanonicalizeHeaders rewrites upstream response header names to
+	// canonical MIME casing before they are filtered and relayed. The go
+	// http client already does this for most responses, but not every
+	// transport does, so origin casing quirks could otherwise leak through.
+	CanonicalizeHeaders bool
+	// ResponseCSPReportOnly, when true, turns any Content-Security-Policy
+	// header already set on a response (eg. by the router's AddHeaders)
+	// into a Content-Security-Policy-Report-Only header, so violations are
+	// reported instead of enforced. Useful when rolling out a new policy.
+	ResponseCSPReportOnly bool
+	// ResponseCSPReportURI, if set, is added to the report-only policy as a
+	// report-uri directive. Requires ResponseCSPReportOnly.
+	ResponseCSPReportURI string
+	// RulesFiles are paths of filter rules files (in filter-ruleset format),
+	// loaded by New in order, and evaluated after any filters passed to
+	// NewWithFilters. Later files take precedence: a url is allowed or
+	// denied by the last file with a matching allow or deny rule. Urls
+	// matching no rule are denied if any file has allow rules.
+	RulesFiles []string
+	// RulesURL, if set, is an http(s) url of filter rules (in filter-ruleset
+	// format), evaluated after any filters passed to NewWithFilters, and
+	// RulesFiles. The rules are fetched by New (failing if they can not be),
+	// and then refreshed every RulesRefreshInterval. If a refresh fails, the
+	// current rules are kept.
+	RulesURL string
+	// RulesRefreshInterval is the interval between RulesURL refreshes.
+	// Defaults to DefaultRulesRefreshInterval.
+	RulesRefreshInterval time.Duration
+	// ParentCamoURL, if set, is the base url of a parent camo instance that
+	// origin urls are fetched through (eg. a central instance, in multi
+	// region setups). Incoming urls are still verified with HMACKey, and
+	// then re-signed with ParentCamoKey. The parent is dialed without ip
+	// filtering, and is expected to filter origins itself.
+	ParentCamoURL string
+	// ParentCamoKey is the hmac key of the parent camo instance. It is
+	// decoded according to HMACKeyEncoding.
+	ParentCamoKey []byte
+	// InsecureNoAuth disables HMAC verification, accepting unsigned base64
+	// encoded urls (the signature path component is ignored). For local
+	// development only. It must never be used in production, and can not be
+	// combined with an HMAC key or metrics collection.
+	InsecureNoAuth bool
+	// ReusePort sets SO_REUSEPORT on listeners created with Listen, so
+	// several processes can share a port. Unix only.
+	ReusePort bool
+	// ClientKeepAlive is the TCP keepalive period of client connections
+	// accepted by listeners created with Listen, so half-open connections
+	// are cleaned up. Zero uses DefaultClientKeepAlive, and a negative value
+	// disables keepalives.
+	ClientKeepAlive time.Duration
+	// HTMLResponseStatus is the status code returned when an origin responds
+	// with an html page (typically an error page served with a 200) instead
+	// of an image. Zero uses 400, as for other unsupported content types.
+	HTMLResponseStatus int
+	// EmptyResponseMode selects the handling of 200 responses with neither
+	// a content type nor a body (a declared Content-Length of 0). One of
+	// `reject` (the default, a 400 as for any response without a content
+	// type), `strict` (a 502, treating it as an origin error), or `empty`
+	// (relayed as an empty 200).
+	EmptyResponseMode string
+	// StartInMaintenance starts the proxy in maintenance (drain) mode, see
+	// Proxy.SetMaintenance.
+	StartInMaintenance bool
+	// RewriteLinkHeader relays upstream Link headers (eg. preload hints),
+	// with their targets rewritten to signed camo urls, so the referenced
+	// resources are also fetched through the proxy. Targets the proxy would
+	// reject are dropped. Also required for RelayEarlyHints.
+	RewriteLinkHeader bool
+	// ExposeOriginHeader sets an X-Camo-Origin response header to the
+	// decoded origin url, for debugging. It is not set on blocked responses.
+	// It reveals origin urls to clients, so it is disabled by default.
+	ExposeOriginHeader bool
+	// DefaultAcceptLanguage, if set, is sent upstream as the Accept-Language
+	// header of requests where the client did not send one (or where
+	// Accept-Language is not forwarded from clients), for origins that vary
+	// images by language.
+	DefaultAcceptLanguage string
 	// no ip filtering (test mode)
 	noIPFiltering bool
 }
@@ -63,12 +450,72 @@ type FilterFunc func(*url.URL) bool
 // A Proxy is a Camo like HTTP proxy, that provides content type
 // restrictions as well as regex host allow list support.
 type Proxy struct {
-	client            *http.Client
 	config            *Config
 	acceptTypesFilter *htrie.GlobPathChecker
+	acceptTypes       []string
+	// lower cased Config.ContentTypeParams. nil when not configured.
+	contentTypeParams map[string]bool
 	acceptTypesString string
 	filters           []FilterFunc
 	filtersLen        int
+	bufPool           *sync.Pool
+	// whether content-encoded responses are inspected for bombs
+	checkDecompression bool
+	// lower cased allowed extensions (with leading dot). nil allows all.
+	allowedExts map[string]bool
+	// lower cased allowed request hosts. nil allows all.
+	allowedHosts map[string]bool
+	// lower cased hosts of this camo instance. nil when not configured.
+	selfHosts map[string]bool
+	// Config.AddHeaders, with canonical names. nil when not configured.
+	addHeaders map[string]string
+	// canonical Config.AcceptCH names, and the Accept-CH value. nil (and
+	// empty) when not configured.
+	clientHints map[string]bool
+	acceptCH    string
+	// request headers forwarded to origins. see buildReqHeaders.
+	reqHeaders map[string]bool
+	// verification keys (primary first), and their fingerprints
+	hmacKeys [][]byte
+	keyIDs   []string
+	// cached upstream failures. nil when disabled.
+	negativeCache *negativeCache
+	// lower cased hosts recently rejected by ip filtering. nil when disabled.
+	blockCache *negativeCache
+	// lower cased host -> request timeout. nil when not configured.
+	hostTimeouts map[string]time.Duration
+	// lower cased content category -> request timeout. nil when not
+	// configured.
+	categoryTimeouts map[string]time.Duration
+	// the longest of categoryTimeouts
+	maxCategoryTimeout time.Duration
+	// urls blocked for legal reasons. nil when not configured.
+	legalFilter FilterFunc
+	// ruleset compiled from Config.RulesFiles. nil when not configured.
+	fileRules *Ruleset
+	// *Ruleset loaded from Config.RulesURL. unset when not configured.
+	remoteRules atomic.Value
+	// *upstream for origin fetches, swapped by ReloadTransport
+	upstream atomic.Value
+	reloadMu sync.Mutex
+	// closed by Close, to stop background work
+	stop      chan struct{}
+	closeOnce sync.Once
+	// Via header value, with a per instance id for loop detection
+	via string
+	// limits distinct in-flight hosts. nil when disabled.
+	hostLimiter *hostLimiter
+	// limits concurrent requests per url. nil when disabled.
+	urlLimiter *urlLimiter
+	// bytes sent per client. nil when disabled.
+	bandwidth *bandwidthLimiter
+	// parsed Config.TrustedProxies
+	trustedProxies []*net.IPNet
+	// maintenance mode (1 when enabled). accessed atomically.
+	maintenance int32
+	// counters for Stats. a pointer, so the 64 bit counters are aligned for
+	// atomic access on 32 bit platforms.
+	stats *proxyStats
 }
 
 // ServerHTTP handles the client request, validates the request is validly
@@ -76,35 +523,169 @@ type Proxy struct {
 // valid requests to the desired endpoint. Responses are filtered for
 // proper image content types.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddUint64(&p.stats.requests, 1)
+	atomic.AddInt64(&p.stats.inFlight, 1)
+	defer atomic.AddInt64(&p.stats.inFlight, -1)
+
+	for k, v := range p.addHeaders {
+		w.Header().Set(k, v)
+	}
 	if p.config.DisableKeepAlivesFE {
 		w.Header().Set("Connection", "close")
 	}
+	if p.config.ResponseCSPReportOnly {
+		p.reportOnlyCSP(w.Header())
+	}
+
+	if !p.checkHost(req.Host) {
+		if mlog.HasDebug() {
+			mlog.Debugm("request for unknown host", mlog.Map{"host": req.Host})
+		}
+		p.httpError(w, req, "Misdirected Request", http.StatusMisdirectedRequest)
+		return
+	}
 
-	if req.Header.Get("Via") == p.config.ServerName {
-		http.Error(w, "Request loop failure", http.StatusNotFound)
+	if p.InMaintenance() {
+		w.Header().Set("Retry-After", maintenanceRetryAfter)
+		p.httpError(w, req, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
+	if p.isLoop(req) {
+		p.httpError(w, req, "Request loop failure", http.StatusNotFound)
+		return
+	}
+
+	var clientKey string
+	if p.bandwidth != nil {
+		if ip := p.clientIP(req); ip != nil {
+			clientKey = bandwidthKey(ip)
+		}
+		if clientKey != "" && !p.bandwidth.allow(clientKey) {
+			if mlog.HasDebug() {
+				mlog.Debugm("client bandwidth limit reached", mlog.Map{"client": clientKey})
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int((p.bandwidth.window+time.Second-1)/time.Second)))
+			p.httpError(w, req, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
 	// split path and get components
-	components := strings.Split(req.URL.Path, "/")
-	if len(components) < 3 {
-		http.Error(w, "Malformed request path", http.StatusNotFound)
+	reqPath := req.URL.Path
+	if p.config.PathPrefix != "" {
+		if !strings.HasPrefix(reqPath, p.config.PathPrefix+"/") {
+			p.httpError(w, req, "Not Found", http.StatusNotFound)
+			return
+		}
+		reqPath = reqPath[len(p.config.PathPrefix):]
+	}
+
+	var sigHash, encodedURL, queryURL string
+	components := strings.Split(reqPath, "/")
+	switch {
+	case len(components) >= 3:
+		sigHash, encodedURL = components[1], components[2]
+	case len(components) == 2 && p.config.QueryStringURLs && req.URL.Query().Get("url") != "":
+		q := req.URL.Query()
+		sigHash, queryURL = q.Get("digest"), q.Get("url")
+		if sigHash == "" {
+			sigHash = components[1]
+		}
+	default:
+		p.httpError(w, req, "Malformed request path", http.StatusNotFound)
 		return
 	}
-	sigHash, encodedURL := components[1], components[2]
 
 	if mlog.HasDebug() {
 		mlog.Debugm("client request", mlog.Map{"req": req})
 	}
 
-	sURL, ok := encoding.DecodeURL(p.config.HMACKey, sigHash, encodedURL)
-	if !ok {
-		http.Error(w, "Bad Signature", http.StatusForbidden)
+	var sURL string
+	switch {
+	case p.config.InsecureNoAuth && queryURL != "":
+		sURL = queryURL
+	case p.config.InsecureNoAuth:
+		var err error
+		sURL, err = encoding.B64DecodeURLUnsigned(encodedURL)
+		if err != nil {
+			p.httpError(w, req, "Bad url", http.StatusBadRequest)
+			return
+		}
+	default:
+		var keyIdx int
+		if queryURL != "" {
+			sURL, keyIdx = queryURL, encoding.VerifyURLMulti(p.hmacKeys, sigHash, queryURL)
+		} else {
+			sURL, keyIdx = encoding.DecodeURLMultiFormat(
+				encoding.MessageFormat(p.config.HMACMessage), p.hmacKeys, sigHash, encodedURL,
+			)
+		}
+		if keyIdx < 0 {
+			p.setOutcome(w, outcomeBadSig)
+			p.httpError(w, req, "Bad Signature", http.StatusForbidden)
+			return
+		}
+
+		if p.config.CollectMetrics {
+			keyVerifications.WithLabelValues(p.keyIDs[keyIdx]).Inc()
+		}
+		if keyIdx > 0 {
+			if !p.config.SunsetLegacyKeyURLs.IsZero() {
+				w.Header().Set("Sunset", p.config.SunsetLegacyKeyURLs.UTC().Format(http.TimeFormat))
+			}
+			if mlog.HasDebug() {
+				mlog.Debugm("verified with fallback key", mlog.Map{"key": p.keyIDs[keyIdx]})
+			}
+		}
+	}
+
+	// signed urls may pin the allowed referer host, and content type
+	sURL, refererHost := encoding.SplitReferer(sURL)
+	sURL, pinnedType := encoding.SplitContentType(sURL)
+	if pinnedType != "" && !validContentTypePattern(pinnedType) {
+		p.httpError(w, req, "Bad url", http.StatusBadRequest)
 		return
 	}
 
 	if mlog.HasDebug() {
-		mlog.Debugm("signed client url", mlog.Map{"url": sURL})
+		mlog.Debugm("signed client url", mlog.Map{"url": sURL, "type": pinnedType, "referer": refererHost})
+	}
+
+	if refererHost != "" && !refererAllowed(req, refererHost) {
+		if mlog.HasDebug() {
+			mlog.Debugm("referer not allowed", mlog.Map{"url": sURL, "referer": req.Referer()})
+		}
+		p.setOutcome(w, outcomeReferer)
+		p.blockResponse(w, req, "Referer not allowed", http.StatusForbidden)
+		return
+	}
+
+	if p.config.RequireAcceptImage && !acceptsMediaTypes(req.Header.Get("Accept"), p.acceptTypes) {
+		if mlog.HasDebug() {
+			mlog.Debugm("accept not allowed", mlog.Map{"url": sURL, "accept": req.Header.Get("Accept")})
+		}
+		// json errors already vary on accept
+		if !p.config.JSONErrors {
+			w.Header().Add("Vary", "Accept")
+		}
+		p.httpError(w, req, "Not Acceptable", http.StatusNotAcceptable)
+		return
+	}
+
+	// fragments are never sent to origins. strip them up front, so filters,
+	// cache keys, headers, and parent camo urls all see the same url.
+	if i := strings.IndexByte(sURL, '#'); i >= 0 {
+		sURL = sURL[:i]
+	}
+
+	if p.config.CollapseSlashes {
+		sURL = collapseSlashes(sURL)
+	}
+
+	if p.config.SelfTestImagePath != "" && sURL == p.config.SelfTestImagePath {
+		p.serveSelfTest(w)
+		return
 	}
 
 	u, err := url.Parse(sURL)
@@ -112,27 +693,134 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		if mlog.HasDebug() {
 			mlog.Debugm("url parse error", mlog.Map{"err": err})
 		}
-		http.Error(w, "Bad url", http.StatusBadRequest)
+		p.httpError(w, req, "Bad url", http.StatusBadRequest)
 		return
 	}
 
 	err = p.checkURL(u)
+	if err == errLegalBlock {
+		p.legalBlockResponse(w, req)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		p.setOutcome(w, checkURLOutcome(err))
+		p.blockResponse(w, req, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !p.checkExtension(u) {
+		p.setOutcome(w, outcomeURL)
+		p.blockResponse(w, req, "Extension rejected", http.StatusNotFound)
 		return
 	}
 
-	nreq, err := http.NewRequestWithContext(req.Context(), req.Method, sURL, nil)
+	if p.blockCache != nil {
+		if e, ok := p.blockCache.get(strings.ToLower(u.Hostname())); ok {
+			if mlog.HasDebug() {
+				mlog.Debugm("host recently rejected by ip filtering", mlog.Map{"url": sURL})
+			}
+			p.setOutcome(w, outcomeSSRF)
+			p.blockResponse(w, req, e.msg, e.code)
+			return
+		}
+	}
+
+	// only set for urls that pass validation, so blocks never reveal it
+	if p.config.ExposeOriginHeader {
+		w.Header().Set("X-Camo-Origin", sURL)
+	}
+
+	if p.negativeCache != nil {
+		if e, ok := p.negativeCache.get(cacheKey(u)); ok {
+			if mlog.HasDebug() {
+				mlog.Debugm("serving cached upstream failure", mlog.Map{"url": sURL, "code": e.code})
+			}
+			p.setOutcome(w, outcomeUpstream)
+			p.httpError(w, req, e.msg, e.code)
+			return
+		}
+	}
+
+	if p.hostLimiter != nil {
+		host := strings.ToLower(u.Hostname())
+		if !p.hostLimiter.acquire(host) {
+			if mlog.HasDebug() {
+				mlog.Debugm("distinct host limit reached", mlog.Map{"host": host})
+			}
+			p.httpError(w, req, "Too many distinct hosts in flight", http.StatusServiceUnavailable)
+			return
+		}
+		defer p.hostLimiter.release(host)
+	}
+
+	if p.urlLimiter != nil {
+		key := cacheKey(u)
+		if !p.urlLimiter.acquire(req.Context(), key, p.config.MaxConcurrentPerURLWait) {
+			if mlog.HasDebug() {
+				mlog.Debugm("per url concurrency limit reached", mlog.Map{"url": sURL})
+			}
+			p.httpError(w, req, "Too many concurrent requests for url", http.StatusServiceUnavailable)
+			return
+		}
+		defer p.urlLimiter.release(key)
+	}
+
+	// request context is wrapped to support cancelling the upstream request
+	// when the body timeout is exceeded.
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	// the request timeout bounds the whole upstream fetch, including any
+	// retries, until the response content type is known. a category timeout
+	// then replaces it, so the overall deadline is the longer of the two.
+	fetchStart := time.Now()
+	timeout := p.requestTimeout(u)
+	var fetchDeadline time.Time
+	var headerTimer *time.Timer
+	if timeout > 0 {
+		fetchDeadline = fetchStart.Add(timeout)
+		ceiling := timeout
+		if p.maxCategoryTimeout > ceiling {
+			ceiling = p.maxCategoryTimeout
+			headerTimer = time.AfterFunc(timeout, cancel)
+			defer headerTimer.Stop()
+		}
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, ceiling)
+		defer cancelTimeout()
+	}
+	if p.config.RelayEarlyHints {
+		var hop *earlyHintsHop
+		ctx, hop = withEarlyHintsHop(ctx, u)
+		ctx = httptrace.WithClientTrace(ctx, p.earlyHintsTrace(w, hop))
+	}
+
+	// the signed url is used verbatim (not re-serialized from the parsed url),
+	// so the raw path and query string are sent byte for byte. presigned
+	// (eg. s3/gcs) urls depend on this.
+	up := p.upstream.Load().(*upstream)
+	client, fetchURL := up.client, sURL
+	if up.parent != nil {
+		client, fetchURL = up.parent.client, up.parent.url(sURL)
+	}
+	var depth *int32
+	if p.config.CollectMetrics {
+		ctx, depth = withRedirectDepth(ctx)
+	}
+	nreq, err := http.NewRequestWithContext(ctx, req.Method, fetchURL, nil)
 	if err != nil {
 		if mlog.HasDebug() {
 			mlog.Debugm("could not create NewRequest", mlog.Map{"err": err})
 		}
-		http.Error(w, "Error Fetching Resource", http.StatusBadGateway)
+		p.httpError(w, req, "Error Fetching Resource", http.StatusBadGateway)
 		return
 	}
 
 	// filter headers
-	p.copyHeaders(&nreq.Header, &req.Header, &ValidReqHeaders)
+	p.copyHeaders(&nreq.Header, &req.Header, &p.reqHeaders)
+
+	if p.config.DefaultAcceptLanguage != "" && nreq.Header.Get("Accept-Language") == "" {
+		nreq.Header.Set("Accept-Language", p.config.DefaultAcceptLanguage)
+	}
 
 	// x-forwarded-for (if appropriate)
 	if p.config.EnableXFwdFor {
@@ -157,13 +845,29 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	nreq.Header.Set("Accept", p.acceptTypesString)
 
 	nreq.Header.Add("User-Agent", p.config.ServerName)
-	nreq.Header.Add("Via", p.config.ServerName)
+	// extend the Via chain, so loops across instances (eg. through a
+	// parent) are detected too.
+	for _, v := range req.Header["Via"] {
+		nreq.Header.Add("Via", v)
+	}
+	nreq.Header.Add("Via", p.via)
 
 	if mlog.HasDebug() {
 		mlog.Debugm("built outgoing request", mlog.Map{"req": nreq})
 	}
 
-	resp, err := p.client.Do(nreq)
+	resp, err := p.doWithRetries(client, nreq, fetchDeadline)
+	if depth != nil {
+		redirectDepth.Observe(float64(atomic.LoadInt32(depth)))
+	}
+	if headerTimer != nil && !headerTimer.Stop() {
+		// the request timeout passed before the response headers (and so,
+		// the content type) were known
+		if resp != nil {
+			resp.Body.Close()
+		}
+		resp, err = nil, context.DeadlineExceeded
+	}
 
 	if resp != nil {
 		defer resp.Body.Close()
@@ -171,39 +875,87 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	if err != nil {
 		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			// request deadline (shared by any retries), or the request
+			// timeout passed before the response headers were read
+			if mlog.HasDebug() {
+				mlog.Debugm("request deadline exceeded", mlog.Map{"err": err})
+			}
+			p.upstreamFailed(w, req, u, "Error Fetching Resource", http.StatusGatewayTimeout)
+			return
 		case errors.Is(err, context.Canceled):
 			// handle client aborting request early in the request lifetime
 			if mlog.HasDebug() {
 				mlog.Debugm("client aborted request (early)", mlog.Map{"req": req})
 			}
 			return
+		case errors.Is(err, ErrTooManyRedirects):
+			if mlog.HasDebug() {
+				mlog.Debugm("too many redirects", mlog.Map{"err": err})
+			}
+			p.setOutcome(w, outcomeRedirect)
+			p.blockResponse(w, req, "Error Fetching Resource", p.config.TooManyRedirectsStatus)
+			return
+		case errors.Is(err, ErrSelfRedirect):
+			if mlog.HasDebug() {
+				mlog.Debugm("redirect to self", mlog.Map{"err": err})
+			}
+			p.setOutcome(w, outcomeRedirect)
+			p.blockResponse(w, req, "Redirect loop detected", http.StatusLoopDetected)
+			return
+		case errors.Is(err, errLegalBlock):
+			// redirected to a url matching a legal rule
+			if mlog.HasDebug() {
+				mlog.Debugm("redirect to legally blocked url", mlog.Map{"err": err})
+			}
+			p.legalBlockResponse(w, req)
+			return
 		case errors.Is(err, ErrRedirect):
 			// Got a bad redirect
 			if mlog.HasDebug() {
 				mlog.Debugm("bad redirect from server", mlog.Map{"err": err})
 			}
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			p.setOutcome(w, outcomeRedirect)
+			p.blockResponse(w, req, "Error Fetching Resource", http.StatusNotFound)
+			return
+		case errors.Is(err, ErrAmbiguousFraming):
+			if mlog.HasDebug() {
+				mlog.Debugm("ambiguous response framing", mlog.Map{"err": err})
+			}
+			p.upstreamFailed(w, req, u, "Error Fetching Resource", http.StatusBadGateway)
+			return
+		case errors.Is(err, ErrLocationTooLong):
+			if mlog.HasDebug() {
+				mlog.Debugm("location header too long", mlog.Map{"err": err})
+			}
+			p.upstreamFailed(w, req, u, "Error Fetching Resource", http.StatusBadGateway)
 			return
 		case errors.Is(err, ErrRejectIP):
 			// Got a deny list failure from Dial.Control
 			if mlog.HasDebug() {
 				mlog.Debugm("ip filter rejection from dial.control", mlog.Map{"err": err})
 			}
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			if p.blockCache != nil {
+				p.blockCache.add(blockedHost(err, u), http.StatusNotFound, "Error Fetching Resource")
+			}
+			p.setOutcome(w, outcomeSSRF)
+			p.blockResponse(w, req, "Error Fetching Resource", http.StatusNotFound)
 			return
 		case errors.Is(err, ErrInvalidHostPort):
 			// Got a deny list failure from Dial.Control
 			if mlog.HasDebug() {
 				mlog.Debugm("invalid host/port rejection from dial.control", mlog.Map{"err": err})
 			}
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			p.setOutcome(w, outcomeSSRF)
+			p.blockResponse(w, req, "Error Fetching Resource", http.StatusNotFound)
 			return
 		case errors.Is(err, ErrInvalidNetType):
 			// Got a deny list failure from Dial.Control
 			if mlog.HasDebug() {
 				mlog.Debugm("net type rejection from dial.control", mlog.Map{"err": err})
 			}
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			p.setOutcome(w, outcomeSSRF)
+			p.blockResponse(w, req, "Error Fetching Resource", http.StatusNotFound)
 			return
 		}
 
@@ -216,20 +968,47 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		// the newer error semantics yet...
 		switch errString := err.Error(); {
 		case containsOneOf(errString, "timeout", "Client.Timeout"):
-			http.Error(w, "Error Fetching Resource", http.StatusGatewayTimeout)
+			p.upstreamFailed(w, req, u, "Error Fetching Resource", http.StatusGatewayTimeout)
 		case strings.Contains(errString, "use of closed"):
-			http.Error(w, "Error Fetching Resource", http.StatusBadGateway)
+			p.upstreamFailed(w, req, u, "Error Fetching Resource", http.StatusBadGateway)
+		case containsOneOf(errString, "multiple Content-Length", "transfer encoding"):
+			// ambiguous message framing (conflicting Content-Length headers,
+			// or an unsupported or repeated Transfer-Encoding). Responses with
+			// both Transfer-Encoding and Content-Length are rejected with
+			// ErrAmbiguousFraming instead.
+			p.upstreamFailed(w, req, u, "Error Fetching Resource", http.StatusBadGateway)
 		default:
 			// some other error. call it a not found (camo compliant)
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
+			p.upstreamFailed(w, req, u, "Error Fetching Resource", http.StatusNotFound)
 		}
 		return
 	}
 
+	if p.config.CanonicalizeHeaders {
+		canonicalizeHeaders(resp.Header)
+	}
+
 	if mlog.HasDebug() {
 		mlog.Debugm("response from upstream", mlog.Map{"resp": resp})
 	}
 
+	if p.config.BodyTimeout > 0 {
+		bodyTimer := time.AfterFunc(p.config.BodyTimeout, cancel)
+		defer bodyTimer.Stop()
+	}
+
+	if p.config.SuspiciousHeaderThreshold > 0 {
+		if n := countDangerousHeaders(resp.Header); n > p.config.SuspiciousHeaderThreshold {
+			if p.config.CollectMetrics {
+				suspiciousOrigins.Inc()
+			}
+			mlog.Printm("suspicious origin response", mlog.Map{"url": sURL, "dangerous_headers": n})
+			p.setOutcome(w, outcomeContent)
+			p.blockResponse(w, req, "Suspicious origin response", http.StatusNotFound)
+			return
+		}
+	}
+
 	// check for too large a response
 	if p.config.MaxSize > 0 && resp.ContentLength > p.config.MaxSize {
 		if p.config.CollectMetrics {
@@ -238,21 +1017,33 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		if mlog.HasDebug() {
 			mlog.Debugm("content length exceeded", mlog.Map{"url": sURL})
 		}
-		http.Error(w, "Content length exceeded", http.StatusNotFound)
+		p.setOutcome(w, outcomeSize)
+		p.blockResponse(w, req, "Content length exceeded", http.StatusNotFound)
 		return
 	}
 
-	var responseContentType string
+	var responseContentType, responseMediaType string
 	switch resp.StatusCode {
 	case 200, 206:
-		contentType := resp.Header.Get("Content-Type")
+		contentTypes := resp.Header["Content-Type"]
 
 		// early abort if content type is empty. avoids empty mime parsing overhead.
-		if contentType == "" {
+		if strings.TrimSpace(strings.Join(contentTypes, "")) == "" {
 			if mlog.HasDebug() {
 				mlog.Debug("Empty content-type returned")
 			}
-			http.Error(w, "Empty content-type returned", http.StatusBadRequest)
+			if resp.StatusCode == 200 && resp.ContentLength == 0 {
+				switch p.config.EmptyResponseMode {
+				case "strict":
+					p.httpError(w, req, "Empty response returned", http.StatusBadGateway)
+					return
+				case "empty":
+					p.relayEmptyResponse(w, resp)
+					return
+				}
+			}
+			p.setOutcome(w, outcomeContentType)
+			p.blockResponse(w, req, "Empty content-type returned", http.StatusBadRequest)
 			return
 		}
 
@@ -262,80 +1053,318 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		// or have a "default fallback" such as text/html, which would be insecure in
 		// this context.
 		// content-type: image/png, text/html; charset=...
-		mediatype, param, err := mime.ParseMediaType(contentType)
+		// origins occasionally send duplicate content-type headers. the first
+		// valid one is used, and only it is relayed.
+		mediatype, param, err := parseContentType(contentTypes)
+		if err == nil && isHTMLMediaType(mediatype) && !p.acceptTypesFilter.CheckPath(mediatype) {
+			// origins frequently answer missing images with a 200 and an
+			// html error page. report it separately, to help diagnose
+			// broken images.
+			if p.config.CollectMetrics {
+				contentTypeRejected.WithLabelValues(rejectReasonHTML).Inc()
+			}
+			if mlog.HasDebug() {
+				mlog.Debugm("origin returned an html page", mlog.Map{"url": sURL, "type": mediatype})
+			}
+			p.setOutcome(w, outcomeContentType)
+			p.blockResponse(w, req, "Origin returned an HTML page", p.config.HTMLResponseStatus)
+			return
+		}
 		if err != nil || !p.acceptTypesFilter.CheckPath(mediatype) {
+			p.rejectContentType(w, req, contentTypes)
+			return
+		}
+
+		if pinnedType != "" && !matchContentTypePattern(pinnedType, mediatype) {
 			if mlog.HasDebug() {
-				mlog.Debugm("Unsupported content-type returned", mlog.Map{"type": u})
+				mlog.Debugm("content-type does not match signed type", mlog.Map{"url": sURL, "type": mediatype, "signed": pinnedType})
 			}
-			http.Error(w, "Unsupported content-type returned", http.StatusBadRequest)
+			p.setOutcome(w, outcomeContentType)
+			p.blockResponse(w, req, "Content-type does not match signed type", http.StatusBadRequest)
 			return
 		}
 
 		// add params back in, as certain content types have various optional and/or
 		// required parameters.
 		// refs: https://www.iana.org/assignments/media-types/media-types.xhtml
+		param = filterContentTypeParams(mediatype, param, p.contentTypeParams)
 		responseContentType = mime.FormatMediaType(mediatype, param)
+		responseMediaType = mediatype
 
 		// also check if the parsed content type is empty, just to be safe.
 		// note: round trip of mediatype and params _should_ be fine, but guard
 		// against implementation changes or bugs.
 		if responseContentType == "" {
-			if mlog.HasDebug() {
-				mlog.Debug("Unsupported content-type returned")
-			}
-			http.Error(w, "Unsupported content-type returned", http.StatusBadRequest)
+			p.rejectContentType(w, req, contentTypes)
 			return
 		}
+
+		if p.config.EnforceExtensionContentTypeMatch {
+			extType, ok := extensionMediaType(u.Path, mediatype)
+			if !ok {
+				// only relabel to an otherwise acceptable content type
+				if !p.config.RelabelExtensionContentType || !p.acceptTypesFilter.CheckPath(extType) {
+					if mlog.HasDebug() {
+						mlog.Debugm("content-type does not match extension", mlog.Map{"url": sURL, "type": mediatype})
+					}
+					p.setOutcome(w, outcomeContentType)
+					p.blockResponse(w, req, "Content-type does not match extension", http.StatusBadRequest)
+					return
+				}
+				if mlog.HasDebug() {
+					mlog.Debugm("relabeling content-type to match extension", mlog.Map{"url": sURL, "type": mediatype, "new": extType})
+				}
+				responseContentType = extType
+				responseMediaType = extType
+			}
+		}
 	case 300:
-		http.Error(w, "Multiple choices not supported", http.StatusNotFound)
+		p.httpError(w, req, "Multiple choices not supported", http.StatusNotFound)
 		return
 	case 301, 302, 303, 307:
 		// if we get a redirect here, we either disabled following,
 		// or followed until max depth and still got one (redirect loop)
-		http.Error(w, "Not Found", http.StatusNotFound)
+		p.httpError(w, req, "Not Found", http.StatusNotFound)
 		return
 	case 304:
 		h := w.Header()
 		p.copyHeaders(&h, &resp.Header, &ValidRespHeaders)
+		normalizeRespHeaders(h)
+		// a 304 carries the same Vary as the full response would
+		var vary varyHeader
+		vary.AddUpstream(resp.Header["Vary"], p.forwardedReqHeader)
+		p.varyAcceptLanguage(&vary)
+		if refererHost != "" {
+			vary.Add("Referer")
+		}
+		if p.config.RequireAcceptImage {
+			vary.Add("Accept")
+		}
+		vary.Set(h)
+		p.setOutcome(w, outcomeNotModified)
 		w.WriteHeader(304)
 		return
 	case 404:
-		http.Error(w, "Not Found", http.StatusNotFound)
+		p.httpError(w, req, "Not Found", http.StatusNotFound)
 		return
 	case 500, 502, 503, 504:
 		// upstream errors should probably just 502. client can try later.
-		http.Error(w, "Error Fetching Resource", http.StatusBadGateway)
+		p.upstreamFailed(w, req, u, "Error Fetching Resource", http.StatusBadGateway)
 		return
 	default:
-		http.Error(w, "Not Found", http.StatusNotFound)
+		p.httpError(w, req, "Not Found", http.StatusNotFound)
 		return
 	}
 
+	// once the content type is known, a category timeout replaces the
+	// request timeout
+	if categoryTimeout, ok := p.categoryTimeout(responseMediaType); ok || headerTimer != nil {
+		if ok {
+			timeout = categoryTimeout
+		}
+		remaining := timeout - time.Since(fetchStart)
+		if remaining <= 0 {
+			if mlog.HasDebug() {
+				mlog.Debugm("category timeout exceeded", mlog.Map{"url": sURL, "type": responseMediaType})
+			}
+			p.upstreamFailed(w, req, u, "Error Fetching Resource", http.StatusGatewayTimeout)
+			return
+		}
+		categoryTimer := time.AfterFunc(remaining, cancel)
+		defer categoryTimer.Stop()
+	}
+
+	var bodyRC io.ReadCloser = resp.Body
+
+	// optionally buffer the full declared body before sending anything to
+	// the client, so a short upstream body can be reported as an error.
+	// note: the transport never reads past the declared length, so overlong
+	// bodies are already truncated.
+	if p.config.StrictContentLength && req.Method != "HEAD" && resp.ContentLength > 0 {
+		bufferLimit := int64(DefaultMaxEncodedBodySize)
+		if p.config.MaxSize > 0 {
+			bufferLimit = p.config.MaxSize
+		}
+		if resp.ContentLength <= bufferLimit {
+			body := make([]byte, resp.ContentLength)
+			n, err := io.ReadFull(resp.Body, body)
+			if err != nil {
+				if mlog.HasDebug() {
+					mlog.Debugm("content length mismatch", mlog.Map{
+						"url": sURL, "declared": resp.ContentLength, "read": n, "err": err,
+					})
+				}
+				p.httpError(w, req, "Error Fetching Resource", http.StatusBadGateway)
+				return
+			}
+			bodyRC = ioutil.NopCloser(bytes.NewReader(body))
+		}
+	}
+
+	// buffer and inspect content-encoded responses for decompression bombs,
+	// before sending anything to the client. responses without a body, and
+	// partial content (which can not be decompressed on its own), are
+	// skipped.
+	contentEncoding := resp.Header.Get("Content-Encoding")
+	if p.checkDecompression && contentEncoding != "" && contentEncoding != "identity" && hasInspectableBody(req, resp) {
+		readLimit := int64(DefaultMaxEncodedBodySize)
+		if p.config.MaxSize > 0 {
+			readLimit = p.config.MaxSize
+		}
+		body, err := inspectEncodedBody(
+			contentEncoding, bodyRC, readLimit,
+			p.config.MaxDecompressRatio, p.config.MaxDecompressedSize,
+		)
+		switch {
+		case errors.Is(err, ErrCompressionBomb), errors.Is(err, ErrBadEncoding):
+			if mlog.HasDebug() {
+				mlog.Debugm("encoded response rejected", mlog.Map{"url": sURL, "err": err})
+			}
+			p.setOutcome(w, outcomeContent)
+			p.blockResponse(w, req, "Encoded response rejected", http.StatusBadRequest)
+			return
+		case err != nil:
+			if mlog.HasDebug() {
+				mlog.Debugm("error reading encoded response", mlog.Map{"url": sURL, "err": err})
+			}
+			p.httpError(w, req, "Error Fetching Resource", http.StatusBadGateway)
+			return
+		}
+		bodyRC = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	// optionally reject animated images. only full (200) responses are
+	// inspected, as partial content may not start at the image header.
+	if p.config.DisallowAnimated && resp.StatusCode == 200 && isAnimatable(responseMediaType) {
+		br := bufio.NewReaderSize(bodyRC, animationSniffLen)
+		// a short peek (with error) is fine. inspect whatever was read.
+		prefix, _ := br.Peek(animationSniffLen)
+		if isAnimated(prefix) {
+			if mlog.HasDebug() {
+				mlog.Debugm("animated image rejected", mlog.Map{"url": sURL})
+			}
+			p.setOutcome(w, outcomeContent)
+			p.blockResponse(w, req, "Animated image rejected", http.StatusBadRequest)
+			return
+		}
+		bodyRC = &readCloser{Reader: br, Closer: bodyRC}
+	}
+
+	// optionally reject tiny (tracking pixel) responses. the declared
+	// length is used when known, otherwise the body is peeked.
+	if p.config.MinResponseBytes > 0 && resp.StatusCode == 200 {
+		tooSmall := false
+		switch {
+		case resp.ContentLength >= 0:
+			tooSmall = resp.ContentLength < int64(p.config.MinResponseBytes)
+		case req.Method != "HEAD":
+			br := bufio.NewReaderSize(bodyRC, p.config.MinResponseBytes)
+			prefix, _ := br.Peek(p.config.MinResponseBytes)
+			tooSmall = len(prefix) < p.config.MinResponseBytes
+			bodyRC = &readCloser{Reader: br, Closer: bodyRC}
+		}
+		if tooSmall {
+			if mlog.HasDebug() {
+				mlog.Debugm("response too small", mlog.Map{"url": sURL})
+			}
+			p.setOutcome(w, outcomeSize)
+			p.blockResponse(w, req, "Response too small", http.StatusBadRequest)
+			return
+		}
+	}
+
 	h := w.Header()
 	p.copyHeaders(&h, &resp.Header, &ValidRespHeaders)
+	normalizeRespHeaders(h)
 	// set content type based on parsed content type, not originally supplied
 	h.Set("content-type", responseContentType)
+	// never let browsers sniff proxied content into something executable
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	// features that make the response depend on request headers should add
+	// them here, so the Vary header is set once.
+	var vary varyHeader
+	vary.AddUpstream(resp.Header["Vary"], p.forwardedReqHeader)
+	p.varyAcceptLanguage(&vary)
+	// referer pinned responses must not be served from shared caches to
+	// other referers
+	if refererHost != "" {
+		vary.Add("Referer")
+	}
+	// whether the response is served depends on the accept header
+	if p.config.RequireAcceptImage {
+		vary.Add("Accept")
+	}
+	vary.Set(h)
+
+	if p.config.TimingAllowOrigin != "" {
+		h.Set("Timing-Allow-Origin", p.config.TimingAllowOrigin)
+	}
+	if p.config.CORP != "" {
+		h.Set("Cross-Origin-Resource-Policy", p.config.CORP)
+	}
+	if p.acceptCH != "" {
+		h.Set("Accept-CH", p.acceptCH)
+	}
+	if p.config.RewriteLinkHeader {
+		base := resp.Request.URL
+		if p.config.ParentCamoURL != "" {
+			base = u
+		}
+		if links := p.rewriteLinks(resp.Header["Link"], base); len(links) > 0 {
+			h["Link"] = links
+		}
+	}
+	if p.config.ClientWriteTimeout > 0 {
+		if err := setWriteDeadline(w, req, time.Now().Add(p.config.ClientWriteTimeout)); err == nil {
+			// the server does not reset write deadlines for keep-alive
+			// requests, unless it has a WriteTimeout itself
+			defer setWriteDeadline(w, req, time.Time{}) // #nosec G104
+		} else if mlog.HasDebug() {
+			mlog.Debugm("could not set client write deadline", mlog.Map{"err": err})
+		}
+	}
+	p.setOutcome(w, outcomeServed)
 	w.WriteHeader(resp.StatusCode)
 
 	// get a []byte from bufpool, and put it back on defer
-	buf := *bufPool.Get().(*[]byte)
-	defer bufPool.Put(&buf)
+	buf := *p.bufPool.Get().(*[]byte)
+	defer p.bufPool.Put(&buf)
 
 	// wrap body in limit reader, so even while chunk/streaming, we read
 	// less than desired max size
-	var bodyRC io.ReadCloser = resp.Body
 	if p.config.MaxSize > 0 {
-		bodyRC = NewLimitReadCloser(resp.Body, p.config.MaxSize)
+		bodyRC = NewLimitReadCloser(bodyRC, p.config.MaxSize)
+	}
+
+	// flush each write of live streams, instead of waiting for the response
+	// buffer to fill.
+	var dst io.Writer = w
+	if responseMediaType == mjpegMediaType {
+		if f, ok := w.(http.Flusher); ok {
+			dst = &flushWriter{w: w, f: f}
+		}
 	}
 
 	// since this uses io.Copy/CopyBuffer from the respBody, it is streaming
 	// from the request to the response. This means it will nearly
 	// always end up with a chunked response.
-	written, err := io.CopyBuffer(w, bodyRC, buf)
+	written, err := io.CopyBuffer(dst, bodyRC, buf)
+	atomic.AddUint64(&p.stats.bytesSent, uint64(written))
+	if clientKey != "" {
+		p.bandwidth.add(clientKey, written)
+	}
 	if err != nil {
 		if p.config.CollectMetrics {
 			responseFailed.Inc()
 		}
+		// upstream request cancelled, but client request still live.
+		if ctx.Err() != nil && req.Context().Err() == nil {
+			if mlog.HasDebug() {
+				mlog.Debugm("body timeout exceeded", mlog.Map{"req": req})
+			}
+			return
+		}
 		if err == context.Canceled || errors.Is(err, context.Canceled) {
 			// client aborted/closed request, which is why copy failed to finish
 			if mlog.HasDebug() {
@@ -352,6 +1381,13 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if mlog.HasDebug() {
+				mlog.Debugm("client write timeout exceeded", mlog.Map{"req": req})
+			}
+			return
+		}
+
 		// only log broken pipe errors at debug level
 		if isBrokenPipe(err) {
 			if mlog.HasDebug() {
@@ -380,48 +1416,477 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (p *Proxy) checkURL(reqURL *url.URL) error {
-	// ensure we have an http or https url
-	// (eg. no file:// or other)
-	scheme := reqURL.Scheme
-	if !(scheme == "http" || scheme == "https") {
-		return errors.New("Bad url scheme")
-	}
+// earlyHintsHop tracks the url of the upstream hop currently being fetched,
+// so relative early hint targets resolve against the hop that sent them.
+type earlyHintsHop struct {
+	mu   sync.Mutex
+	base *url.URL
+	cur  *url.URL
+}
 
-	// reject localhost urls
-	// lower case for matching is done by CheckHostname, so no need to
-	// ToLower here also
-	uHostname := reqURL.Hostname()
-	if uHostname == "" || localsFilter.CheckHostname(uHostname) {
-		return errors.New("Bad url host")
-	}
+type earlyHintsHopKey struct{}
 
-	// if not allowed, reject credentialed/userinfo urls
-	if !p.config.AllowCredetialURLs && reqURL.User != nil {
-		return errors.New("Userinfo URL rejected")
-	}
+// withEarlyHintsHop returns a context that tracks the current hop of the
+// upstream fetch made with it, starting at base.
+func withEarlyHintsHop(ctx context.Context, base *url.URL) (context.Context, *earlyHintsHop) {
+	hop := &earlyHintsHop{base: base, cur: base}
+	return context.WithValue(ctx, earlyHintsHopKey{}, hop), hop
+}
 
-	// evaluate filters. first false value "fails"
-	for i := 0; i < p.filtersLen; i++ {
-		if !p.filters[i](reqURL) {
-			return errors.New("Rejected due to filter-ruleset")
-		}
+// recordEarlyHintsHop records following a redirect to u, for a fetch made
+// with a context from withEarlyHintsHop. A nil u resets the hop to the base
+// url, as when a fetch is retried.
+func recordEarlyHintsHop(ctx context.Context, u *url.URL) {
+	hop, ok := ctx.Value(earlyHintsHopKey{}).(*earlyHintsHop)
+	if !ok {
+		return
+	}
+	hop.mu.Lock()
+	defer hop.mu.Unlock()
+	if u == nil {
+		u = hop.base
 	}
+	hop.cur = u
+}
 
-	return nil
+func (hop *earlyHintsHop) url() *url.URL {
+	hop.mu.Lock()
+	defer hop.mu.Unlock()
+	return hop.cur
 }
 
-// copy headers from src into dst
-// empty filter map will result in no filtering being done
-func (p *Proxy) copyHeaders(dst, src *http.Header, filter *map[string]bool) {
-	f := *filter
-	filtering := false
-	if len(f) > 0 {
-		filtering = true
-	}
+// earlyHintsTrace returns a ClientTrace that relays the Link headers of
+// upstream 103 Early Hints responses to the client. Hints are only relayed
+// when RewriteLinkHeader is enabled, with relative link targets resolved
+// against the current hop.
+func (p *Proxy) earlyHintsTrace(w http.ResponseWriter, hop *earlyHintsHop) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			// hints are relayed before the response is checked, so must be
+			// rewritten to go through the proxy. without link rewriting,
+			// they are dropped.
+			if code != http.StatusEarlyHints || !p.config.RewriteLinkHeader {
+				return nil
+			}
+			links := p.rewriteLinks(header["Link"], hop.url())
+			if len(links) == 0 {
+				return nil
+			}
 
-	for k, vv := range *src {
-		if x, ok := f[k]; filtering && (!ok || !x) {
+			if mlog.HasDebug() {
+				mlog.Debugm("relaying early hints", mlog.Map{"links": links})
+			}
+
+			// the interim response is sent with the headers present at the
+			// time, so add the links, write, and then restore any previous
+			// values so the hints do not leak into the final response.
+			h := w.Header()
+			prev := h["Link"]
+			h["Link"] = append(append([]string(nil), prev...), links...)
+			w.WriteHeader(http.StatusEarlyHints)
+			if prev == nil {
+				h.Del("Link")
+			} else {
+				h["Link"] = prev
+			}
+			return nil
+		},
+	}
+}
+
+// upstreamFailed responds with an upstream failure, and records it in the
+// negative cache (if enabled).
+func (p *Proxy) upstreamFailed(w http.ResponseWriter, req *http.Request, u *url.URL, msg string, code int) {
+	if p.negativeCache != nil {
+		p.negativeCache.add(cacheKey(u), code, msg)
+	}
+	p.setOutcome(w, outcomeUpstream)
+	p.httpError(w, req, msg, code)
+}
+
+// varyAcceptLanguage adds Accept-Language to vary when a default
+// Accept-Language is configured, and client values are forwarded. The
+// upstream request then depends on whether the client sent one.
+func (p *Proxy) varyAcceptLanguage(vary *varyHeader) {
+	if p.config.DefaultAcceptLanguage != "" && p.forwardedReqHeader("Accept-Language") {
+		vary.Add("Accept-Language")
+	}
+}
+
+// relayEmptyResponse relays an upstream response without a content type or a
+// body, as an empty 200.
+func (p *Proxy) relayEmptyResponse(w http.ResponseWriter, resp *http.Response) {
+	h := w.Header()
+	p.copyHeaders(&h, &resp.Header, &ValidRespHeaders)
+	normalizeRespHeaders(h)
+	h.Del("Content-Type")
+	h.Set("Content-Length", "0")
+	h.Set("X-Content-Type-Options", "nosniff")
+	p.setOutcome(w, outcomeServed)
+	w.WriteHeader(http.StatusOK)
+}
+
+// reportOnlyCSP moves a Content-Security-Policy header to
+// Content-Security-Policy-Report-Only, adding the configured report-uri.
+func (p *Proxy) reportOnlyCSP(h http.Header) {
+	csp := h.Get("Content-Security-Policy")
+	if csp == "" {
+		return
+	}
+	h.Del("Content-Security-Policy")
+	if p.config.ResponseCSPReportURI != "" {
+		csp = strings.TrimRight(csp, "; ") + "; report-uri " + p.config.ResponseCSPReportURI
+	}
+	h.Set("Content-Security-Policy-Report-Only", csp)
+}
+
+// refererAllowed reports whether the Referer of req is on host.
+func refererAllowed(req *http.Request, host string) bool {
+	ref, err := url.Parse(req.Referer())
+	if err != nil || ref.Host == "" {
+		return false
+	}
+	return normalizeHost(ref.Hostname()) == normalizeHost(host)
+}
+
+// blockedHost returns the lower cased host of the request that failed with
+// err, which may be a redirect target rather than u.
+func blockedHost(err error, u *url.URL) string {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		if eu, perr := url.Parse(uerr.URL); perr == nil && eu.Host != "" {
+			return strings.ToLower(eu.Hostname())
+		}
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// SetMaintenance enables or disables maintenance (drain) mode. While enabled,
+// all requests are answered with a 503 and a Retry-After header, without
+// fetching.
+func (p *Proxy) SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&p.maintenance, v)
+}
+
+// InMaintenance reports whether maintenance mode is enabled.
+func (p *Proxy) InMaintenance() bool {
+	return atomic.LoadInt32(&p.maintenance) == 1
+}
+
+// httpError replies to the request with the error message and code. If
+// JSON errors are enabled, clients accepting json get a json object with
+// `error` (the status text) and `reason` (the message) fields, instead of
+// a plain text body.
+func (p *Proxy) httpError(w http.ResponseWriter, req *http.Request, msg string, code int) {
+	p.setOutcome(w, outcomeError)
+	if !p.config.JSONErrors {
+		http.Error(w, msg, code)
+		return
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Accept")
+	if !acceptsJSON(req.Header.Get("Accept")) {
+		http.Error(w, msg, code)
+		return
+	}
+
+	body, err := json.Marshal(jsonError{
+		Error:  http.StatusText(code),
+		Reason: msg,
+		Code:   h.Get("X-Camo-Reason"),
+	})
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(append(body, '\n')) // #nosec G104 -- client write errors are not actionable
+}
+
+// rejectContentType replies to a response with a content type that is not
+// allowed (or is malformed). All such responses are rejected identically,
+// with a 400 and the reasonContentTypeNotAllowed reason code.
+func (p *Proxy) rejectContentType(w http.ResponseWriter, req *http.Request, contentTypes []string) {
+	if p.config.CollectMetrics {
+		contentTypeRejected.WithLabelValues(rejectReasonUnsupported).Inc()
+	}
+	if mlog.HasDebug() {
+		mlog.Debugm("Unsupported content-type returned", mlog.Map{"type": contentTypes})
+	}
+	if !p.config.StealthBlocks {
+		w.Header().Set("X-Camo-Reason", reasonContentTypeNotAllowed)
+	}
+	p.setOutcome(w, outcomeContentType)
+	p.blockResponse(w, req, "Unsupported content-type returned", http.StatusBadRequest)
+}
+
+// serveSelfTest replies with the built-in self test image.
+func (p *Proxy) serveSelfTest(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Content-Type", "image/png")
+	h.Set("Content-Length", strconv.Itoa(len(selfTestImage)))
+	h.Set("Cache-Control", "no-cache")
+	p.setOutcome(w, outcomeServed)
+	w.WriteHeader(http.StatusOK)
+	w.Write(selfTestImage) // #nosec G104 -- client write errors are not actionable
+}
+
+// blockResponse replies to the request with the block message and code,
+// or with a uniform transparent pixel if stealth blocks are enabled.
+func (p *Proxy) blockResponse(w http.ResponseWriter, req *http.Request, msg string, code int) {
+	p.stats.block(msg)
+	// blocks after the fetch (eg. a rejected redirect or content type) do
+	// not reveal the origin either
+	w.Header().Del("X-Camo-Origin")
+
+	if p.config.BlockResponseJitter > 0 {
+		// #nosec G404 -- jitter does not require a cryptographic rng
+		delay := time.Duration(rand.Int63n(int64(p.config.BlockResponseJitter)))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return
+		}
+	}
+
+	if !p.config.StealthBlocks {
+		p.setOutcome(w, outcomeBlocked)
+		p.httpError(w, req, msg, code)
+		return
+	}
+
+	h := w.Header()
+	// the outcome would reveal the block
+	h.Del("X-Camo-Outcome")
+	h.Set("Content-Type", "image/gif")
+	h.Set("Content-Length", strconv.Itoa(len(stealthPixel)))
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write(stealthPixel) // #nosec G104 -- client write errors are not actionable
+}
+
+// legalBlockResponse responds to a url blocked for legal reasons. Unlike
+// other blocks, it is never disguised (see Config.StealthBlocks), as the
+// point of a 451 is to be transparent about the block.
+func (p *Proxy) legalBlockResponse(w http.ResponseWriter, req *http.Request) {
+	p.stats.block(errLegalBlock.Error())
+	w.Header().Del("X-Camo-Origin")
+	p.setOutcome(w, outcomeLegal)
+	p.httpError(w, req, p.config.LegalBlockNotice, http.StatusUnavailableForLegalReasons)
+}
+
+func (p *Proxy) checkURL(reqURL *url.URL) error {
+	// ensure we have an http or https url
+	// (eg. no file:// or other)
+	scheme := reqURL.Scheme
+	if !(scheme == "http" || scheme == "https") {
+		return errors.New("Bad url scheme")
+	}
+
+	// reject localhost urls
+	// lower case for matching is done by CheckHostname, so no need to
+	// ToLower here also
+	uHostname := reqURL.Hostname()
+	if uHostname == "" || localsFilter.CheckHostname(uHostname) {
+		return errBadURLHost
+	}
+
+	// explicitly reject (and log) cloud metadata addresses
+	if ip := net.ParseIP(uHostname); ip != nil && isMetadataIP(ip) {
+		logMetadataBlock(ip, reqURL.String(), p.config.CollectMetrics)
+		return errBadURLHost
+	}
+
+	// if not allowed, reject credentialed/userinfo urls
+	if !p.config.AllowCredetialURLs && reqURL.User != nil {
+		return errors.New("Userinfo URL rejected")
+	}
+
+	// if configured, reject urls with query strings
+	if p.config.DisallowQueryStrings && reqURL.RawQuery != "" {
+		return errors.New("Query string rejected")
+	}
+
+	remote, _ := p.remoteRules.Load().(*Ruleset)
+
+	// legal blocks take precedence over allow filters
+	if p.legalFilter != nil && p.legalFilter(reqURL) {
+		return errLegalBlock
+	}
+	if p.fileRules != nil && p.fileRules.Legal != nil && p.fileRules.Legal(reqURL) {
+		return errLegalBlock
+	}
+	if remote != nil && remote.Legal != nil && remote.Legal(reqURL) {
+		return errLegalBlock
+	}
+
+	// evaluate filters. first false value "fails"
+	for i := 0; i < p.filtersLen; i++ {
+		if !p.filters[i](reqURL) {
+			return errFilterRejected
+		}
+	}
+
+	if p.fileRules != nil {
+		for _, filter := range p.fileRules.Filters {
+			if !filter(reqURL) {
+				return errFilterRejected
+			}
+		}
+	}
+
+	if remote != nil {
+		for _, filter := range remote.Filters {
+			if !filter(reqURL) {
+				return errFilterRejected
+			}
+		}
+	}
+
+	return nil
+}
+
+// logMetadataBlock logs (and optionally counts) a blocked attempt to reach a
+// cloud metadata address.
+func logMetadataBlock(ip net.IP, target string, collectMetrics bool) {
+	if collectMetrics {
+		metadataBlocked.Inc()
+	}
+	mlog.Printm("blocked request to cloud metadata address", mlog.Map{"ip": ip.String(), "target": target})
+}
+
+// signedURL returns a camo url (path and query, under PathPrefix) for oURL,
+// signed with the primary key, that this proxy accepts: a query string url
+// with QueryStringURLs, and otherwise a path signed per HMACMessage.
+func (p *Proxy) signedURL(oURL string) string {
+	if p.config.QueryStringURLs {
+		return p.config.PathPrefix + "/?url=" + url.QueryEscape(oURL) +
+			"&digest=" + encoding.HexDigest(p.hmacKeys[0], oURL)
+	}
+	return p.config.PathPrefix + encoding.B64EncodeURLFormat(
+		encoding.MessageFormat(p.config.HMACMessage), p.hmacKeys[0], oURL,
+	)
+}
+
+// keyFingerprint returns a short identifier for an hmac key, suitable for
+// use in metrics and logs without exposing the key itself.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// decodeHMACKey decodes key according to encoding (see
+// Config.HMACKeyEncoding).
+func decodeHMACKey(key []byte, encoding string) ([]byte, error) {
+	var (
+		decoded []byte
+		err     error
+	)
+	switch encoding {
+	case "", "raw":
+		return key, nil
+	case "hex":
+		decoded, err = hex.DecodeString(strings.TrimSpace(string(key)))
+	case "base64":
+		decoded, err = base64.RawStdEncoding.DecodeString(
+			strings.TrimRight(strings.TrimSpace(string(key)), "="),
+		)
+	default:
+		return nil, fmt.Errorf("unknown hmac key encoding: %s", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s encoded hmac key: %w", encoding, err)
+	}
+	if len(decoded) == 0 && len(key) > 0 {
+		return nil, fmt.Errorf("invalid %s encoded hmac key: empty key", encoding)
+	}
+	return decoded, nil
+}
+
+// validContentTypePattern returns true if pattern is a media type (eg.
+// `image/png`), or a media type category (eg. `image/*`).
+func validContentTypePattern(pattern string) bool {
+	parts := strings.Split(pattern, "/")
+	return len(parts) == 2 && parts[0] != "" && parts[0] != "*" && parts[1] != ""
+}
+
+// matchContentTypePattern returns true if mediatype matches pattern (see
+// validContentTypePattern).
+func matchContentTypePattern(pattern, mediatype string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediatype, strings.TrimSuffix(pattern, "*"))
+	}
+	return mediatype == pattern
+}
+
+// checkExtension returns true if the url path has an allowed file extension,
+// or if no extension list is configured.
+func (p *Proxy) checkExtension(reqURL *url.URL) bool {
+	if p.allowedExts == nil {
+		return true
+	}
+	// url.Path excludes the query string and fragment
+	ext := strings.ToLower(path.Ext(reqURL.Path))
+	return ext != "" && p.allowedExts[ext]
+}
+
+// checkHost returns true if the request host (which may include a port) is
+// allowed, or if no host list is configured.
+func (p *Proxy) checkHost(host string) bool {
+	if p.allowedHosts == nil {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return p.allowedHosts[normalizeHost(host)]
+}
+
+// normalizeHost lower cases a hostname (without port), and strips ipv6
+// brackets and a trailing dot, for matching against a host list.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+// parseHostList converts a list of hostnames (without port) into a set of
+// normalized hosts. Returns nil for an empty list.
+func parseHostList(hosts []string, kind string) (map[string]bool, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	set := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		host = normalizeHost(strings.TrimSpace(host))
+		if host == "" || strings.ContainsAny(host, ":/") && net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid %s host: %q", kind, host)
+		}
+		set[host] = true
+	}
+	return set, nil
+}
+
+// copy headers from src into dst
+// empty filter map will result in no filtering being done
+func (p *Proxy) copyHeaders(dst, src *http.Header, filter *map[string]bool) {
+	f := *filter
+	filtering := false
+	if len(f) > 0 {
+		filtering = true
+	}
+
+	for k, vv := range *src {
+		if x, ok := f[k]; filtering && (!ok || !x) {
 			continue
 		}
 		for _, v := range vv {
@@ -434,103 +1899,194 @@ func (p *Proxy) copyHeaders(dst, src *http.Header, filter *map[string]bool) {
 // filters are evaluated in order, and the first false response from a filter
 // function halts further evaluation and fails the request.
 func NewWithFilters(pc Config, filters []FilterFunc) (*Proxy, error) {
+	return NewWithRuleset(pc, &Ruleset{Filters: filters})
+}
+
+// NewWithRuleset returns a new Proxy that utilises the passed in ruleset
+// (eg. from ParseFilterRules). A nil ruleset is equivalent to New.
+func NewWithRuleset(pc Config, rs *Ruleset) (*Proxy, error) {
 	proxy, err := New(pc)
 	if err != nil {
 		return nil, err
 	}
+	if rs == nil {
+		return proxy, nil
+	}
 
 	filterFuncs := make([]FilterFunc, 0)
 	// check for nil entries, and copy the slice in case the original
 	// is mutated.
-	for _, filter := range filters {
+	for _, filter := range rs.Filters {
 		if filter != nil {
 			filterFuncs = append(filterFuncs, filter)
 		}
 	}
 	proxy.filters = filterFuncs
 	proxy.filtersLen = len(filterFuncs)
+	proxy.legalFilter = rs.Legal
 	return proxy, nil
 }
 
 // New returns a new Proxy. Returns an error if Proxy could not be constructed.
 func New(pc Config) (*Proxy, error) {
-	doFiltering := !pc.noIPFiltering
-
-	dailer := &net.Dialer{
-		Timeout:   3 * time.Second,
-		KeepAlive: 30 * time.Second,
-		// Move ip filtering to dial.control, this avoids cases where
-		// an adversary may return an unblocked ip on name resolution
-		// the first time, and a blocked ip the second time.
-		// if the server's resolver has no caching, or hits an unlucky ttl expiry,
-		// an ip check in checkURL may pass (unblocked ip), then the bad ip may
-		// be connected to (re-resolve in dailer).
-		// Moving the ip filtering here avoids that.
-		Control: func(network string, address string, conn syscall.RawConn) error {
-			// reject not tcp/tcp6 connection attempts
-			if !(network == "tcp4" || network == "tcp6") {
-				return fmt.Errorf("%s is not a safe network type: %w", network, ErrInvalidNetType)
-			}
-
-			// ip/allow-list/deny-list filtering
-			if doFiltering {
-				host, _, err := net.SplitHostPort(address)
-				if err != nil {
-					return fmt.Errorf("%s:%s is not a valid host/port pair: %w", address, err, ErrInvalidHostPort)
-				}
+	hmacKey, err := decodeHMACKey(pc.HMACKey, pc.HMACKeyEncoding)
+	if err != nil {
+		return nil, err
+	}
+	fallbackKeys := make([][]byte, 0, len(pc.FallbackHMACKeys))
+	for _, key := range pc.FallbackHMACKeys {
+		key, err = decodeHMACKey(key, pc.HMACKeyEncoding)
+		if err != nil {
+			return nil, err
+		}
+		fallbackKeys = append(fallbackKeys, key)
+	}
+	pc.HMACKey = hmacKey
+	pc.FallbackHMACKeys = fallbackKeys
 
-				// filter out rejected networks
-				if ip := net.ParseIP(host); ip != nil {
-					if isRejectedIP(ip) {
-						return ErrRejectIP
-					}
-				} else {
-					if ips, err := net.LookupIP(host); err == nil {
-						for _, ip := range ips {
-							if isRejectedIP(ip) {
-								return ErrRejectIP
-							}
-						}
-					}
-				}
+	if pc.HMACMessage == "" {
+		pc.HMACMessage = string(encoding.MessageURL)
+	}
+	if !encoding.ValidMessageFormat(encoding.MessageFormat(pc.HMACMessage)) {
+		return nil, fmt.Errorf("invalid hmac message format: %q", pc.HMACMessage)
+	}
+
+	if pc.MinKeyLength > 0 && !pc.InsecureNoAuth {
+		for _, key := range append([][]byte{pc.HMACKey}, pc.FallbackHMACKeys...) {
+			if len(key) < pc.MinKeyLength {
+				return nil, fmt.Errorf(
+					"hmac key too short: %d bytes, minimum %d", len(key), pc.MinKeyLength,
+				)
 			}
-			return nil
-		},
+		}
 	}
 
-	tr := &http.Transport{
-		DialContext: dailer.DialContext,
+	if pc.InsecureNoAuth {
+		if len(pc.HMACKey) > 0 || len(pc.FallbackHMACKeys) > 0 {
+			return nil, errors.New("insecure no auth mode can not be used with an hmac key")
+		}
+		if pc.CollectMetrics {
+			return nil, errors.New("insecure no auth mode can not be used with metrics collection")
+		}
+		mlog.Printf("WARNING! Insecure no auth mode enabled. Unsigned urls are accepted. NEVER use this in production!")
+	}
 
-		// Use proxy from environment
-		// It uses HTTP proxies as directed by the $HTTP_PROXY and $NO_PROXY
-		// (or $http_proxy and $no_poxy) environment variables.
-		//
-		// Also Note: This is invoked as a once.Do deep in go http client, and
-		// reified, to avoid constant overhead. Nice.
-		Proxy: http.ProxyFromEnvironment,
+	if pc.BlockResponseJitter > MaxBlockResponseJitter {
+		pc.BlockResponseJitter = MaxBlockResponseJitter
+	}
+
+	if pc.CopyBufferSize == 0 {
+		pc.CopyBufferSize = DefaultCopyBufferSize
+	}
+	if pc.CopyBufferSize < MinCopyBufferSize || pc.CopyBufferSize > MaxCopyBufferSize {
+		return nil, fmt.Errorf(
+			"copy buffer size %d out of range [%d, %d]",
+			pc.CopyBufferSize, MinCopyBufferSize, MaxCopyBufferSize,
+		)
+	}
+
+	if pc.HTMLResponseStatus == 0 {
+		pc.HTMLResponseStatus = http.StatusBadRequest
+	}
+	if pc.HTMLResponseStatus < 400 || pc.HTMLResponseStatus > 599 {
+		return nil, fmt.Errorf("html response status %d is not an error status", pc.HTMLResponseStatus)
+	}
+
+	pc.PathPrefix = strings.TrimRight(pc.PathPrefix, "/")
+	if pc.PathPrefix != "" && !strings.HasPrefix(pc.PathPrefix, "/") {
+		return nil, fmt.Errorf("path prefix must start with /: %s", pc.PathPrefix)
+	}
+
+	if pc.SelfTestImagePath != "" && !strings.HasPrefix(pc.SelfTestImagePath, "/") {
+		return nil, fmt.Errorf("self test image path must start with /: %s", pc.SelfTestImagePath)
+	}
+
+	if pc.LegalBlockNotice == "" {
+		pc.LegalBlockNotice = errLegalBlock.Error()
+	}
+
+	if pc.TooManyRedirectsStatus == 0 {
+		pc.TooManyRedirectsStatus = http.StatusNotFound
+	}
+	if pc.TooManyRedirectsStatus < 400 || pc.TooManyRedirectsStatus > 599 {
+		return nil, fmt.Errorf("too many redirects status %d is not an error status", pc.TooManyRedirectsStatus)
+	}
 
-		// max idle conns. Go DetaultTransport uses 100, which seems like a
-		// fairly reasonable number. Very busy servers may wish to raise
-		// or lower this value.
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 8,
+	if !httpguts.ValidHeaderFieldValue(pc.DefaultAcceptLanguage) {
+		return nil, fmt.Errorf("invalid default accept-language: %q", pc.DefaultAcceptLanguage)
+	}
 
-		// more defaults from DefaultTransport, with a few tweaks
-		IdleConnTimeout:       30 * time.Second,
-		TLSHandshakeTimeout:   3 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+	switch pc.EmptyResponseMode {
+	case "", "reject", "strict", "empty":
+	default:
+		return nil, fmt.Errorf("invalid empty response mode: %q", pc.EmptyResponseMode)
+	}
 
-		DisableKeepAlives: pc.DisableKeepAlivesBE,
-		// no need for compression with images
-		// some xml/svg can be compressed, but apparently some clients can
-		// exhibit weird behavior when those are compressed
-		DisableCompression: true,
+	switch pc.CORP {
+	case "", "same-site", "same-origin", "cross-origin":
+	default:
+		return nil, fmt.Errorf("invalid cross-origin-resource-policy: %q", pc.CORP)
 	}
 
+	if pc.MinResponseBytes < 0 || pc.MinResponseBytes > maxMinResponseBytes {
+		return nil, fmt.Errorf("min response bytes %d not in range 0-%d", pc.MinResponseBytes, maxMinResponseBytes)
+	}
+
+	if pc.MaxHostChanges < 0 {
+		return nil, fmt.Errorf("invalid max host changes: %d", pc.MaxHostChanges)
+	}
+
+	if pc.MaxRedirectBodySize < 0 {
+		return nil, fmt.Errorf("invalid max redirect body size: %d", pc.MaxRedirectBodySize)
+	}
+	if pc.RedirectBodyTimeout < 0 {
+		return nil, fmt.Errorf("invalid redirect body timeout: %s", pc.RedirectBodyTimeout)
+	}
+
+	if pc.MaxConcurrentPerURL < 0 {
+		return nil, fmt.Errorf("invalid max concurrent requests per url: %d", pc.MaxConcurrentPerURL)
+	}
+
+	if pc.ClientBandwidthLimit < 0 {
+		return nil, fmt.Errorf("invalid client bandwidth limit: %d", pc.ClientBandwidthLimit)
+	}
+	if pc.ClientBandwidthWindow < 0 {
+		return nil, fmt.Errorf("invalid client bandwidth window: %s", pc.ClientBandwidthWindow)
+	}
+
+	if pc.SuspiciousHeaderThreshold < 0 {
+		return nil, fmt.Errorf("invalid suspicious header threshold: %d", pc.SuspiciousHeaderThreshold)
+	}
+
+	if pc.ResponseCSPReportURI != "" {
+		if !pc.ResponseCSPReportOnly {
+			return nil, errors.New("csp report uri requires csp report only")
+		}
+		if _, err := url.Parse(pc.ResponseCSPReportURI); err != nil ||
+			strings.ContainsAny(pc.ResponseCSPReportURI, ";, ") ||
+			!httpguts.ValidHeaderFieldValue(pc.ResponseCSPReportURI) {
+			return nil, fmt.Errorf("invalid csp report uri: %q", pc.ResponseCSPReportURI)
+		}
+	}
+
+	transport, tr, hl, err := newUpstreamTransport(pc)
+	if err != nil {
+		return nil, err
+	}
+
+	// the request (and category) timeouts are applied as deadlines per
+	// request, so the client itself has no timeout.
 	client := &http.Client{
-		Transport: tr,
-		// timeout
-		Timeout: pc.RequestTimeout,
+		Transport: transport,
+	}
+
+	hostTimeouts, err := parseHostTimeouts(pc.PerHostTimeouts)
+	if err != nil {
+		return nil, err
+	}
+	categoryTimeouts, err := parseCategoryTimeouts(pc.CategoryTimeouts)
+	if err != nil {
+		return nil, err
 	}
 
 	acceptTypes := []string{"image/*"}
@@ -541,6 +2097,9 @@ func New(pc Config) (*Proxy, error) {
 	if pc.AllowContentAudio {
 		acceptTypes = append(acceptTypes, "audio/*")
 	}
+	if pc.AllowMJPEG {
+		acceptTypes = append(acceptTypes, mjpegMediaType)
+	}
 
 	// re-use the htrie glob path checker for accept types validation
 	acceptTypesFilter := htrie.NewGlobPathChecker()
@@ -551,11 +2110,178 @@ func New(pc Config) (*Proxy, error) {
 		}
 	}
 
+	acceptTypesString := strings.Join(acceptTypes, ", ")
+	if pc.DefaultAcceptHeader != "" {
+		acceptTypesString = pc.DefaultAcceptHeader
+	}
+
 	p := &Proxy{
-		client:            client,
 		config:            &pc,
-		acceptTypesString: strings.Join(acceptTypes, ", "),
+		acceptTypesString: acceptTypesString,
 		acceptTypesFilter: acceptTypesFilter,
+		acceptTypes:       acceptTypes,
+		bufPool:           newBufferPool(pc.CopyBufferSize),
+
+		checkDecompression: pc.MaxDecompressRatio > 0 || pc.MaxDecompressedSize > 0,
+		hostTimeouts:       hostTimeouts,
+		categoryTimeouts:   categoryTimeouts,
+		maxCategoryTimeout: maxTimeout(categoryTimeouts),
+		stats:              &proxyStats{},
+	}
+
+	up := &upstream{client: client, tr: tr}
+
+	viaID, err := newViaID()
+	if err != nil {
+		return nil, err
+	}
+	p.via = pc.ServerName + " (" + viaID + ")"
+
+	p.hmacKeys = append([][]byte{pc.HMACKey}, pc.FallbackHMACKeys...)
+	p.keyIDs = make([]string, len(p.hmacKeys))
+	for i, key := range p.hmacKeys {
+		p.keyIDs[i] = keyFingerprint(key)
+	}
+
+	if len(pc.AllowedExtensions) > 0 {
+		p.allowedExts = make(map[string]bool, len(pc.AllowedExtensions))
+		for _, ext := range pc.AllowedExtensions {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext == "" || ext == "." {
+				return nil, fmt.Errorf("invalid allowed extension: %q", ext)
+			}
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			p.allowedExts[ext] = true
+		}
+	}
+
+	p.allowedHosts, err = parseHostList(pc.AllowedHosts, "allowed")
+	if err != nil {
+		return nil, err
+	}
+	p.selfHosts, err = parseHostList(pc.SelfHosts, "self")
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range pc.AddHeaders {
+		if !httpguts.ValidHeaderFieldName(k) || !httpguts.ValidHeaderFieldValue(v) {
+			return nil, fmt.Errorf("invalid header: %q: %q", k, v)
+		}
+		if p.addHeaders == nil {
+			p.addHeaders = make(map[string]string, len(pc.AddHeaders))
+		}
+		p.addHeaders[http.CanonicalHeaderKey(k)] = v
+	}
+
+	hints := make([]string, 0, len(pc.AcceptCH))
+	for _, hint := range pc.AcceptCH {
+		hint = strings.TrimSpace(hint)
+		if !httpguts.ValidHeaderFieldName(hint) {
+			return nil, fmt.Errorf("invalid client hint: %q", hint)
+		}
+		if p.clientHints == nil {
+			p.clientHints = make(map[string]bool, len(pc.AcceptCH))
+		}
+		// advertised as configured (eg. DPR, not Dpr)
+		if name := http.CanonicalHeaderKey(hint); !p.clientHints[name] {
+			p.clientHints[name] = true
+			hints = append(hints, hint)
+		}
+	}
+	p.acceptCH = strings.Join(hints, ", ")
+
+	p.reqHeaders, err = buildReqHeaders(pc, p.clientHints)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range pc.ContentTypeParams {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("invalid content type param: %q", name)
+		}
+		if p.contentTypeParams == nil {
+			p.contentTypeParams = make(map[string]bool, len(pc.ContentTypeParams))
+		}
+		p.contentTypeParams[name] = true
+	}
+
+	if pc.StartInMaintenance {
+		p.SetMaintenance(true)
+	}
+
+	if pc.NegativeCacheTTL > 0 {
+		p.negativeCache = newNegativeCache(pc.NegativeCacheTTL)
+	}
+
+	if pc.BlockCacheTTL > 0 {
+		ttl := pc.BlockCacheTTL
+		if ttl > MaxBlockCacheTTL {
+			ttl = MaxBlockCacheTTL
+		}
+		p.blockCache = newNegativeCache(ttl)
+	}
+
+	if pc.MaxDistinctHostsInFlight > 0 {
+		p.hostLimiter = newHostLimiter(pc.MaxDistinctHostsInFlight)
+	}
+
+	if pc.MaxConcurrentPerURL > 0 {
+		p.urlLimiter = newURLLimiter(pc.MaxConcurrentPerURL)
+	}
+
+	if pc.ClientBandwidthLimit > 0 {
+		window := pc.ClientBandwidthWindow
+		if window == 0 {
+			window = DefaultClientBandwidthWindow
+		}
+		p.bandwidth = newBandwidthLimiter(pc.ClientBandwidthLimit, window)
+	}
+
+	p.trustedProxies, err = parseTrustedProxies(pc.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc.ParentCamoURL != "" {
+		key, err := decodeHMACKey(pc.ParentCamoKey, pc.HMACKeyEncoding)
+		if err != nil {
+			return nil, err
+		}
+		up.parent, err = newParentCamo(pc.ParentCamoURL, key, tr, hl, upstreamConnectTimeout(pc))
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.upstream.Store(up)
+
+	if len(pc.RulesFiles) > 0 {
+		p.fileRules, err = loadRulesFiles(pc.RulesFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if pc.RulesURL != "" {
+		rr, err := newRemoteRules(pc.RulesURL)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := rr.fetch()
+		if err != nil {
+			return nil, err
+		}
+		p.remoteRules.Store(rs)
+
+		interval := pc.RulesRefreshInterval
+		if interval <= 0 {
+			interval = DefaultRulesRefreshInterval
+		}
+		p.stop = make(chan struct{})
+		go p.refreshRules(rr, interval, p.stop)
 	}
 
 	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
@@ -563,16 +2289,42 @@ func New(pc Config) (*Proxy, error) {
 			if mlog.HasDebug() {
 				mlog.Debug("Got bad redirect: Too many redirects", mlog.Map{"url": req})
 			}
-			return fmt.Errorf("Too many redirects: %w", ErrRedirect)
+			return ErrTooManyRedirects
+		}
+		if pc.MaxHostChanges > 0 && countHostChanges(req, via) > pc.MaxHostChanges {
+			if mlog.HasDebug() {
+				mlog.Debugm("Got bad redirect: Too many host changes", mlog.Map{"url": req})
+			}
+			return ErrTooManyHostChanges
+		}
+		if p.selfHosts[normalizeHost(req.URL.Hostname())] {
+			if mlog.HasDebug() {
+				mlog.Debugm("Got bad redirect: redirect to self", mlog.Map{"url": req})
+			}
+			return ErrSelfRedirect
 		}
 		err := p.checkURL(req.URL)
+		if err == errLegalBlock {
+			if mlog.HasDebug() {
+				mlog.Debugm("Got bad redirect: legal block", mlog.Map{"url": req})
+			}
+			return fmt.Errorf("Bad redirect: %w", errLegalBlock)
+		}
 		if err != nil {
 			if mlog.HasDebug() {
 				mlog.Debugm("Got bad redirect", mlog.Map{"url": req})
 			}
 			return fmt.Errorf("Bad redirect: %w", ErrRedirect)
 		}
+		if !p.checkExtension(req.URL) {
+			if mlog.HasDebug() {
+				mlog.Debugm("Got bad redirect: extension rejected", mlog.Map{"url": req})
+			}
+			return fmt.Errorf("Bad redirect: extension rejected: %w", ErrRedirect)
+		}
 
+		recordRedirectDepth(req.Context(), len(via))
+		recordEarlyHintsHop(req.Context(), req.URL)
 		return nil
 	}
 
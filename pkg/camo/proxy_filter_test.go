@@ -5,10 +5,23 @@
 package camo
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/cactus/go-camo/pkg/camo/encoding"
+	"github.com/cactus/mlog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -100,3 +113,751 @@ func TestFilterListMatrixMultiples(t *testing.T) {
 		}
 	}
 }
+
+func TestBlockCacheSkipsResolution(t *testing.T) {
+	t.Parallel()
+
+	var hits int32
+	doh := newMockDoHServer(t, net.ParseIP("127.0.0.1"), &hits)
+	defer doh.Close()
+
+	c := camoConfig
+	c.DoHEndpoint = doh.URL
+	c.BlockCacheTTL = 200 * time.Millisecond
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+
+	fetch := func() {
+		req, err := makeReq(c, "http://camo-blocked.test/image.png")
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		assert.Equal(t, http.StatusNotFound, record.Code)
+		assert.Equal(t, "Error Fetching Resource\n", record.Body.String())
+	}
+
+	fetch()
+	resolved := atomic.LoadInt32(&hits)
+	assert.True(t, resolved > 0, "doh endpoint not queried")
+
+	// blocked again, without resolving
+	fetch()
+	assert.Equal(t, resolved, atomic.LoadInt32(&hits))
+
+	// once the ttl has passed, the host is resolved again
+	time.Sleep(300 * time.Millisecond)
+	fetch()
+	assert.True(t, atomic.LoadInt32(&hits) > resolved, "host not re-resolved after ttl")
+}
+
+func TestBlockCacheTTLClamped(t *testing.T) {
+	t.Parallel()
+
+	c := camoConfig
+	c.BlockCacheTTL = time.Hour
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+	assert.Equal(t, MaxBlockCacheTTL, camoServer.blockCache.ttl)
+}
+
+func TestAllowedExtensions(t *testing.T) {
+	t.Parallel()
+
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.AllowedExtensions = []string{"png", ".JPG"}
+
+	var tests = []struct {
+		path   string
+		status int
+	}{
+		{"/image.png", 200},
+		{"/image.PNG", 200},
+		{"/some/dir/image.jpg", 200},
+		{"/image.png?size=large", 200},
+		{"/image.gif", 404},
+		{"/image.gif?x=.png", 404},
+		{"/image", 404},
+		{"/image?fmt=png", 404},
+		{"/dir.png/image", 404},
+		{"/", 404},
+	}
+
+	for _, tt := range tests {
+		before := atomic.LoadInt32(&hits)
+		_, err := makeTestReq(ts.URL+tt.path, tt.status, c)
+		assert.Nil(t, err, tt.path)
+		if tt.status == 404 {
+			// rejected before fetching
+			assert.Equal(t, before, atomic.LoadInt32(&hits), tt.path)
+		}
+	}
+}
+
+func TestAllowedExtensionsRedirect(t *testing.T) {
+	t.Parallel()
+
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect.png":
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+		default:
+			atomic.AddInt32(&hits, 1)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("ok")) // #nosec G104
+		}
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.AllowedExtensions = []string{"png"}
+
+	var tests = []struct {
+		to     string
+		status int
+	}{
+		{"/image.png", 200},
+		{"/image.gif", 404},
+		{"/image", 404},
+	}
+
+	for _, tt := range tests {
+		before := atomic.LoadInt32(&hits)
+		_, err := makeTestReq(ts.URL+"/redirect.png?to="+tt.to, tt.status, c)
+		assert.Nil(t, err, tt.to)
+		if tt.status == 404 {
+			// the redirect target is never fetched
+			assert.Equal(t, before, atomic.LoadInt32(&hits), tt.to)
+		}
+	}
+}
+
+func TestAllowedExtensionsInvalid(t *testing.T) {
+	t.Parallel()
+
+	c := camoConfig
+	c.AllowedExtensions = []string{"png", ""}
+	_, err := New(c)
+	assert.NotNil(t, err)
+}
+
+func TestExtensionContentTypeMatch(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+
+	var tests = []struct {
+		path   string
+		status int
+		// expected content-type when relabeling
+		relabeled string
+	}{
+		{"/image.png?ct=image/png", 200, "image/png"},
+		{"/image.PNG?ct=image/png", 200, "image/png"},
+		{"/image.jpeg?ct=image/jpeg", 200, "image/jpeg"},
+		{"/image.png?ct=image/jpeg", 400, "image/png"},
+		{"/image.JPG?ct=image/gif", 400, "image/jpeg"},
+		// relabeling to a non allowed content type is still rejected
+		{"/video.mp4?ct=image/gif", 400, ""},
+		// unknown or missing extensions are not checked
+		{"/image.foo?ct=image/jpeg", 200, "image/jpeg"},
+		{"/image?ct=image/jpeg", 200, "image/jpeg"},
+	}
+
+	// not enforced by default
+	for _, tt := range tests {
+		_, err := makeTestReq(ts.URL+tt.path, 200, c)
+		assert.Nil(t, err, tt.path)
+	}
+
+	c.EnforceExtensionContentTypeMatch = true
+	for _, tt := range tests {
+		resp, err := makeTestReq(ts.URL+tt.path, tt.status, c)
+		if assert.Nil(t, err, tt.path) && tt.status == 400 {
+			bodyAssert(t, "Content-type does not match extension\n", resp)
+		}
+	}
+
+	c.RelabelExtensionContentType = true
+	for _, tt := range tests {
+		status := 200
+		if tt.relabeled == "" {
+			status = 400
+		}
+		resp, err := makeTestReq(ts.URL+tt.path, status, c)
+		if assert.Nil(t, err, tt.path) && status == 200 {
+			assert.Equal(t, tt.relabeled, resp.Header.Get("Content-Type"), tt.path)
+		}
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.AllowedHosts = []string{"img.example.com", "IMG.example.org.", "[::1]"}
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+
+	var tests = []struct {
+		host   string
+		status int
+	}{
+		{"img.example.com", 200},
+		{"IMG.EXAMPLE.COM:8080", 200},
+		{"img.example.org", 200},
+		{"img.example.com.", 200},
+		{"[::1]:8080", 200},
+		{"example.com", 421},
+		{"other.example.com:8080", 421},
+		{"", 421},
+	}
+	for _, tt := range tests {
+		req, err := makeReq(c, ts.URL+"/image.png")
+		assert.Nil(t, err)
+		req.Host = tt.host
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		assert.Equal(t, tt.status, record.Code, tt.host)
+	}
+}
+
+func TestAllowedHostsInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, host := range []string{"", "img.example.com:8080", "http://img.example.com"} {
+		c := camoConfig
+		c.AllowedHosts = []string{host}
+		_, err := New(c)
+		assert.NotNil(t, err, host)
+	}
+}
+
+func TestSelfHostRedirect(t *testing.T) {
+	t.Parallel()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.SelfHosts = []string{"Camo.Example.com"}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			// redirect to a camo url for this same origin url
+			http.Redirect(w, r, "http://camo.example.com:8080/sig/encoded", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("ok")) // #nosec G104
+		}
+	}))
+	defer ts.Close()
+
+	resp, err := makeTestReq(ts.URL+"/loop", 508, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "Redirect loop detected\n", resp)
+	}
+
+	// other redirects are followed
+	resp, err = makeTestReq(ts.URL+"/elsewhere", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "ok", resp)
+	}
+
+	c.SelfHosts = []string{"camo.example.com/x"}
+	_, err = New(c)
+	assert.NotNil(t, err)
+}
+
+func TestMaxHostChanges(t *testing.T) {
+	t.Parallel()
+
+	// /hop/n redirects n times, alternating between two hosts. /stay/n
+	// redirects n times on the same host.
+	var hosts [2]string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/")
+		n, _ := strconv.Atoi(parts[len(parts)-1])
+		if n == 0 {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("ok")) // #nosec G104
+			return
+		}
+		host := r.Host
+		if parts[1] == "hop" {
+			host = hosts[0]
+			if r.Host == hosts[0] {
+				host = hosts[1]
+			}
+		}
+		http.Redirect(w, r, fmt.Sprintf("http://%s/%s/%d", host, parts[1], n-1), http.StatusFound)
+	})
+	tsA := httptest.NewServer(handler)
+	defer tsA.Close()
+	// a second loopback address, for a different host
+	tsB := httptest.NewUnstartedServer(handler)
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("unable to listen on 127.0.0.2: %s", err)
+	}
+	tsB.Listener.Close()
+	tsB.Listener = ln
+	tsB.Start()
+	defer tsB.Close()
+	hosts[0] = tsA.Listener.Addr().String()
+	hosts[1] = tsB.Listener.Addr().String()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.MaxRedirects = 10
+	c.MaxHostChanges = 2
+
+	var tests = []struct {
+		path string
+		code int
+	}{
+		{"/hop/2", 200},
+		{"/hop/3", 404},
+		{"/hop/5", 404},
+		// same host redirects are not host changes
+		{"/stay/5", 200},
+	}
+	for _, tt := range tests {
+		_, err := makeTestReq(tsA.URL+tt.path, tt.code, c)
+		assert.Nil(t, err, tt.path)
+	}
+
+	// unlimited by default
+	c.MaxHostChanges = 0
+	_, err = makeTestReq(tsA.URL+"/hop/5", 200, c)
+	assert.Nil(t, err)
+
+	c.MaxHostChanges = -1
+	_, err = New(c)
+	assert.NotNil(t, err)
+}
+
+func TestCountHostChanges(t *testing.T) {
+	t.Parallel()
+
+	chain := func(urls ...string) []*http.Request {
+		reqs := make([]*http.Request, 0, len(urls))
+		for _, u := range urls {
+			reqs = append(reqs, httptest.NewRequest("GET", u, nil))
+		}
+		return reqs
+	}
+
+	reqs := chain("http://a.example/", "http://a.example:8080/x", "https://A.example./y")
+	assert.Equal(t, 0, countHostChanges(reqs[2], reqs[:2]))
+
+	reqs = chain("http://a.example/", "http://b.example/", "http://a.example/", "http://a.example/z")
+	assert.Equal(t, 2, countHostChanges(reqs[3], reqs[:3]))
+}
+
+func TestIPv6RejectedIP(t *testing.T) {
+	t.Parallel()
+
+	var rejectTests = []struct {
+		ip       string
+		rejected bool
+	}{
+		// reserved ranges
+		{"::1", true},
+		{"::", true},
+		{"::7f00:1", true},
+		{"::ffff:127.0.0.1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"fec0::1", true},
+		{"ff02::1", true},
+		{"2001:db8::1", true},
+		{"100::1", true},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", true},
+		{"64:ff9b:1::a00:1", true},
+		// nat64, filtered by the embedded ipv4 address
+		{"64:ff9b::127.0.0.1", true},
+		{"64:ff9b::10.0.0.1", true},
+		{"64:ff9b::192.168.1.1", true},
+		{"64:ff9b::169.254.169.254", true},
+		{"64:ff9b::8.8.8.8", false},
+		// 6to4, filtered by the embedded ipv4 address
+		{"2002:7f00:1::1", true},
+		{"2002:a00:1::1", true},
+		{"2002:808:808::1", false},
+		// global unicast
+		{"2606:4700:4700::1111", false},
+		{"2a00:1450:4001:80b::200e", false},
+	}
+
+	for _, tt := range rejectTests {
+		ip := net.ParseIP(tt.ip)
+		if assert.NotNil(t, ip, tt.ip) {
+			assert.Equal(t, tt.rejected, isRejectedIP(ip), tt.ip)
+		}
+	}
+}
+
+func TestIPv6MetadataIP(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isMetadataIP(net.ParseIP("64:ff9b::169.254.169.254")))
+	assert.True(t, isMetadataIP(net.ParseIP("2002:a9fe:a9fe::1")))
+	assert.False(t, isMetadataIP(net.ParseIP("64:ff9b::8.8.8.8")))
+}
+
+func TestIPv6Origin(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 loopback not available: %s", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	ts.Listener.Close()
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	testURL := ts.URL + "/image.png"
+	assert.Contains(t, testURL, "[::1]")
+
+	// fetched over ipv6
+	c := camoConfig
+	c.noIPFiltering = true
+	resp, err := makeTestReq(testURL, 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "ok", resp)
+	}
+
+	// ipv6 loopback is rejected when dialing, with filtering in place
+	_, err = makeTestReq(testURL, 404, camoConfig)
+	assert.Nil(t, err)
+
+	// as is a nat64 address embedding ipv4 loopback
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	_, err = makeTestReq("http://[64:ff9b::7f00:1]:"+port+"/image.png", 404, camoConfig)
+	assert.Nil(t, err)
+}
+
+func TestLegalBlock(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect.png" {
+			http.Redirect(w, r, "/takedown/image.png", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	rs, err := ParseFilterRules(strings.NewReader(
+		"allow|s|127.0.0.1||\nlegal||127.0.0.1||/takedown/*\ndeny||127.0.0.1||/denied/*\n",
+	))
+	assert.Nil(t, err)
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.StealthBlocks = true
+	c.LegalBlockNotice = "Removed. See https://example.com/notices/1234"
+
+	camoServer, err := NewWithRuleset(c, rs)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/image.png", 200, "ok"},
+		// legal blocks win over allow rules, and are never disguised
+		{"/takedown/image.png", 451, c.LegalBlockNotice + "\n"},
+		// as are redirects to legally blocked urls
+		{"/redirect.png", 451, c.LegalBlockNotice + "\n"},
+		// other blocks are unaffected
+		{"/denied/image.png", 200, string(stealthPixel)},
+	}
+	for _, tt := range tests {
+		req, err := makeReq(c, ts.URL+tt.path)
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		assert.Equal(t, tt.status, record.Code, tt.path)
+		assert.Equal(t, tt.body, record.Body.String(), tt.path)
+	}
+	assert.Equal(t, uint64(2), camoServer.Stats().Blocked["Unavailable For Legal Reasons"])
+
+	// default notice
+	c.LegalBlockNotice = ""
+	camoServer, err = NewWithRuleset(c, rs)
+	assert.Nil(t, err)
+	req, err := makeReq(c, ts.URL+"/takedown/image.png")
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	camoServer.ServeHTTP(record, req)
+	assert.Equal(t, 451, record.Code)
+	assert.Equal(t, "Unavailable For Legal Reasons\n", record.Body.String())
+}
+
+func TestIsMetadataIP(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{"169.254.169.254", "fd00:ec2::254", "169.254.170.2", "100.100.100.200"} {
+		ip := net.ParseIP(s)
+		assert.True(t, isMetadataIP(ip), s)
+		assert.True(t, isRejectedIP(ip), s)
+	}
+	for _, s := range []string{"169.254.169.253", "8.8.8.8", "2001:4860:4860::8888"} {
+		assert.False(t, isMetadataIP(net.ParseIP(s)), s)
+	}
+}
+
+// not parallel, as the default logger is swapped out to capture output
+func TestMetadataBlocked(t *testing.T) {
+	var logBuf bytes.Buffer
+	origLogger := mlog.DefaultLogger
+	mlog.DefaultLogger = mlog.New(&logBuf, 0)
+	defer func() { mlog.DefaultLogger = origLogger }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	// blocked even when ip filtering is disabled
+	c := camoConfig
+	c.noIPFiltering = true
+	c.CollectMetrics = true
+
+	var tests = []struct {
+		name string
+		url  string
+	}{
+		{"direct", "http://169.254.169.254/latest/meta-data/"},
+		{"direct ipv6", "http://[fd00:ec2::254]/latest/meta-data/"},
+		{"redirect", ts.URL + "/image.png"},
+	}
+
+	for _, tt := range tests {
+		logBuf.Reset()
+		before := testutil.ToFloat64(metadataBlocked)
+		_, err := makeTestReq(tt.url, 404, c)
+		assert.Nil(t, err, tt.name)
+		assert.Contains(t, logBuf.String(), "blocked request to cloud metadata address", tt.name)
+		assert.Equal(t, before+1, testutil.ToFloat64(metadataBlocked), tt.name)
+	}
+}
+
+func TestPresignedURLPreserved(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.RequestURI
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+
+	var tests = []string{
+		// s3 style (unsorted, percent encoded params)
+		"/bucket/some%20key.png?X-Amz-Algorithm=AWS4-HMAC-SHA256" +
+			"&X-Amz-Credential=AKIAEXAMPLE%2F20190101%2Fus-east-1%2Fs3%2Faws4_request" +
+			"&X-Amz-Date=20190101T000000Z&X-Amz-Expires=3600&X-Amz-SignedHeaders=host" +
+			"&X-Amz-Signature=0123456789abcdef",
+		// gcs style
+		"/bucket/obj.png?GoogleAccessId=svc%40example.iam.gserviceaccount.com" +
+			"&Expires=1546300800&Signature=ab%2Bcd%2Fef%3D%3D",
+		// encodings that must not be normalized
+		"/a%2Fb.png?z=1&a=2&plus=a+b&space=a%20b&empty=&flag&lower=%2f&dup=1&dup=2",
+	}
+
+	for _, uri := range tests {
+		_, err := makeTestReq(ts.URL+uri, 200, c)
+		assert.Nil(t, err, uri)
+		assert.Equal(t, uri, <-received)
+	}
+}
+
+func TestQueryStringURLs(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.QueryStringURLs = true
+
+	oURL := ts.URL + "/image.png?size=large"
+	mac := querySign(c.HMACKey, oURL)
+	hexDigest := hex.EncodeToString(mac)
+	b64Digest := strings.TrimRight(base64.URLEncoding.EncodeToString(mac), "=")
+	escaped := url.QueryEscape(oURL)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"hex digest param", "/?url=" + escaped + "&digest=" + hexDigest, 200},
+		{"base64 digest param", "/?digest=" + b64Digest + "&url=" + escaped, 200},
+		{"digest path", "/" + hexDigest + "?url=" + escaped, 200},
+		{"tampered digest", "/?url=" + escaped + "&digest=" + strings.Repeat("0", 40), 403},
+		{"tampered url", "/?url=" + url.QueryEscape(oURL+"x") + "&digest=" + hexDigest, 403},
+		{"missing digest", "/?url=" + escaped, 403},
+		{"missing url", "/?digest=" + hexDigest, 404},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "http://example.com"+tt.path, nil)
+		assert.Nil(t, err)
+		resp, err := processRequest(req, tt.status, c, nil)
+		assert.Nil(t, err, tt.name)
+		if tt.status == 200 {
+			bodyAssert(t, "ok", resp)
+		}
+	}
+
+	// path format urls still work
+	_, err := makeTestReq(oURL, 200, c)
+	assert.Nil(t, err)
+
+	// disabled by default
+	c.QueryStringURLs = false
+	req, err := http.NewRequest("GET", "http://example.com/?url="+escaped+"&digest="+hexDigest, nil)
+	assert.Nil(t, err)
+	_, err = processRequest(req, 404, c, nil)
+	assert.Nil(t, err)
+}
+
+func TestRefererPinned(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+
+	var tests = []struct {
+		payload string
+		referer string
+		status  int
+	}{
+		{encoding.PinReferer(ts.URL+"/image.png", "example.com"), "https://example.com/post/1", 200},
+		{encoding.PinReferer(ts.URL+"/image.png", "example.com"), "http://EXAMPLE.com:8080/", 200},
+		{encoding.PinReferer(ts.URL+"/image.png", "example.com"), "https://evil.example.net/", 403},
+		{encoding.PinReferer(ts.URL+"/image.png", "example.com"), "https://sub.example.com/", 403},
+		{encoding.PinReferer(ts.URL+"/image.png", "example.com"), "", 403},
+		{encoding.PinReferer(encoding.PinContentType(ts.URL+"/image.png", "image/*"), "example.com"), "https://example.com/", 200},
+		{encoding.PinReferer(encoding.PinContentType(ts.URL+"/image.png", "image/*"), "example.com"), "https://other.com/", 403},
+		// unpinned urls are served regardless of referer
+		{ts.URL + "/image.png", "https://evil.example.net/", 200},
+	}
+
+	for _, tt := range tests {
+		req, err := makeReq(c, tt.payload)
+		assert.Nil(t, err)
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+		resp, err := processRequest(req, tt.status, c, nil)
+		if !assert.Nil(t, err, tt.referer) {
+			continue
+		}
+		switch {
+		case tt.status == 403:
+			bodyAssert(t, "Referer not allowed\n", resp)
+		case tt.payload != ts.URL+"/image.png":
+			assert.Contains(t, resp.Header.Get("Vary"), "Referer", tt.referer)
+		}
+	}
+}
+
+func TestCollapseSlashes(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		in   string
+		want string
+	}{
+		{"http://example.com/a/b.png", "http://example.com/a/b.png"},
+		{"http://example.com//a///b.png", "http://example.com/a/b.png"},
+		{"https://example.com:8443/a//b.png?x=//y", "https://example.com:8443/a/b.png?x=//y"},
+		{"http://example.com/a//?x=1", "http://example.com/a/?x=1"},
+		{"http://example.com", "http://example.com"},
+		{"http://example.com?x=//y", "http://example.com?x=//y"},
+		{"not a url//path", "not a url//path"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, collapseSlashes(tt.in), "in %q", tt.in)
+	}
+}
+
+func TestCollapseSlashesFetch(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI != "/img/a.png?q=//x" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	testURL := ts.URL + "//img//a.png?q=//x"
+
+	// fetched verbatim by default
+	_, err := makeTestReq(testURL, 404, c)
+	assert.Nil(t, err)
+
+	c.CollapseSlashes = true
+	resp, err := makeTestReq(testURL, 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "ok", resp)
+	}
+}
@@ -13,12 +13,16 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/cactus/go-camo/pkg/camo/encoding"
 	"github.com/cactus/go-camo/pkg/router"
 	"github.com/cactus/mlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -301,3 +305,374 @@ func TestServerChunkTooBig(t *testing.T) {
 	// at least we should have only read the MaxSize amount...
 	assert.Equal(t, total, 1024)
 }
+
+func TestConnectTimeout(t *testing.T) {
+	t.Parallel()
+
+	// TEST-NET-1 is not routable, so connection attempts should hang
+	// until the timeout fires. Some environments instead refuse or proxy
+	// connections, in which case the test is not meaningful.
+	blackhole := "192.0.2.1:80"
+	conn, err := net.DialTimeout("tcp", blackhole, 200*time.Millisecond)
+	if err == nil {
+		conn.Close()
+		t.Skip("blackhole address is reachable in this environment")
+	}
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Skipf("blackhole address does not time out in this environment: %s", err)
+	}
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.ConnectTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err = makeTestReq("http://"+blackhole+"/image.png", 504, c)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 1*time.Second, "connect timeout didn't fire in time")
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	// accept connections, but never complete a tls handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conns := make([]net.Conn, 0)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.TLSHandshakeTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err = makeTestReq("https://"+ln.Addr().String()+"/image.png", 504, c)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 1*time.Second, "tls handshake timeout didn't fire in time")
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.ResponseHeaderTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := makeTestReq(ts.URL+"/image.png", 504, c)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 1*time.Second, "response header timeout didn't fire in time")
+}
+
+func TestBodyTimeout(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("partial"))
+		assert.Nil(t, err)
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.BodyTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	resp, err := makeTestReq(ts.URL+"/image.png", 200, c)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 1*time.Second, "body timeout didn't fire in time")
+	if err == nil {
+		bodyAssert(t, "partial", resp)
+	}
+}
+
+func TestRequestTimeoutCeiling(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	// phase timeout larger than the overall timeout. overall timeout wins.
+	c := camoConfig
+	c.noIPFiltering = true
+	c.RequestTimeout = 100 * time.Millisecond
+	c.ResponseHeaderTimeout = 5 * time.Second
+
+	start := time.Now()
+	_, err := makeTestReq(ts.URL+"/image.png", 504, c)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 1*time.Second, "request timeout didn't fire in time")
+}
+
+func TestCategoryTimeouts(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") != "" {
+			time.Sleep(150 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.WriteHeader(200)
+		_, err := w.Write([]byte("partial"))
+		assert.Nil(t, err)
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+			return
+		case <-r.Context().Done():
+			return
+		case <-time.After(300 * time.Millisecond):
+		}
+		w.Write([]byte("-rest")) // #nosec G104
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.AllowContentVideo = true
+	c.RequestTimeout = 5 * time.Second
+	c.CategoryTimeouts = map[string]time.Duration{
+		"Image": 100 * time.Millisecond,
+		"video": 2 * time.Second,
+	}
+
+	// images get the shorter timeout
+	start := time.Now()
+	resp, err := makeTestReq(ts.URL+"/image.png?type=image/png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "partial", resp)
+	}
+	assert.True(t, time.Since(start) < 300*time.Millisecond, "image category timeout didn't fire in time")
+
+	// video gets the longer timeout
+	resp, err = makeTestReq(ts.URL+"/video.mp4?type=video/mp4", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "partial-rest", resp)
+	}
+
+	// categories without a timeout only use the request timeout
+	c.AllowContentAudio = true
+	resp, err = makeTestReq(ts.URL+"/audio.mp3?type=audio/mpeg", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "partial-rest", resp)
+	}
+
+	// already exceeded once the content type is known
+	_, err = makeTestReq(ts.URL+"/image.png?type=image/png&slow=1", 504, c)
+	assert.Nil(t, err)
+
+	// category timeouts replace the request timeout, so may be longer
+	c.RequestTimeout = 100 * time.Millisecond
+	resp, err = makeTestReq(ts.URL+"/video.mp4?type=video/mp4", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "partial-rest", resp)
+	}
+
+	// the request timeout still bounds the time to the response headers
+	start = time.Now()
+	_, err = makeTestReq(ts.URL+"/video.mp4?type=video/mp4&slow=1", 504, c)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 300*time.Millisecond, "request timeout didn't fire in time")
+
+	// and the whole fetch for categories without a timeout
+	start = time.Now()
+	resp, err = makeTestReq(ts.URL+"/audio.mp3?type=audio/mpeg", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "partial", resp)
+	}
+	assert.True(t, time.Since(start) < 300*time.Millisecond, "request timeout didn't fire in time")
+
+	c.CategoryTimeouts = map[string]time.Duration{"image/png": time.Second}
+	_, err = New(c)
+	assert.NotNil(t, err)
+}
+
+func TestRedirectBodyTimeout(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("ok")) // #nosec G104
+			return
+		}
+		// a redirect with a slowly dripped, never ending body
+		w.Header().Set("Location", "/image.png")
+		w.WriteHeader(http.StatusFound)
+		for {
+			if _, err := w.Write([]byte("x")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.RedirectBodyTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	resp, err := makeTestReq(ts.URL+"/redirect", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "ok", resp)
+	}
+	// well within the request timeout
+	assert.True(t, time.Since(start) < 5*time.Second, "redirect body read was not bounded")
+}
+
+func TestRedirectBodySize(t *testing.T) {
+	t.Parallel()
+
+	closed := false
+	b := &redirectBody{
+		rc:        ioutil.NopCloser(bytes.NewReader(make([]byte, 64*1024))),
+		remaining: 100,
+		done:      func() { closed = true },
+	}
+	data, err := ioutil.ReadAll(b)
+	assert.Nil(t, err)
+	assert.Len(t, data, 100)
+	assert.Nil(t, b.Close())
+	assert.True(t, closed)
+}
+
+func TestRedirectBodyTransport(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("x", 64*1024)
+	tr := &redirectBodyTransport{
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			resp := &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+			}
+			if req.URL.Path == "/redirect" {
+				resp.Header.Set("Location", "/image.png")
+			}
+			return resp, nil
+		}),
+		maxSize: 10,
+		timeout: time.Second,
+	}
+
+	for path, size := range map[string]int{"/redirect": 10, "/other": len(body)} {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		resp, err := tr.RoundTrip(req)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Len(t, data, size, path)
+		assert.Nil(t, resp.Body.Close())
+	}
+}
+
+func TestRedirectBodyInvalid(t *testing.T) {
+	t.Parallel()
+
+	c := camoConfig
+	c.MaxRedirectBodySize = -1
+	_, err := New(c)
+	assert.NotNil(t, err)
+
+	c = camoConfig
+	c.RedirectBodyTimeout = -time.Second
+	_, err = New(c)
+	assert.NotNil(t, err)
+}
+
+func TestClientWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	// large enough to fill the socket buffers of a client that never reads
+	body := bytes.Repeat([]byte{0x00}, 64*1024*1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.MaxSize = 0
+	c.ClientWriteTimeout = 200 * time.Millisecond
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+
+	// like metrics instrumentation, hide the server's ResponseWriter
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_responses_total"}, []string{"code"})
+	done := make(chan struct{})
+	tsCamo := httptest.NewServer(PreserveResponseController(promhttp.InstrumentHandlerCounter(counter,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(done)
+			camoServer.ServeHTTP(w, r)
+		}),
+	)))
+	defer tsCamo.Close()
+
+	u, err := url.Parse(tsCamo.URL)
+	assert.Nil(t, err)
+	conn, err := net.Dial("tcp", u.Host)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// a slow client: send the request, then never read the response
+	path := encoding.B64EncodeURL(c.HMACKey, ts.URL+"/image.png")
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, u.Host)
+	assert.Nil(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("response write to slow client did not time out")
+	}
+}
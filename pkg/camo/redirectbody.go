@@ -0,0 +1,94 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// isFollowedRedirect returns true for responses the http client follows
+// (and discards the body of).
+func isFollowedRedirect(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Header.Get("Location") != ""
+	}
+	return false
+}
+
+// redirectBodyTransport bounds the size of, and time spent reading, the body
+// of redirect responses, which the http client drains before following the
+// redirect.
+type redirectBodyTransport struct {
+	next    http.RoundTripper
+	maxSize int64
+	timeout time.Duration
+}
+
+func (t *redirectBodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// closing a body does not interrupt a blocked read, but cancelling the
+	// request does.
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	if !isFollowedRedirect(resp) {
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+	timer := time.AfterFunc(t.timeout, cancel)
+	resp.Body = &redirectBody{
+		rc:        resp.Body,
+		remaining: t.maxSize,
+		done: func() {
+			timer.Stop()
+			cancel()
+		},
+	}
+	return resp, nil
+}
+
+// cancelOnClose calls cancel once the body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// redirectBody reads at most remaining bytes of rc, reporting io.EOF after.
+type redirectBody struct {
+	rc        io.ReadCloser
+	remaining int64
+	done      func()
+}
+
+func (b *redirectBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.rc.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *redirectBody) Close() error {
+	err := b.rc.Close()
+	b.done()
+	return err
+}
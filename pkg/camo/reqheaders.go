@@ -0,0 +1,74 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// conditionalReqHeaders are the request headers of conditional requests,
+// forwarded unless Config.DisableConditionalRequests is set.
+var conditionalReqHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// rangeReqHeaders are the request headers of byte range requests, forwarded
+// unless Config.DisableRangeRequests is set.
+var rangeReqHeaders = []string{"Range"}
+
+// managedReqHeaders are request headers set by the proxy itself, which can
+// not be added to Config.ForwardHeaders.
+var managedReqHeaders = map[string]bool{
+	"Accept":          true,
+	"Accept-Encoding": true,
+	"Connection":      true,
+	"Host":            true,
+	"User-Agent":      true,
+	"Via":             true,
+	"X-Forwarded-For": true,
+}
+
+// buildReqHeaders returns the set of request headers forwarded from the
+// client to origins: ValidReqHeaders, less those of disabled features, plus
+// client hints and Config.ForwardHeaders.
+func buildReqHeaders(pc Config, clientHints map[string]bool) (map[string]bool, error) {
+	h := make(map[string]bool, len(ValidReqHeaders))
+	for k, v := range ValidReqHeaders {
+		h[k] = v
+	}
+	// empty implies no filtering
+	if len(h) == 0 {
+		return h, nil
+	}
+
+	if pc.DisableConditionalRequests {
+		for _, name := range conditionalReqHeaders {
+			h[name] = false
+		}
+	}
+	if pc.DisableRangeRequests {
+		for _, name := range rangeReqHeaders {
+			h[name] = false
+		}
+	}
+
+	for name := range clientHints {
+		h[name] = true
+	}
+	for _, name := range pc.ForwardHeaders {
+		name = strings.TrimSpace(name)
+		if !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("invalid forward header: %q", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if managedReqHeaders[name] {
+			return nil, fmt.Errorf("forward header %q is managed by the proxy", name)
+		}
+		h[name] = true
+	}
+	return h, nil
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cactus/mlog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohTimeout is the maximum time allowed for a single DNS-over-HTTPS query.
+const dohTimeout = 2 * time.Second
+
+// dohMaxResponseSize caps the size of a DNS-over-HTTPS response body.
+const dohMaxResponseSize = 64 * 1024
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dohResolver resolves hostnames using DNS-over-HTTPS (rfc8484) wire format
+// GET requests.
+type dohResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newDoHResolver(endpoint string) (*dohResolver, error) {
+	if !(strings.HasPrefix(endpoint, "https://") || strings.HasPrefix(endpoint, "http://")) {
+		return nil, fmt.Errorf("invalid doh endpoint: %s", endpoint)
+	}
+	return &dohResolver{
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout: dohTimeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     30 * time.Second,
+				TLSHandshakeTimeout: 3 * time.Second,
+			},
+		},
+	}, nil
+}
+
+func (r *dohResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, error) {
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// rfc8484 recommends an ID of 0 for cache friendliness
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	sep := "?"
+	if strings.Contains(r.endpoint, "?") {
+		sep = "&"
+	}
+	qURL := r.endpoint + sep + "dns=" + base64.RawURLEncoding.EncodeToString(msg)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", qURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh response code = %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dohMaxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	hdr, err := p.Start(body)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("doh query failed: %s", hdr.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0)
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			rr, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(rr.A[:]))
+		case dnsmessage.TypeAAAA:
+			rr, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(rr.AAAA[:]))
+		default:
+			// cnames and such. the resolver is expected to have followed them.
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ips, nil
+}
+
+// LookupIP returns the A and AAAA records for host.
+func (r *dohResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if !strings.HasSuffix(host, ".") {
+		host = host + "."
+	}
+
+	ips4, err4 := r.query(ctx, host, dnsmessage.TypeA)
+	ips6, err6 := r.query(ctx, host, dnsmessage.TypeAAAA)
+	if err4 != nil && err6 != nil {
+		return nil, err4
+	}
+
+	ips := append(ips4, ips6...)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	return ips, nil
+}
+
+// lookupWithFallback returns a lookup function using the resolver. If
+// fallback is true, resolution failures fall back to the system resolver.
+func (r *dohResolver) lookupWithFallback(fallback bool) func(ctx context.Context, host string) ([]net.IP, error) {
+	return func(ctx context.Context, host string) ([]net.IP, error) {
+		ips, err := r.LookupIP(ctx, host)
+		if err == nil || !fallback || errors.Is(err, context.Canceled) {
+			return ips, err
+		}
+		if mlog.HasDebug() {
+			mlog.Debugm("doh lookup failed, falling back", mlog.Map{"host": host, "err": err})
+		}
+		return systemLookupIP(ctx, host)
+	}
+}
+
+// systemLookupIP resolves host with the system resolver.
+func systemLookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// resolvingDialContext returns a dialFunc that resolves hostnames with the
+// DNS-over-HTTPS resolver, and then dials the resulting addresses (in order)
+// with dial. As dial is expected to perform ip filtering in Dial.Control,
+// resolved addresses are subject to the same filtering as system resolved
+// addresses. If fallback is true, resolution failures fall back to dialing
+// by hostname (eg. the system resolver).
+func resolvingDialContext(r *dohResolver, fallback bool, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s is not a valid host/port pair: %w", address, err, ErrInvalidHostPort)
+		}
+
+		// already an ip address. nothing to resolve.
+		if ip := net.ParseIP(host); ip != nil {
+			return dial(ctx, network, address)
+		}
+
+		ips, err := r.LookupIP(ctx, host)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return nil, err
+			}
+			if fallback {
+				if mlog.HasDebug() {
+					mlog.Debugm("doh lookup failed, falling back", mlog.Map{"host": host, "err": err})
+				}
+				return dial(ctx, network, address)
+			}
+			return nil, fmt.Errorf("doh lookup failed: %w", err)
+		}
+
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+}
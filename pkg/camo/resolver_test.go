@@ -0,0 +1,137 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newMockDoHServer returns a DNS-over-HTTPS server that answers every A
+// query with ip, and every AAAA query with no records.
+func newMockDoHServer(t *testing.T, ip net.IP, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		msg, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+
+		var p dnsmessage.Parser
+		hdr, err := p.Start(msg)
+		assert.Nil(t, err)
+		q, err := p.Question()
+		assert.Nil(t, err)
+
+		hdr.Response = true
+		b := dnsmessage.NewBuilder(nil, hdr)
+		assert.Nil(t, b.StartQuestions())
+		assert.Nil(t, b.Question(q))
+		assert.Nil(t, b.StartAnswers())
+		if q.Type == dnsmessage.TypeA {
+			var a [4]byte
+			copy(a[:], ip.To4())
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			assert.Nil(t, b.AResource(rh, dnsmessage.AResource{A: a}))
+		}
+		out, err := b.Finish()
+		assert.Nil(t, err)
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, err = w.Write(out)
+		assert.Nil(t, err)
+	}))
+}
+
+func TestDoHResolution(t *testing.T) {
+	t.Parallel()
+
+	var hits int32
+	doh := newMockDoHServer(t, net.ParseIP("127.0.0.1"), &hits)
+	defer doh.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, err := w.Write([]byte("ok"))
+		assert.Nil(t, err)
+	}))
+	defer ts.Close()
+
+	tsURL, err := url.Parse(ts.URL)
+	assert.Nil(t, err)
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.DoHEndpoint = doh.URL
+
+	req, err := makeReq(c, "http://camo-doh.test:"+tsURL.Port()+"/image.png")
+	assert.Nil(t, err)
+	resp, err := processRequest(req, 200, c, nil)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "ok", resp)
+	}
+	assert.True(t, atomic.LoadInt32(&hits) > 0, "doh endpoint not queried")
+}
+
+func TestDoHResolutionFiltered(t *testing.T) {
+	t.Parallel()
+
+	var hits int32
+	doh := newMockDoHServer(t, net.ParseIP("127.0.0.1"), &hits)
+	defer doh.Close()
+
+	c := camoConfig
+	c.DoHEndpoint = doh.URL
+
+	resp, err := makeTestReq("http://camo-doh.test/image.png", 404, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "Error Fetching Resource\n", resp)
+	}
+	assert.True(t, atomic.LoadInt32(&hits) > 0, "doh endpoint not queried")
+}
+
+func TestDoHFallback(t *testing.T) {
+	t.Parallel()
+
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer doh.Close()
+
+	resolver, err := newDoHResolver(doh.URL)
+	assert.Nil(t, err)
+
+	var dialed string
+	errDial := errors.New("dial")
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = address
+		return nil, errDial
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// no fallback: dial is never reached
+	_, err = resolvingDialContext(resolver, false, dial)(ctx, "tcp", "camo-doh.test:80")
+	assert.NotNil(t, err)
+	assert.Equal(t, "", dialed)
+
+	// fallback: dial by hostname
+	_, err = resolvingDialContext(resolver, true, dial)(ctx, "tcp", "camo-doh.test:80")
+	assert.True(t, errors.Is(err, errDial))
+	assert.Equal(t, "camo-doh.test:80", dialed)
+}
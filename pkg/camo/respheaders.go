@@ -0,0 +1,130 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// response headers that must only appear once. when an origin sends
+// duplicates, only the first is relayed.
+var singleRespHeaders = []string{
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Etag",
+	"Expires",
+	"Last-Modified",
+}
+
+// response headers that are comma separated lists, where repeated (identical)
+// values are redundant.
+var listRespHeaders = []string{
+	"Accept-Ranges",
+	"Cache-Control",
+}
+
+// response headers that an image origin has no business sending, and which
+// are dangerous if relayed. they are never forwarded, but many of them hint at
+// a malicious or compromised origin.
+var dangerousRespHeaders = []string{
+	"Clear-Site-Data",
+	"Refresh",
+	"Service-Worker-Allowed",
+	"Set-Cookie",
+	"Set-Cookie2",
+}
+
+var errEmptyContentType = errors.New("empty content-type")
+
+// countDangerousHeaders returns the number of dangerous header values in h.
+func countDangerousHeaders(h http.Header) int {
+	n := 0
+	for _, k := range dangerousRespHeaders {
+		n += len(h[k])
+	}
+	return n
+}
+
+// canonicalizeHeaders rewrites header names to canonical MIME casing (eg.
+// "content-TYPE" becomes "Content-Type"), merging the values of names that
+// differ only in case. Names that can not be canonicalized are kept as is.
+func canonicalizeHeaders(h http.Header) {
+	for k, vv := range h {
+		ck := http.CanonicalHeaderKey(k)
+		if ck == k {
+			continue
+		}
+		delete(h, k)
+		h[ck] = append(h[ck], vv...)
+	}
+}
+
+// normalizeRespHeaders collapses duplicated response headers sent by
+// origins, which may otherwise confuse clients.
+func normalizeRespHeaders(h http.Header) {
+	for _, k := range singleRespHeaders {
+		if vv := h[k]; len(vv) > 1 {
+			h[k] = vv[:1]
+		}
+	}
+	for _, k := range listRespHeaders {
+		vv := h[k]
+		if len(vv) < 2 {
+			continue
+		}
+		seen := make(map[string]bool, len(vv))
+		uniq := vv[:0]
+		for _, v := range vv {
+			if key := strings.ToLower(strings.TrimSpace(v)); !seen[key] {
+				seen[key] = true
+				uniq = append(uniq, v)
+			}
+		}
+		h[k] = uniq
+	}
+}
+
+// parseContentType returns the first parseable media type from (possibly
+// duplicated) Content-Type header values. If none parse, the error from the
+// first non-empty value is returned.
+func parseContentType(values []string) (string, map[string]string, error) {
+	var firstErr error
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		mediatype, params, err := mime.ParseMediaType(v)
+		if err == nil {
+			return mediatype, params, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = errEmptyContentType
+	}
+	return "", nil, firstErr
+}
+
+// filterContentTypeParams returns the content type parameters in allowed,
+// dropping any others. A nil allowed keeps all parameters. The boundary of
+// multipart types is always kept, as streams can not be parsed without it.
+func filterContentTypeParams(mediatype string, params map[string]string, allowed map[string]bool) map[string]string {
+	if allowed == nil || len(params) == 0 {
+		return params
+	}
+	kept := make(map[string]string, len(params))
+	for k, v := range params {
+		if allowed[k] || k == "boundary" && strings.HasPrefix(mediatype, "multipart/") {
+			kept[k] = v
+		}
+	}
+	return kept
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeRespHeaders(t *testing.T) {
+	t.Parallel()
+
+	h := http.Header{
+		"Content-Type":  {"image/png", "image/gif"},
+		"Etag":          {`"a"`, `"b"`},
+		"Cache-Control": {"max-age=60", "public", "Max-Age=60"},
+		"Accept-Ranges": {"bytes"},
+	}
+	normalizeRespHeaders(h)
+	assert.Equal(t, []string{"image/png"}, h["Content-Type"])
+	assert.Equal(t, []string{`"a"`}, h["Etag"])
+	assert.Equal(t, []string{"max-age=60", "public"}, h["Cache-Control"])
+	assert.Equal(t, []string{"bytes"}, h["Accept-Ranges"])
+}
+
+func TestParseContentType(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		values    []string
+		mediatype string
+		valid     bool
+	}{
+		{[]string{"image/png"}, "image/png", true},
+		{[]string{"image/png", "text/html"}, "image/png", true},
+		{[]string{"", "image/gif"}, "image/gif", true},
+		{[]string{"image/png, text/html", "image/jpeg"}, "image/jpeg", true},
+		{[]string{"image/png, text/html"}, "", false},
+		{[]string{""}, "", false},
+	}
+
+	for _, tt := range tests {
+		mediatype, _, err := parseContentType(tt.values)
+		assert.Equal(t, tt.mediatype, mediatype, "%q", tt.values)
+		assert.Equal(t, tt.valid, err == nil, "%q", tt.values)
+	}
+}
+
+func TestDuplicateResponseHeaders(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h["Content-Type"] = []string{"image/png, text/html", "image/png", "text/html"}
+		h["Etag"] = []string{`"abc"`, `"def"`}
+		h["Cache-Control"] = []string{"max-age=60", "max-age=60"}
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+
+	resp, err := makeTestReq(ts.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"image/png"}, resp.Header["Content-Type"])
+		assert.Equal(t, []string{`"abc"`}, resp.Header["Etag"])
+		assert.Equal(t, []string{"max-age=60"}, resp.Header["Cache-Control"])
+		bodyAssert(t, "ok", resp)
+	}
+}
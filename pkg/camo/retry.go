@@ -0,0 +1,100 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cactus/mlog"
+)
+
+// parseRetryAfter parses a Retry-After header value, in either the
+// delay-seconds or HTTP-date form, returning the delay relative to now.
+// Dates in the past result in a zero delay.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// isRetryableStatus returns true for upstream response codes that indicate a
+// transient condition worth retrying.
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+}
+
+// doWithRetries performs the upstream request with client, retrying 429 and
+// 503 responses up to Config.MaxRetries times. The delay before each retry is
+// taken from the Retry-After header if present, otherwise exponential
+// backoff is used. All attempts share the request timeout deadline (zero for
+// none); if the delay would exceed the remaining budget, the last response is
+// returned immediately instead.
+func (p *Proxy) doWithRetries(client *http.Client, req *http.Request, deadline time.Time) (*http.Response, error) {
+
+	for attempt := 0; ; attempt++ {
+		// each attempt starts over at the requested url
+		recordEarlyHintsHop(req.Context(), nil)
+		resp, err := client.Do(req)
+		if err != nil || attempt >= p.config.MaxRetries || !isRetryableStatus(resp.StatusCode) {
+			return resp, err
+		}
+
+		now := time.Now()
+		delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+		if !ok {
+			delay = RetryBaseDelay << uint(attempt)
+		}
+
+		var budget time.Duration
+		if deadline.IsZero() {
+			budget = MaxRetryDelay
+		} else {
+			budget = deadline.Sub(now)
+		}
+		if delay >= budget {
+			if mlog.HasDebug() {
+				mlog.Debugm("retry delay exceeds budget", mlog.Map{
+					"url": req.URL, "status": resp.StatusCode, "delay": delay, "budget": budget,
+				})
+			}
+			return resp, nil
+		}
+
+		if mlog.HasDebug() {
+			mlog.Debugm("retrying upstream request", mlog.Map{
+				"url": req.URL, "status": resp.StatusCode, "delay": delay, "attempt": attempt + 1,
+			})
+		}
+
+		// drain (a bit of) the body, so the connection may be reused
+		_, _ = io.CopyN(ioutil.Discard, resp.Body, 4096)
+		resp.Body.Close()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
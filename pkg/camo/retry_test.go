@@ -0,0 +1,169 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"3", 3 * time.Second, true},
+		{" 120 ", 2 * time.Minute, true},
+		{"Tue, 01 Jan 2019 12:00:05 GMT", 5 * time.Second, true},
+		{"Tuesday, 01-Jan-19 12:01:00 GMT", time.Minute, true},
+		{"Tue, 01 Jan 2019 11:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, tt := range tests {
+		delay, ok := parseRetryAfter(tt.value, now)
+		assert.Equal(t, tt.ok, ok, tt.value)
+		assert.Equal(t, tt.delay, delay, tt.value)
+	}
+}
+
+// newRetryServer returns a server that responds with status (and the
+// Retry-After value returned by retryAfter) until failures requests have
+// been made, and then succeeds.
+func newRetryServer(status int, failures int32, retryAfter func() string) (*httptest.Server, *int32) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= failures {
+			if v := retryAfter(); v != "" {
+				w.Header().Set("Retry-After", v)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	return ts, &hits
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	t.Parallel()
+
+	ts, hits := newRetryServer(429, 1, func() string { return "1" })
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.MaxRetries = 2
+
+	start := time.Now()
+	resp, err := makeTestReq(ts.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "ok", resp)
+	}
+	assert.True(t, time.Since(start) >= time.Second, "retry-after delay not honored")
+	assert.Equal(t, int32(2), atomic.LoadInt32(hits))
+}
+
+func TestRetryAfterDate(t *testing.T) {
+	t.Parallel()
+
+	ts, hits := newRetryServer(503, 1, func() string {
+		// http dates have second resolution, so the delay is 1-2s
+		return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)
+	})
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.MaxRetries = 1
+
+	start := time.Now()
+	resp, err := makeTestReq(ts.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "ok", resp)
+	}
+	assert.True(t, time.Since(start) >= time.Second, "retry-after delay not honored")
+	assert.Equal(t, int32(2), atomic.LoadInt32(hits))
+}
+
+func TestRetryAfterExceedsBudget(t *testing.T) {
+	t.Parallel()
+
+	ts, hits := newRetryServer(503, 10, func() string { return "120" })
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.MaxRetries = 3
+
+	// fast fails with the upstream error
+	start := time.Now()
+	_, err := makeTestReq(ts.URL+"/image.png", 502, c)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < time.Second, "did not fast fail")
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	t.Parallel()
+
+	ts, hits := newRetryServer(503, 2, func() string { return "" })
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+
+	// no retries by default
+	_, err := makeTestReq(ts.URL+"/image.png", 502, c)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+
+	// remaining failure retried with backoff
+	c.MaxRetries = 1
+	resp, err := makeTestReq(ts.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		bodyAssert(t, "ok", resp)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(hits))
+}
+
+func TestRetryWithinRequestTimeout(t *testing.T) {
+	t.Parallel()
+
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(900 * time.Millisecond)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.MaxRetries = 3
+	c.RequestTimeout = time.Second
+
+	// each attempt fits in the request timeout, but all of them together do
+	// not. the retries share a single deadline.
+	start := time.Now()
+	_, err := makeTestReq(ts.URL+"/image.png", 504, c)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 1500*time.Millisecond, "retries exceeded the request timeout")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,12 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package camo
+
+// the syscall package does not define SO_REUSEPORT on all linux
+// architectures. it is 0xf on all but mips.
+const soReusePort = 0xf
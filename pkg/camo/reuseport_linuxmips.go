@@ -0,0 +1,15 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+// +build linux
+// +build mips mipsle mips64 mips64le
+
+package camo
+
+import (
+	"syscall"
+)
+
+const soReusePort = syscall.SO_REUSEPORT
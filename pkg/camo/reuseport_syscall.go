@@ -0,0 +1,14 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build aix darwin dragonfly freebsd netbsd openbsd
+
+package camo
+
+import (
+	"syscall"
+)
+
+const soReusePort = syscall.SO_REUSEPORT
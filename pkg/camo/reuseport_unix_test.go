@@ -0,0 +1,50 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
+
+package camo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenReusePort(t *testing.T) {
+	t.Parallel()
+
+	c := camoConfig
+	c.ReusePort = true
+
+	ln1, err := Listen(c, "tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer ln1.Close()
+
+	ln2, err := Listen(c, "tcp", ln1.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer ln2.Close()
+	assert.Equal(t, ln1.Addr().String(), ln2.Addr().String())
+}
+
+func TestListenNoReusePort(t *testing.T) {
+	t.Parallel()
+
+	ln1, err := Listen(camoConfig, "tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer ln1.Close()
+
+	ln2, err := Listen(camoConfig, "tcp", ln1.Addr().String())
+	if err == nil {
+		ln2.Close()
+	}
+	assert.NotNil(t, err)
+}
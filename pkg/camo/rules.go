@@ -0,0 +1,263 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cactus/go-camo/pkg/htrie"
+	"github.com/cactus/mlog"
+)
+
+// Ruleset is a parsed filter ruleset.
+type Ruleset struct {
+	// Filters are the allow and deny filters, in evaluation order. The first
+	// false response from a filter fails the request.
+	Filters []FilterFunc
+	// Legal, if not nil, returns true for urls blocked for legal reasons,
+	// which are rejected with a 451 (Unavailable For Legal Reasons). It is
+	// evaluated before Filters.
+	Legal FilterFunc
+}
+
+// ruleMatchers are the allow, deny, and legal rules of a single ruleset.
+type ruleMatchers struct {
+	allow, deny, legal          *htrie.URLMatcher
+	hasAllow, hasDeny, hasLegal bool
+}
+
+// parseRuleMatchers reads filter rules (one per line, in filter-ruleset
+// format) from r.
+func parseRuleMatchers(r io.Reader) (*ruleMatchers, error) {
+	m := &ruleMatchers{
+		allow: htrie.NewURLMatcher(),
+		deny:  htrie.NewURLMatcher(),
+		legal: htrie.NewURLMatcher(),
+	}
+
+	var err error
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "allow|") {
+			line = strings.TrimPrefix(line, "allow")
+			err = m.allow.AddRule(line)
+			if err != nil {
+				break
+			}
+			m.hasAllow = true
+		} else if strings.HasPrefix(line, "deny|") {
+			line = strings.TrimPrefix(line, "deny")
+			err = m.deny.AddRule(line)
+			if err != nil {
+				break
+			}
+			m.hasDeny = true
+		} else if strings.HasPrefix(line, "legal|") {
+			line = strings.TrimPrefix(line, "legal")
+			err = m.legal.AddRule(line)
+			if err != nil {
+				break
+			}
+			m.hasLegal = true
+		} else {
+			mlog.Printf("ignoring line: %s", line)
+		}
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error building filter ruleset: %s", err)
+	}
+	return m, nil
+}
+
+// ParseFilterRules reads filter rules (one per line, in filter-ruleset
+// format) from r, and returns the resulting ruleset. Allow rules are
+// evaluated first, then deny rules. Legal rules are deny rules that are
+// rejected with a 451.
+func ParseFilterRules(r io.Reader) (*Ruleset, error) {
+	m, err := parseRuleMatchers(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// append in order. allow first, then deny filters.
+	// first false value aborts the request.
+	rs := &Ruleset{Filters: make([]FilterFunc, 0)}
+
+	if m.hasAllow {
+		rs.Filters = append(rs.Filters, m.allow.CheckURL)
+	}
+
+	// denyFilter returns true on a match. we want a "false" value to abort processing.
+	// so just wrap and invert the bool.
+	if m.hasDeny {
+		denyF := func(u *url.URL) bool {
+			return !m.deny.CheckURL(u)
+		}
+		rs.Filters = append(rs.Filters, denyF)
+	}
+
+	if m.hasLegal {
+		rs.Legal = m.legal.CheckURL
+	}
+
+	if m.hasAllow && m.hasDeny {
+		mlog.Printf("Warning! Allow and Deny rules both supplied. Having Allow rules means anything not matching an allow rule is denied. THEN deny rules are evaluated. Be sure this is what you want!")
+	}
+
+	return rs, nil
+}
+
+// loadRulesFiles reads the filter rules files at paths, and compiles them
+// into a single ruleset, where later files take precedence. See
+// layeredRuleset.
+func loadRulesFiles(paths []string) (*Ruleset, error) {
+	layers := make([]*ruleMatchers, 0, len(paths))
+	for _, path := range paths {
+		// #nosec
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open rules file: %s", err)
+		}
+		m, err := parseRuleMatchers(file)
+		// #nosec
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		layers = append(layers, m)
+	}
+	return layeredRuleset(layers), nil
+}
+
+// layeredRuleset compiles rulesets into one, where later rulesets take
+// precedence over earlier ones. A url is decided by the last ruleset with a
+// matching allow or deny rule (deny winning within a ruleset). Urls matching
+// no rule are rejected if any ruleset has allow rules. Legal rules from all
+// rulesets apply.
+func layeredRuleset(layers []*ruleMatchers) *Ruleset {
+	hasAllow, hasLegal := false, false
+	for _, m := range layers {
+		hasAllow = hasAllow || m.hasAllow
+		hasLegal = hasLegal || m.hasLegal
+	}
+
+	rs := &Ruleset{Filters: []FilterFunc{func(u *url.URL) bool {
+		for i := len(layers) - 1; i >= 0; i-- {
+			m := layers[i]
+			if m.hasDeny && m.deny.CheckURL(u) {
+				return false
+			}
+			if m.hasAllow && m.allow.CheckURL(u) {
+				return true
+			}
+		}
+		return !hasAllow
+	}}}
+
+	if hasLegal {
+		rs.Legal = func(u *url.URL) bool {
+			for _, m := range layers {
+				if m.hasLegal && m.legal.CheckURL(u) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return rs
+}
+
+// remoteRules fetches filter rules from a url.
+type remoteRules struct {
+	url    string
+	client *http.Client
+}
+
+func newRemoteRules(rulesURL string) (*remoteRules, error) {
+	u, err := url.Parse(rulesURL)
+	if err != nil || !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid rules url: %s", rulesURL)
+	}
+	return &remoteRules{
+		url: rulesURL,
+		client: &http.Client{
+			Timeout: rulesFetchTimeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				IdleConnTimeout:     30 * time.Second,
+				TLSHandshakeTimeout: 3 * time.Second,
+			},
+		},
+	}, nil
+}
+
+// fetch fetches and parses the rules.
+func (r *remoteRules) fetch() (*Ruleset, error) {
+	resp, err := r.client.Get(r.url)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rules: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching rules: unexpected status %d", resp.StatusCode)
+	}
+
+	// read fully before parsing, so a truncated ruleset is never used
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxRulesSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rules: %w", err)
+	}
+	if len(body) > MaxRulesSize {
+		return nil, fmt.Errorf("error fetching rules: ruleset larger than %d bytes", MaxRulesSize)
+	}
+	return ParseFilterRules(strings.NewReader(string(body)))
+}
+
+// refreshRules periodically refreshes the remote filter rules, until stop
+// is closed. On failure, the current rules are kept.
+func (p *Proxy) refreshRules(rr *remoteRules, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		rs, err := rr.fetch()
+		if err != nil {
+			mlog.Printf("rules refresh failed, keeping current rules: %s", err)
+			continue
+		}
+		p.remoteRules.Store(rs)
+		if mlog.HasDebug() {
+			mlog.Debugm("rules refreshed", mlog.Map{"url": rr.url, "filters": len(rs.Filters)})
+		}
+	}
+}
+
+// Close stops background work (eg. rules refreshing) of the Proxy.
+func (p *Proxy) Close() {
+	p.closeOnce.Do(func() {
+		if p.stop != nil {
+			close(p.stop)
+		}
+	})
+}
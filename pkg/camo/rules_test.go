@@ -0,0 +1,223 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFilterRules(t *testing.T) {
+	t.Parallel()
+
+	rs, err := ParseFilterRules(strings.NewReader(
+		"allow|s|*.example.com||\ndeny|s|bad.example.com||\n# comment\n",
+	))
+	assert.Nil(t, err)
+	assert.Len(t, rs.Filters, 2)
+	assert.Nil(t, rs.Legal)
+
+	check := func(s string) bool {
+		u, err := url.Parse(s)
+		assert.Nil(t, err)
+		for _, f := range rs.Filters {
+			if !f(u) {
+				return false
+			}
+		}
+		return true
+	}
+	assert.True(t, check("http://good.example.com/a.png"))
+	assert.False(t, check("http://bad.example.com/a.png"))
+	assert.False(t, check("http://example.org/a.png"))
+
+	_, err = ParseFilterRules(strings.NewReader("deny|s|||\n"))
+	assert.NotNil(t, err)
+
+	// legal rules
+	rs, err = ParseFilterRules(strings.NewReader("legal|s|example.com|i|/takedown/*\n"))
+	assert.Nil(t, err)
+	assert.Len(t, rs.Filters, 0)
+	if assert.NotNil(t, rs.Legal) {
+		u, _ := url.Parse("http://img.example.com/TakeDown/a.png")
+		assert.True(t, rs.Legal(u))
+		u, _ = url.Parse("http://img.example.com/a.png")
+		assert.False(t, rs.Legal(u))
+	}
+
+	_, err = ParseFilterRules(strings.NewReader("legal|s|||\n"))
+	assert.NotNil(t, err)
+
+	// scheme scoped rules
+	rs, err = ParseFilterRules(strings.NewReader("deny||http://insecure.example.com||*\n"))
+	assert.Nil(t, err)
+	assert.False(t, check("http://insecure.example.com/a.png"))
+	assert.True(t, check("https://insecure.example.com/a.png"))
+}
+
+// mockRules serves rules, or a failure status if status is non-zero.
+type mockRules struct {
+	mu     sync.Mutex
+	rules  string
+	status int
+	hits   int
+}
+
+func (m *mockRules) set(rules string, status int) {
+	m.mu.Lock()
+	m.rules, m.status = rules, status
+	m.mu.Unlock()
+}
+
+func (m *mockRules) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hits
+}
+
+func (m *mockRules) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hits++
+	if m.status != 0 {
+		w.WriteHeader(m.status)
+		return
+	}
+	w.Write([]byte(m.rules)) // #nosec G104
+}
+
+func TestRemoteRulesRefresh(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockRules{rules: "deny|s|one.example.com||\n"}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	c := camoConfig
+	c.RulesURL = ts.URL
+	c.RulesRefreshInterval = 20 * time.Millisecond
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+	defer camoServer.Close()
+
+	one, _ := url.Parse("http://one.example.com/a.png")
+	two, _ := url.Parse("http://two.example.com/a.png")
+	assert.NotNil(t, camoServer.checkURL(one))
+	assert.Nil(t, camoServer.checkURL(two))
+
+	// rules are swapped on refresh
+	mock.set("deny|s|two.example.com||\n", 0)
+	assert.Eventually(t, func() bool {
+		return camoServer.checkURL(one) == nil && camoServer.checkURL(two) != nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// failed refreshes keep the current rules
+	mock.set("", http.StatusInternalServerError)
+	hits := mock.count()
+	assert.Eventually(t, func() bool {
+		return mock.count() >= hits+2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Nil(t, camoServer.checkURL(one))
+	assert.NotNil(t, camoServer.checkURL(two))
+
+	// as do invalid rulesets
+	mock.set("deny|s|||\n", 0)
+	hits = mock.count()
+	assert.Eventually(t, func() bool {
+		return mock.count() >= hits+2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, camoServer.checkURL(two))
+}
+
+func TestRemoteRulesInitialFailure(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockRules{status: http.StatusNotFound}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	c := camoConfig
+	c.RulesURL = ts.URL
+	_, err := New(c)
+	assert.NotNil(t, err)
+
+	c.RulesURL = "file:///etc/rules"
+	_, err = New(c)
+	assert.NotNil(t, err)
+}
+
+func writeRulesFile(t *testing.T, dir, name, rules string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(rules), 0600))
+	return path
+}
+
+func TestRulesFilesPrecedence(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "camo-rules")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	global := writeRulesFile(t, dir, "global.rules",
+		"allow|s|*.example.com||\ndeny|s|cdn.example.com||\nlegal|s|example.com|i|/team/takedown/*\n")
+	team := writeRulesFile(t, dir, "team.rules",
+		"allow|s|cdn.example.com|i|/team/*\ndeny|s|img.example.com|i|/private/*\n")
+
+	c := camoConfig
+	c.RulesFiles = []string{global, team}
+	p, err := New(c)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	check := func(s string) error {
+		u, err := url.Parse(s)
+		assert.Nil(t, err)
+		return p.checkURL(u)
+	}
+	// allowed by the global file
+	assert.Nil(t, check("http://img.example.com/a.png"))
+	// denied by the global file, not matched by the team file
+	assert.Equal(t, errFilterRejected, check("http://cdn.example.com/a.png"))
+	// global deny overridden by a team allow
+	assert.Nil(t, check("http://cdn.example.com/team/a.png"))
+	// global allow overridden by a team deny
+	assert.Equal(t, errFilterRejected, check("http://img.example.com/private/a.png"))
+	// not allowed by any file
+	assert.Equal(t, errFilterRejected, check("http://example.org/a.png"))
+	// legal rules always apply
+	assert.Equal(t, errLegalBlock, check("http://cdn.example.com/team/takedown/a.png"))
+
+	// reversing the order reverses the precedence
+	c.RulesFiles = []string{team, global}
+	p, err = New(c)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, errFilterRejected, check("http://cdn.example.com/team/a.png"))
+	assert.Nil(t, check("http://img.example.com/private/a.png"))
+
+	c.RulesFiles = []string{global, filepath.Join(dir, "missing.rules")}
+	_, err = New(c)
+	assert.NotNil(t, err)
+
+	c.RulesFiles = []string{writeRulesFile(t, dir, "bad.rules", "deny|s|||\n")}
+	_, err = New(c)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of proxy counters, since the proxy was created. It is
+// collected regardless of Config.CollectMetrics, for quick checks without a
+// metrics stack.
+type Stats struct {
+	// Requests is the number of requests received
+	Requests uint64 `json:"requests"`
+	// InFlight is the number of requests currently being processed
+	InFlight int64 `json:"in_flight"`
+	// BytesSent is the number of response body bytes proxied to clients
+	BytesSent uint64 `json:"bytes_sent"`
+	// Blocked is the number of blocked requests, by block reason
+	Blocked map[string]uint64 `json:"blocked"`
+	// NegativeCache and BlockCache are only set when the caches are enabled
+	NegativeCache *CacheStats `json:"negative_cache,omitempty"`
+	BlockCache    *CacheStats `json:"block_cache,omitempty"`
+}
+
+// CacheStats is a snapshot of cache counters.
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+}
+
+// proxyStats holds the counters behind Stats. Scalars are accessed
+// atomically.
+type proxyStats struct {
+	requests  uint64
+	inFlight  int64
+	bytesSent uint64
+
+	mu      sync.Mutex
+	blocked map[string]uint64
+}
+
+func (s *proxyStats) block(reason string) {
+	s.mu.Lock()
+	if s.blocked == nil {
+		s.blocked = make(map[string]uint64)
+	}
+	s.blocked[reason]++
+	s.mu.Unlock()
+}
+
+// Stats returns a snapshot of the proxy counters.
+func (p *Proxy) Stats() Stats {
+	st := Stats{
+		Requests:  atomic.LoadUint64(&p.stats.requests),
+		InFlight:  atomic.LoadInt64(&p.stats.inFlight),
+		BytesSent: atomic.LoadUint64(&p.stats.bytesSent),
+	}
+
+	p.stats.mu.Lock()
+	st.Blocked = make(map[string]uint64, len(p.stats.blocked))
+	for reason, n := range p.stats.blocked {
+		st.Blocked[reason] = n
+	}
+	p.stats.mu.Unlock()
+
+	if p.negativeCache != nil {
+		st.NegativeCache = p.negativeCache.stats()
+	}
+	if p.blockCache != nil {
+		st.BlockCache = p.blockCache.stats()
+	}
+	return st
+}
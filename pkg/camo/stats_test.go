@@ -0,0 +1,68 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken.png" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("12345")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.NegativeCacheTTL = time.Minute
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+
+	for _, u := range []string{
+		ts.URL + "/image.png",
+		ts.URL + "/image.png",
+		"ftp://example.com/image.png",
+		ts.URL + "/broken.png",
+		ts.URL + "/broken.png",
+	} {
+		req, err := makeReq(c, u)
+		assert.Nil(t, err)
+		camoServer.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	st := camoServer.Stats()
+	assert.Equal(t, uint64(5), st.Requests)
+	assert.Equal(t, int64(0), st.InFlight)
+	assert.Equal(t, uint64(10), st.BytesSent)
+	assert.Equal(t, map[string]uint64{"Bad url scheme": 1}, st.Blocked)
+	if assert.NotNil(t, st.NegativeCache) {
+		assert.Equal(t, 1, st.NegativeCache.Entries)
+		assert.Equal(t, uint64(1), st.NegativeCache.Hits)
+	}
+	assert.Nil(t, st.BlockCache)
+
+	// json field names
+	b, err := json.Marshal(st)
+	assert.Nil(t, err)
+	var fields map[string]interface{}
+	assert.Nil(t, json.Unmarshal(b, &fields))
+	for _, k := range []string{"requests", "in_flight", "bytes_sent", "blocked", "negative_cache"} {
+		assert.Contains(t, fields, k)
+	}
+	assert.NotContains(t, fields, "block_cache")
+}
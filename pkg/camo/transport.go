@@ -0,0 +1,270 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// upstream is the client used for origin fetches, and its tcp transport.
+type upstream struct {
+	client *http.Client
+	tr     *http.Transport
+	// parent camo instance to fetch through, using a copy of tr. nil when
+	// not configured.
+	parent *parentCamo
+}
+
+// upstreamConnectTimeout returns the configured connect timeout, or the
+// default.
+func upstreamConnectTimeout(pc Config) time.Duration {
+	if pc.ConnectTimeout > 0 {
+		return pc.ConnectTimeout
+	}
+	return 3 * time.Second
+}
+
+// newUpstreamTransport builds the round tripper for origin fetches from the
+// transport settings of pc. The tcp transport it wraps, and its tls handshake
+// limiter, are also returned.
+func newUpstreamTransport(pc Config) (http.RoundTripper, *http.Transport, *handshakeLimiter, error) {
+	doFiltering := !pc.noIPFiltering
+
+	connectTimeout := upstreamConnectTimeout(pc)
+	tlsHandshakeTimeout := 3 * time.Second
+	if pc.TLSHandshakeTimeout > 0 {
+		tlsHandshakeTimeout = pc.TLSHandshakeTimeout
+	}
+
+	dailer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+		// Move ip filtering to dial.control, this avoids cases where
+		// an adversary may return an unblocked ip on name resolution
+		// the first time, and a blocked ip the second time.
+		// if the server's resolver has no caching, or hits an unlucky ttl expiry,
+		// an ip check in checkURL may pass (unblocked ip), then the bad ip may
+		// be connected to (re-resolve in dailer).
+		// Moving the ip filtering here avoids that.
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			// reject not tcp/tcp6 connection attempts
+			if !(network == "tcp4" || network == "tcp6") {
+				return fmt.Errorf("%s is not a safe network type: %w", network, ErrInvalidNetType)
+			}
+
+			// always reject (and log) cloud metadata addresses, which
+			// may be reached through dns rebinding even if the url (or
+			// redirect) host looked safe.
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				if ip := net.ParseIP(host); ip != nil && isMetadataIP(ip) {
+					logMetadataBlock(ip, address, pc.CollectMetrics)
+					return ErrRejectIP
+				}
+			}
+
+			// ip/allow-list/deny-list filtering
+			if doFiltering {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return fmt.Errorf("%s:%s is not a valid host/port pair: %w", address, err, ErrInvalidHostPort)
+				}
+
+				// filter out rejected networks
+				if ip := net.ParseIP(host); ip != nil {
+					if isRejectedIP(ip) {
+						return ErrRejectIP
+					}
+				} else {
+					if ips, err := net.LookupIP(host); err == nil {
+						for _, ip := range ips {
+							if isRejectedIP(ip) {
+								return ErrRejectIP
+							}
+						}
+					}
+				}
+			}
+			return nil
+		},
+	}
+
+	// HTTP/3 connections are dialed outside of dailer, so get the same
+	// filtering, egress ips, and resolver separately.
+	h3Dialer := http3Dialer{
+		rejectIP: func(ip net.IP) bool {
+			if isMetadataIP(ip) {
+				logMetadataBlock(ip, ip.String(), pc.CollectMetrics)
+				return true
+			}
+			return doFiltering && isRejectedIP(ip)
+		},
+	}
+
+	dialContext := dailer.DialContext
+	if len(pc.EgressIPs) > 0 {
+		egress, err := newEgressDialer(dailer, pc.EgressIPs)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		dialContext = egress.DialContext
+		h3Dialer.localIP = func(ip net.IP) net.IP {
+			if addr := egress.nextAddr(ip); addr != nil {
+				return addr.IP
+			}
+			return nil
+		}
+	}
+
+	if pc.DoHEndpoint != "" {
+		resolver, err := newDoHResolver(pc.DoHEndpoint)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		dialContext = resolvingDialContext(resolver, pc.DoHFallback, dialContext)
+		h3Dialer.lookupIP = resolver.lookupWithFallback(pc.DoHFallback)
+	}
+
+	tlsConfig, err := upstreamTLSConfig(pc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tr := &http.Transport{
+		// responses are scanned for ambiguous framing on the raw
+		// connection. https connections are dialed (and scanned) above the
+		// tls layer.
+		DialContext:     framingDial(dialContext),
+		TLSClientConfig: tlsConfig,
+		// a custom dialer or tls config otherwise disables http2
+		ForceAttemptHTTP2: true,
+
+		// Use proxy from environment
+		// It uses HTTP proxies as directed by the $HTTP_PROXY and $NO_PROXY
+		// (or $http_proxy and $no_poxy) environment variables.
+		//
+		// Also Note: This is invoked as a once.Do deep in go http client, and
+		// reified, to avoid constant overhead. Nice.
+		Proxy: http.ProxyFromEnvironment,
+
+		// max idle conns. Go DetaultTransport uses 100, which seems like a
+		// fairly reasonable number. Very busy servers may wish to raise
+		// or lower this value.
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 8,
+
+		// more defaults from DefaultTransport, with a few tweaks
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: pc.ResponseHeaderTimeout,
+		// outgoing requests never have a body, so an Expect header is never
+		// sent. Interim `100 Continue` responses some origins send anyway are
+		// consumed by the transport, and are never treated as the final
+		// response.
+		ExpectContinueTimeout: 1 * time.Second,
+
+		DisableKeepAlives: pc.DisableKeepAlivesBE,
+		// no need for compression with images
+		// some xml/svg can be compressed, but apparently some clients can
+		// exhibit weird behavior when those are compressed
+		DisableCompression: true,
+	}
+
+	hl := newHandshakeLimiter(dialContext, tlsConfig, tlsHandshakeTimeout, pc.MaxConcurrentHandshakes)
+	tr.DialTLSContext = framingDialTLS(hl.DialTLSContext)
+
+	var transport http.RoundTripper = &framingTransport{next: tr}
+	if pc.EnableHTTP3 {
+		if newHTTP3RoundTripper == nil {
+			return nil, nil, nil, ErrHTTP3Unsupported
+		}
+		transport = newAltSvcTransport(transport, newHTTP3RoundTripper(h3Dialer, tlsConfig))
+	}
+
+	creds, err := parseOriginBasicAuth(pc.OriginBasicAuth)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if creds != nil {
+		transport = &basicAuthTransport{next: transport, creds: creds}
+	}
+
+	redirectBodySize := int64(DefaultMaxRedirectBodySize)
+	if pc.MaxRedirectBodySize > 0 {
+		redirectBodySize = pc.MaxRedirectBodySize
+	}
+	redirectBodyTimeout := DefaultRedirectBodyTimeout
+	if pc.RedirectBodyTimeout > 0 {
+		redirectBodyTimeout = pc.RedirectBodyTimeout
+	}
+	transport = &redirectBodyTransport{
+		next:    transport,
+		maxSize: redirectBodySize,
+		timeout: redirectBodyTimeout,
+	}
+
+	maxLocationLength := DefaultMaxLocationLength
+	if pc.MaxLocationLength > 0 {
+		maxLocationLength = pc.MaxLocationLength
+	}
+	transport = &locationLimitTransport{next: transport, maxLen: maxLocationLength}
+
+	return transport, tr, hl, nil
+}
+
+// upstreamClient returns the current client for origin fetches.
+func (p *Proxy) upstreamClient() *http.Client {
+	return p.upstream.Load().(*upstream).client
+}
+
+// ReloadTransport rebuilds the upstream transport from the transport settings
+// of pc (connect, tls handshake, and response header timeouts, backend
+// keep-alives, egress ips, dns over https, the handshake limit, http3, the
+// max location length, the redirect body limits, origin basic auth
+// credentials, and the upstream tls files), and atomically swaps it in,
+// along with the parent camo client built on it. Other settings (including
+// the parent camo url and key), and ip filtering, are not changed.
+//
+// The proxy's Config is not updated. The settings from pc only apply to the
+// rebuilt transport, so passing the Config given to New (as go-camo does on
+// SIGHUP) only reloads the upstream tls files.
+//
+// In-flight requests finish on the old transport. Its idle connections (and
+// those of the old parent camo client) are closed, so no connection made
+// with stale settings is reused.
+func (p *Proxy) ReloadTransport(pc Config) error {
+	pc.noIPFiltering = p.config.noIPFiltering
+	pc.CollectMetrics = p.config.CollectMetrics
+	transport, tr, hl, err := newUpstreamTransport(pc)
+	if err != nil {
+		return err
+	}
+
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	old := p.upstream.Load().(*upstream)
+	cur := &upstream{
+		client: &http.Client{
+			Transport:     transport,
+			CheckRedirect: old.client.CheckRedirect,
+		},
+		tr: tr,
+	}
+	if old.parent != nil {
+		cur.parent, err = newParentCamo(old.parent.base, old.parent.key, tr, hl, upstreamConnectTimeout(pc))
+		if err != nil {
+			return err
+		}
+	}
+	p.upstream.Store(cur)
+	old.tr.CloseIdleConnections()
+	if old.parent != nil {
+		old.parent.client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadTransport(t *testing.T) {
+	t.Parallel()
+
+	var opened, closed int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&opened, 1)
+		case http.StateClosed:
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.ResponseHeaderTimeout = time.Second
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+
+	fetch := func() {
+		req, err := makeReq(c, ts.URL+"/image.png")
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		assert.Equal(t, 200, record.Code)
+	}
+
+	// the connection is kept alive, and reused
+	fetch()
+	fetch()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&opened))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&closed))
+
+	old := camoServer.upstream.Load().(*upstream)
+	c.ResponseHeaderTimeout = 5 * time.Second
+	err = camoServer.ReloadTransport(c)
+	assert.Nil(t, err)
+
+	cur := camoServer.upstream.Load().(*upstream)
+	assert.True(t, old.tr != cur.tr)
+	assert.Equal(t, 5*time.Second, cur.tr.ResponseHeaderTimeout)
+	assert.Equal(t, time.Second, old.tr.ResponseHeaderTimeout)
+	assert.NotNil(t, cur.client.CheckRedirect)
+
+	// the old idle connection is closed
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&closed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&closed))
+
+	// and fetches use a new connection
+	fetch()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&opened))
+
+	// invalid settings leave the current transport in place
+	c.UpstreamClientCert = "missing.crt"
+	err = camoServer.ReloadTransport(c)
+	assert.NotNil(t, err)
+	assert.True(t, cur == camoServer.upstream.Load().(*upstream))
+}
+
+func TestReloadTransportTLSFiles(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "go-camo-reload")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	// start out trusting an unrelated certificate
+	_, _, other := writeClientCert(t, dir)
+	rootCAs := filepath.Join(dir, "roots.pem")
+	err = ioutil.WriteFile(rootCAs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Raw}), 0600)
+	assert.Nil(t, err)
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.UpstreamRootCAs = rootCAs
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+
+	fetch := func() int {
+		req, err := makeReq(c, ts.URL+"/image.png")
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		return record.Code
+	}
+	assert.Equal(t, 404, fetch())
+
+	// reloading with the same config (as on SIGHUP) re-reads the files
+	err = ioutil.WriteFile(rootCAs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	assert.Nil(t, err)
+	err = camoServer.ReloadTransport(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, fetch())
+}
+
+func TestReloadTransportParent(t *testing.T) {
+	t.Parallel()
+
+	var opened, closed int32
+	parent := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("from parent")) // #nosec G104
+	}))
+	parent.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&opened, 1)
+		case http.StateClosed:
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	parent.Start()
+	defer parent.Close()
+
+	c := camoConfig
+	c.ParentCamoURL = parent.URL
+	c.ParentCamoKey = []byte("parent-camo-test-key")
+	c.ResponseHeaderTimeout = time.Second
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+
+	fetch := func() {
+		req, err := makeReq(c, "http://origin.invalid/image.png")
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		assert.Equal(t, 200, record.Code)
+		assert.Equal(t, "from parent", record.Body.String())
+	}
+	fetch()
+
+	old := camoServer.upstream.Load().(*upstream)
+	c.ResponseHeaderTimeout = 5 * time.Second
+	err = camoServer.ReloadTransport(c)
+	assert.Nil(t, err)
+
+	// the parent client is rebuilt on the new transport settings
+	cur := camoServer.upstream.Load().(*upstream)
+	if assert.NotNil(t, cur.parent) {
+		assert.True(t, old.parent != cur.parent)
+		assert.Equal(t, old.parent.base, cur.parent.base)
+		assert.Equal(t, 5*time.Second, cur.parent.client.Transport.(*framingTransport).next.(*http.Transport).ResponseHeaderTimeout)
+	}
+
+	// the old parent connection is closed, and fetches use a new one
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&closed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&closed))
+	fetch()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&opened))
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// upstreamTLSConfig returns the tls config for upstream connections, with the
+// configured client certificate and root CAs loaded. It returns nil when
+// neither is configured, so the transport defaults apply.
+func upstreamTLSConfig(pc Config) (*tls.Config, error) {
+	if pc.UpstreamClientCert == "" && pc.UpstreamClientKey == "" && pc.UpstreamRootCAs == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if pc.UpstreamClientCert != "" || pc.UpstreamClientKey != "" {
+		if pc.UpstreamClientCert == "" || pc.UpstreamClientKey == "" {
+			return nil, errors.New("upstream client cert and key must be configured together")
+		}
+		cert, err := tls.LoadX509KeyPair(pc.UpstreamClientCert, pc.UpstreamClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading upstream client cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if pc.UpstreamRootCAs != "" {
+		pem, err := ioutil.ReadFile(pc.UpstreamRootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("loading upstream root CAs: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream root CAs file %s", pc.UpstreamRootCAs)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeClientCert writes a self signed client certificate and key to dir,
+// returning their paths and the parsed certificate.
+func writeClientCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-camo"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	assert.Nil(t, err)
+	return certFile, keyFile, cert
+}
+
+func TestUpstreamClientCert(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "go-camo-mtls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, clientCert := writeClientCert(t, dir)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte{0x00, 0x01, 0x02, 0x03}) // #nosec G104
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	rootCAs := filepath.Join(dir, "roots.pem")
+	err = ioutil.WriteFile(rootCAs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	assert.Nil(t, err)
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.UpstreamRootCAs = rootCAs
+
+	// the origin refuses the handshake without a client cert
+	_, err = makeTestReq(ts.URL+"/image.png", 404, c)
+	assert.Nil(t, err)
+
+	c.UpstreamClientCert = certFile
+	c.UpstreamClientKey = keyFile
+	resp, err := makeTestReq(ts.URL+"/image.png", 200, c)
+	assert.Nil(t, err)
+	bodyAssert(t, "\x00\x01\x02\x03", resp)
+
+	// also presented on tls dials with a handshake limit
+	c.MaxConcurrentHandshakes = 1
+	_, err = makeTestReq(ts.URL+"/image.png", 200, c)
+	assert.Nil(t, err)
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "go-camo-mtls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, _ := writeClientCert(t, dir)
+
+	cfg, err := upstreamTLSConfig(Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, cfg)
+
+	cfg, err = upstreamTLSConfig(Config{UpstreamClientCert: certFile, UpstreamClientKey: keyFile})
+	assert.Nil(t, err)
+	assert.Len(t, cfg.Certificates, 1)
+
+	var tests = []struct {
+		name string
+		pc   Config
+	}{
+		{"cert without key", Config{UpstreamClientCert: certFile}},
+		{"key without cert", Config{UpstreamClientKey: keyFile}},
+		{"mismatched pair", Config{UpstreamClientCert: keyFile, UpstreamClientKey: certFile}},
+		{"missing roots", Config{UpstreamRootCAs: filepath.Join(dir, "missing.pem")}},
+		{"roots without certs", Config{UpstreamRootCAs: keyFile}},
+	}
+	for _, tt := range tests {
+		_, err := upstreamTLSConfig(tt.pc)
+		assert.NotNil(t, err, tt.name)
+	}
+}
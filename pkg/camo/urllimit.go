@@ -0,0 +1,85 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// urlLimiter caps the number of concurrent in-flight requests per url.
+type urlLimiter struct {
+	max int
+
+	mu sync.Mutex
+	// url -> slots, for urls with requests in flight (or waiting)
+	urls map[string]*urlSlots
+}
+
+type urlSlots struct {
+	sem chan struct{}
+	// in-flight plus waiting requests, so idle entries can be dropped
+	refs int
+}
+
+func newURLLimiter(max int) *urlLimiter {
+	return &urlLimiter{
+		max:  max,
+		urls: make(map[string]*urlSlots),
+	}
+}
+
+// acquire takes one of the in-flight slots for key. If none are free, it
+// waits up to wait (or until ctx is done) for one, returning false if it
+// did not get a slot. Each successful acquire must be paired with a release.
+func (l *urlLimiter) acquire(ctx context.Context, key string, wait time.Duration) bool {
+	l.mu.Lock()
+	s, ok := l.urls[key]
+	if !ok {
+		s = &urlSlots{sem: make(chan struct{}, l.max)}
+		l.urls[key] = s
+	}
+	s.refs++
+	l.mu.Unlock()
+
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case s.sem <- struct{}{}:
+			return true
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	l.mu.Lock()
+	l.unref(key, s)
+	l.mu.Unlock()
+	return false
+}
+
+func (l *urlLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.urls[key]
+	<-s.sem
+	l.unref(key, s)
+}
+
+// unref drops a reference to s, removing it once unused. l.mu must be held.
+func (l *urlLimiter) unref(key string, s *urlSlots) {
+	s.refs--
+	if s.refs == 0 {
+		delete(l.urls, key)
+	}
+}
@@ -6,18 +6,145 @@ package camo
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/cactus/go-camo/pkg/htrie"
 )
 
 var (
-	ErrRedirect        = errors.New("bad redirect")
-	ErrDenyList        = errors.New("denylist host failure")
-	ErrRejectIP        = errors.New("ip rejection")
-	ErrInvalidHostPort = errors.New("invalid host/port")
-	ErrInvalidNetType  = errors.New("invalid network type")
+	ErrRedirect             = errors.New("bad redirect")
+	ErrDenyList             = errors.New("denylist host failure")
+	ErrRejectIP             = errors.New("ip rejection")
+	ErrInvalidHostPort      = errors.New("invalid host/port")
+	ErrInvalidNetType       = errors.New("invalid network type")
+	ErrNoEgressIP           = errors.New("no egress ip for address family")
+	ErrCompressionBomb      = errors.New("decompression limit exceeded")
+	ErrBadEncoding          = errors.New("unsupported or invalid content-encoding")
+	ErrLocationTooLong      = errors.New("location header too long")
+	ErrAmbiguousFraming     = errors.New("ambiguous response framing")
+	ErrReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
 )
 
+// ErrTooManyRedirects is returned (wrapped) when Config.MaxRedirects is
+// exceeded. It wraps ErrRedirect.
+var ErrTooManyRedirects = fmt.Errorf("too many redirects: %w", ErrRedirect)
+
+// ErrSelfRedirect is returned (wrapped) when an origin redirects to one of
+// Config.SelfHosts. It wraps ErrRedirect.
+var ErrSelfRedirect = fmt.Errorf("redirect to self: %w", ErrRedirect)
+
+// ErrTooManyHostChanges is returned (wrapped) when Config.MaxHostChanges is
+// exceeded. It wraps ErrRedirect.
+var ErrTooManyHostChanges = fmt.Errorf("too many host changes: %w", ErrRedirect)
+
+// reason codes sent in the X-Camo-Reason header of rejected responses
+const (
+	reasonContentTypeNotAllowed = "content-type-not-allowed"
+)
+
+// errLegalBlock is returned by checkURL for urls matching a legal rule.
+var errLegalBlock = errors.New("Unavailable For Legal Reasons")
+
+// errors returned by checkURL, for local hosts and filter rejections
+var (
+	errBadURLHost     = errors.New("Bad url host")
+	errFilterRejected = errors.New("Rejected due to filter-ruleset")
+)
+
+// Bounds and default for Config.CopyBufferSize.
+// note: 32 * 1024 is the size used by io.Copy by default.
+// Seems like a good starting point, just with a bit less garbage
+// (using a sync pool) to reduce some GC work.
+// ref: https://golang.org/src/io/io.go?s=13136:13214#L391
+const (
+	DefaultCopyBufferSize = 32 * 1024
+	MinCopyBufferSize     = 1024
+	MaxCopyBufferSize     = 1024 * 1024
+)
+
+// DefaultMaxEncodedBodySize is the maximum size of a content-encoded body
+// buffered for decompression checks, when Config.MaxSize is not set.
+const DefaultMaxEncodedBodySize = 10 * 1024 * 1024
+
+// DefaultMaxLocationLength is the default for Config.MaxLocationLength.
+const DefaultMaxLocationLength = 8 * 1024
+
+// Defaults for Config.MaxRedirectBodySize and Config.RedirectBodyTimeout.
+// note: the http client itself never drains more than 2KiB of a redirect
+// body.
+const (
+	DefaultMaxRedirectBodySize = 2 * 1024
+	DefaultRedirectBodyTimeout = 1 * time.Second
+)
+
+// DefaultClientBandwidthWindow is the default for
+// Config.ClientBandwidthWindow.
+const DefaultClientBandwidthWindow = 1 * time.Minute
+
+// maximum Config.MinResponseBytes. unknown length bodies are buffered up to
+// this size to check them.
+const maxMinResponseBytes = 64 * 1024
+
+// Retry-After value (in seconds) of responses in maintenance mode.
+const maintenanceRetryAfter = "60"
+
+// MaxPerHostTimeout is the maximum value of a Config.PerHostTimeouts or
+// Config.CategoryTimeouts entry.
+const MaxPerHostTimeout = 2 * time.Minute
+
+// DefaultRulesRefreshInterval is the default interval between refreshes of
+// Config.RulesURL.
+const DefaultRulesRefreshInterval = 5 * time.Minute
+
+// MaxRulesSize is the maximum size (in bytes) of a remote ruleset.
+const MaxRulesSize = 10 * 1024 * 1024
+
+// timeout for fetching a remote ruleset
+const rulesFetchTimeout = 30 * time.Second
+
+// MaxBlockCacheTTL is the maximum value of Config.BlockCacheTTL. Block
+// decisions follow dns, so they are only cached briefly.
+const MaxBlockCacheTTL = 30 * time.Second
+
+// DefaultClientKeepAlive is the default for Config.ClientKeepAlive.
+const DefaultClientKeepAlive = 30 * time.Second
+
+// mjpegMediaType is the media type of MJPEG streams, allowed by
+// Config.AllowMJPEG.
+const mjpegMediaType = "multipart/x-mixed-replace"
+
+// MaxBlockResponseJitter is the upper limit for Config.BlockResponseJitter.
+const MaxBlockResponseJitter = 1 * time.Second
+
+// Retry delays, used when retrying 429 and 503 upstream responses.
+// RetryBaseDelay is the initial backoff when no Retry-After is sent (doubled
+// each attempt), and MaxRetryDelay caps any single delay when
+// Config.RequestTimeout is unset.
+const (
+	RetryBaseDelay = 100 * time.Millisecond
+	MaxRetryDelay  = 5 * time.Second
+)
+
+// stealthPixel is a 1x1 transparent gif, used as the response body for
+// stealth block responses.
+var stealthPixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x21, 0xf9, 0x04, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00,
+	0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// selfTestImage is a 1x1 png, served for Config.SelfTestImagePath.
+var selfTestImage = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d,
+	0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+	0x08, 0x02, 0x00, 0x00, 0x00, 0x90, 0x77, 0x53, 0xde, 0x00, 0x00, 0x00,
+	0x0c, 0x49, 0x44, 0x41, 0x54, 0x78, 0x9c, 0x63, 0xd0, 0x9a, 0xeb, 0x01,
+	0x00, 0x02, 0x04, 0x01, 0x10, 0x48, 0x37, 0x44, 0xdf, 0x00, 0x00, 0x00,
+	0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
+
 // ValidReqHeaders are http request headers that are acceptable to pass from
 // the client to the remote server. Only those present and true, are forwarded.
 // Empty implies no filtering.
@@ -76,12 +203,19 @@ var rejectIPv6Networks = mustParseNetmasks(
 	[]string{
 		// unspecified address
 		"::/128",
+		// ipv4 compatible (deprecated, rfc4291)
+		"::/96",
 		// ipv6 loopback
 		"::1/128",
 		// ipv4 mapped onto ipv6
 		"::ffff:0:0/96",
 		// discard prefix
 		"100::/64",
+		// local use nat64 (rfc8215). the ipv4 address embedding depends on
+		// the local prefix length, so the whole block is rejected.
+		"64:ff9b:1::/48",
+		// teredo tunneling
+		"2001::/32",
 		// addresses reserved for documentation and example code rfc3849
 		"2001:db8::/32",
 		// ipv6 ULA. Encompasses rfc4193 (fd00::/8)
@@ -95,6 +229,31 @@ var rejectIPv6Networks = mustParseNetmasks(
 	},
 )
 
+// ipv6 networks embedding an ipv4 address, which may be routed to it. see
+// embeddedIPv4.
+var (
+	// well known nat64 prefix (rfc6052)
+	nat64Network = mustParseNetmask("64:ff9b::/96")
+	// 6to4 (rfc3056)
+	sixToFourNetwork = mustParseNetmask("2002::/16")
+)
+
+// well known cloud metadata service addresses. most are also covered by the
+// reject networks above, but these are always rejected (even when ip
+// filtering is disabled), and attempts to reach them are logged and counted.
+var metadataIPs = mustParseIPs(
+	[]string{
+		// aws, gcp, azure, digitalocean, openstack, and others
+		"169.254.169.254",
+		// aws imds ipv6
+		"fd00:ec2::254",
+		// aws ecs task metadata
+		"169.254.170.2",
+		// alibaba cloud
+		"100.100.100.200",
+	},
+)
+
 // match for localhost, localdomain
 var localsFilter = htrie.MustNewURLMatcherWithRules(
 	[]string{
@@ -0,0 +1,84 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// varyHeader accumulates the names of request headers that influenced a
+// response, so a single aggregated Vary header can be set once, no matter
+// how many features contributed.
+type varyHeader struct {
+	names []string
+	seen  map[string]bool
+	star  bool
+}
+
+// Add adds request header names. Names are canonicalized and de-duplicated.
+// A `*` value supersedes any names.
+func (v *varyHeader) Add(names ...string) {
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "*":
+			v.star = true
+			continue
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if v.seen == nil {
+			v.seen = make(map[string]bool)
+		}
+		if v.seen[name] {
+			continue
+		}
+		v.seen[name] = true
+		v.names = append(v.names, name)
+	}
+}
+
+// AddUpstream adds the names from upstream Vary header values, keeping only
+// request headers for which forwarded returns true. Headers not forwarded
+// from the client can not have influenced the response.
+func (v *varyHeader) AddUpstream(values []string, forwarded func(string) bool) {
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || forwarded(textproto.CanonicalMIMEHeaderKey(name)) {
+				v.Add(name)
+			}
+		}
+	}
+}
+
+// String returns the aggregated Vary header value.
+func (v *varyHeader) String() string {
+	if v.star {
+		return "*"
+	}
+	return strings.Join(v.names, ", ")
+}
+
+// Set sets the aggregated Vary header on h, replacing any existing value.
+// Nothing is set if no names were added.
+func (v *varyHeader) Set(h http.Header) {
+	if value := v.String(); value != "" {
+		h.Set("Vary", value)
+	}
+}
+
+// forwardedReqHeader returns true if the (canonical) request header is
+// passed from the client to the upstream server unmodified.
+func (p *Proxy) forwardedReqHeader(name string) bool {
+	// accept is always replaced with the configured accept types
+	if name == "Accept" {
+		return false
+	}
+	return p.reqHeaders[name]
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package camo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaryHeader(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		name     string
+		adds     [][]string
+		upstream []string
+		expected string
+	}{
+		{"empty", nil, nil, ""},
+		{"single", [][]string{{"Save-Data"}}, nil, "Save-Data"},
+		{
+			"multiple features, canonicalized and deduplicated",
+			[][]string{{"save-data", "Accept"}, {"Accept", "DPR"}},
+			nil,
+			"Save-Data, Accept, Dpr",
+		},
+		{
+			"upstream filtered to forwarded headers",
+			[][]string{{"Save-Data"}},
+			[]string{"accept-language, Cookie", "Accept-Encoding, Accept, save-data"},
+			"Save-Data, Accept-Language",
+		},
+		{"star supersedes", [][]string{{"Save-Data"}}, []string{"*"}, "*"},
+	}
+
+	p := &Proxy{reqHeaders: ValidReqHeaders}
+	for _, tt := range tests {
+		var vary varyHeader
+		for _, names := range tt.adds {
+			vary.Add(names...)
+		}
+		vary.AddUpstream(tt.upstream, p.forwardedReqHeader)
+
+		h := http.Header{}
+		h.Set("Vary", "stale")
+		vary.Set(h)
+		if tt.expected == "" {
+			assert.Equal(t, "stale", h.Get("Vary"), tt.name)
+		} else {
+			assert.Equal(t, []string{tt.expected}, h["Vary"], tt.name)
+		}
+	}
+}
+
+func TestVaryRelayed(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Language, Cookie")
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("Etag", `"abc"`)
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			w.WriteHeader(304)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+
+	resp, err := makeTestReq(ts.URL+"/image.png", 200, c)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"Accept-Language"}, resp.Header["Vary"])
+	}
+
+	req, err := makeReq(c, ts.URL+"/image.png")
+	assert.Nil(t, err)
+	req.Header.Set("If-None-Match", `"abc"`)
+	resp, err = processRequest(req, 304, c, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"Accept-Language"}, resp.Header["Vary"])
+	}
+}
+
+func TestDefaultAcceptLanguage(t *testing.T) {
+	t.Parallel()
+
+	langs := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		langs <- r.Header.Get("Accept-Language")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("ok")) // #nosec G104
+	}))
+	defer ts.Close()
+
+	c := camoConfig
+	c.noIPFiltering = true
+	c.DefaultAcceptLanguage = "de-DE,de;q=0.9"
+	camoServer, err := New(c)
+	assert.Nil(t, err)
+
+	// configured default sent when the client sends none
+	req, err := makeReq(c, ts.URL+"/image.png")
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	camoServer.ServeHTTP(record, req)
+	assert.Equal(t, http.StatusOK, record.Code)
+	assert.Equal(t, "de-DE,de;q=0.9", <-langs)
+	assert.Equal(t, "Accept-Language", record.Header().Get("Vary"))
+
+	// client value takes precedence
+	req, err = makeReq(c, ts.URL+"/image.png")
+	assert.Nil(t, err)
+	req.Header.Set("Accept-Language", "fr")
+	record = httptest.NewRecorder()
+	camoServer.ServeHTTP(record, req)
+	assert.Equal(t, http.StatusOK, record.Code)
+	assert.Equal(t, "fr", <-langs)
+	assert.Equal(t, "Accept-Language", record.Header().Get("Vary"))
+
+	// invalid values are rejected
+	c.DefaultAcceptLanguage = "en\r\nX-Injected: 1"
+	_, err = New(c)
+	assert.NotNil(t, err)
+}
@@ -16,6 +16,8 @@ type GlobPathChecker struct {
 	csNode *globPathNode
 	// case insensitive checker
 	ciNode *globPathNode
+	// whether rules without a case flag are case insensitive
+	defaultICase bool
 }
 
 func (gpc *GlobPathChecker) parseRule(rule string) (string, string, error) {
@@ -56,6 +58,10 @@ func (gpc *GlobPathChecker) parseRule(rule string) (string, string, error) {
 // Allowed flags:
 //
 // * `i`: URL match string should be matched case insensitively
+// * `c`: URL match string should be matched case sensitively
+//
+// Rules with neither flag use the checker default, which is case sensitive
+// unless the checker was created with NewGlobPathCheckerICase.
 func (gpc *GlobPathChecker) AddRule(rule string) error {
 	// expected format: |i|/some/subdir/*
 	if gpc == nil {
@@ -67,9 +73,18 @@ func (gpc *GlobPathChecker) AddRule(rule string) error {
 		return err
 	}
 
-	icase := false
-	if strings.Contains(urlRuleFlags, "i") {
+	hasI := strings.Contains(urlRuleFlags, "i")
+	hasC := strings.Contains(urlRuleFlags, "c")
+	if hasI && hasC {
+		return fmt.Errorf("bad rule format: conflicting case flags: %s", rule)
+	}
+
+	icase := gpc.defaultICase
+	switch {
+	case hasI:
 		icase = true
+	case hasC:
+		icase = false
 	}
 
 	if strings.ContainsAny(urlRuleMatch, "?#") {
@@ -155,3 +170,10 @@ func (gpc *GlobPathChecker) CheckPath(url string) bool {
 func NewGlobPathChecker() *GlobPathChecker {
 	return &GlobPathChecker{}
 }
+
+// NewGlobPathCheckerICase returns a new GlobPathChecker, where rules are
+// matched case insensitively by default. Individual rules may still opt in to
+// case sensitive matching with the `c` flag.
+func NewGlobPathCheckerICase() *GlobPathChecker {
+	return &GlobPathChecker{defaultICase: true}
+}
@@ -116,6 +116,83 @@ func TestGlobPathCheckerPathsMisc(t *testing.T) {
 	}
 }
 
+func TestGlobPathCheckerMixedCase(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		checker *GlobPathChecker
+		rules   []string
+		match   []string
+		noMatch []string
+	}{
+		// case sensitive by default
+		{
+			NewGlobPathChecker(),
+			[]string{"|i|/Images/*", "||/Photos/*", "|c|/Videos/*"},
+			[]string{"/images/a.png", "/IMAGES/a.png", "/Photos/a.png", "/Videos/a.mp4"},
+			[]string{"/photos/a.png", "/PHOTOS/a.png", "/videos/a.mp4"},
+		},
+		// case insensitive by default
+		{
+			NewGlobPathCheckerICase(),
+			[]string{"|i|/Images/*", "||/Photos/*", "|c|/Videos/*"},
+			[]string{"/images/a.png", "/IMAGES/a.png", "/photos/a.png", "/PHOTOS/a.png", "/Videos/a.mp4"},
+			[]string{"/videos/a.mp4", "/VIDEOS/a.mp4"},
+		},
+		// overlapping case sensitive and insensitive rules
+		{
+			NewGlobPathChecker(),
+			[]string{"|i|/foo/*.PNG", "||/foo/Bar*"},
+			[]string{"/foo/x.png", "/FOO/x.Png", "/foo/Bar1", "/foo/Barbell"},
+			[]string{"/foo/bar1", "/FOO/Bar1", "/foo/x.gif"},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, rule := range tt.rules {
+			assert.Nil(t, tt.checker.AddRule(rule))
+		}
+		for _, u := range tt.match {
+			assert.True(t, tt.checker.CheckPath(u), fmt.Sprintf("should have matched: %s", u))
+		}
+		for _, u := range tt.noMatch {
+			assert.False(t, tt.checker.CheckPath(u), fmt.Sprintf("should NOT have matched: %s", u))
+		}
+	}
+
+	// conflicting flags
+	assert.NotNil(t, NewGlobPathChecker().AddRule("|ic|/foo"))
+}
+
+func TestURLMatcherMixedCase(t *testing.T) {
+	t.Parallel()
+
+	// host rules are always case insensitive, path rules per rule
+	dt := MustNewURLMatcherWithRules([]string{
+		"||Example.COM||/CaseSensitive/*",
+		"||example.com|i|/CaseInsensitive/*",
+	})
+
+	testMatch := []string{
+		"http://EXAMPLE.com/CaseSensitive/a.png",
+		"http://example.com/caseinsensitive/a.png",
+		"http://example.COM/CASEINSENSITIVE/a.png",
+	}
+	testNoMatch := []string{
+		"http://example.com/casesensitive/a.png",
+		"http://EXAMPLE.com/CASESENSITIVE/a.png",
+	}
+
+	for _, s := range testMatch {
+		u, _ := url.Parse(s)
+		assert.True(t, dt.CheckURL(u), fmt.Sprintf("should have matched: %s", u))
+	}
+	for _, s := range testNoMatch {
+		u, _ := url.Parse(s)
+		assert.False(t, dt.CheckURL(u), fmt.Sprintf("should NOT have matched: %s", u))
+	}
+}
+
 func BenchmarkGlobPathChecker(b *testing.B) {
 	rules := []string{
 		"|i|*/test.png",
@@ -29,6 +29,15 @@ type URLMatcher struct {
 	hasWildChild bool
 	canMatch     bool
 	hasRules     bool
+	// scheme scoped rules, keyed by lowercase scheme. only set on the root
+	// node.
+	schemes map[string]*URLMatcher
+}
+
+// schemes allowed in a scheme scoped domain match rule
+var ruleSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
 }
 
 var matchesPool = sync.Pool{
@@ -133,6 +142,28 @@ func (dt *URLMatcher) AddRule(rule string) error {
 		return err
 	}
 
+	// a scheme prefixed domain match rule (eg. `https://example.com`) is
+	// added to a separate tree, only consulted for urls with that scheme.
+	if i := strings.Index(ruleParts[1], "://"); i >= 0 {
+		scheme := strings.ToLower(strings.TrimSpace(ruleParts[1][:i]))
+		if !ruleSchemes[scheme] {
+			return fmt.Errorf("bad domain format: unsupported scheme %q", scheme)
+		}
+		ruleParts[1] = ruleParts[1][i+3:]
+		if dt.schemes == nil {
+			dt.schemes = make(map[string]*URLMatcher)
+		}
+		sdt, ok := dt.schemes[scheme]
+		if !ok {
+			sdt = NewURLMatcher()
+			dt.schemes[scheme] = sdt
+		}
+		return sdt.addRuleParts(ruleParts)
+	}
+	return dt.addRuleParts(ruleParts)
+}
+
+func (dt *URLMatcher) addRuleParts(ruleParts []string) error {
 	var (
 		hostRuleFlags = ruleParts[0]
 		hostRuleMatch = ruleParts[1]
@@ -159,7 +190,7 @@ func (dt *URLMatcher) AddRule(rule string) error {
 		hostRuleMatch = hostRuleMatch[2:]
 	}
 
-	hostRuleMatch, err = idna.ToASCII(uniformLower(hostRuleMatch, "."))
+	hostRuleMatch, err := idna.ToASCII(uniformLower(hostRuleMatch, "."))
 	if err != nil {
 		return err
 	}
@@ -266,9 +297,20 @@ func (dt *URLMatcher) walkFind(s string) []*URLMatcher {
 // CheckURL checks a *url.URL against the URLMatcher.
 // If the url matches (a "hit"), it returns true.
 // If the url does not match (a "miss"), it return false.
+// Scheme scoped rules are only checked for urls with a matching scheme.
 func (dt *URLMatcher) CheckURL(u *url.URL) bool {
 	// alas, (*url.URL).Hostname() does not ToLower
 	hostname := strings.ToLower(u.Hostname())
+	if dt.checkURL(hostname, u) {
+		return true
+	}
+	if sdt, ok := dt.schemes[strings.ToLower(u.Scheme)]; ok {
+		return sdt.checkURL(hostname, u)
+	}
+	return false
+}
+
+func (dt *URLMatcher) checkURL(hostname string, u *url.URL) bool {
 	matches := dt.walkFind(hostname)
 	defer putURLMatcherSlice(&matches)
 
@@ -300,6 +342,7 @@ func (dt *URLMatcher) CheckURL(u *url.URL) bool {
 //
 //     strings.ToLower((*url.URL).Hostname())
 //
+// Scheme scoped rules are not consulted, as there is no scheme to match.
 func (dt *URLMatcher) CheckHostname(hostname string) bool {
 	hostname = strings.ToLower(hostname)
 	matches := dt.walkFind(hostname)
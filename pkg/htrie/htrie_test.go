@@ -106,6 +106,58 @@ func TestHTrieCheckHostname(t *testing.T) {
 	}
 }
 
+func TestHTrieCheckURLScheme(t *testing.T) {
+	t.Parallel()
+
+	rules := []string{
+		"||http://insecure.example.com||*",
+		"|s|HTTPS://example.org||/secure/*",
+		"||example.net||*",
+	}
+
+	testMatch := []string{
+		"http://insecure.example.com/foo/test.png",
+		"HTTP://insecure.example.com/foo/test.png",
+		"https://example.org/secure/test.png",
+		"https://sub.example.org/secure/test.png",
+		"http://example.net/test.png",
+		"https://example.net/test.png",
+	}
+
+	testNoMatch := []string{
+		"https://insecure.example.com/foo/test.png",
+		"http://example.org/secure/test.png",
+		"https://example.org/other/test.png",
+	}
+
+	dt := NewURLMatcher()
+	for _, rule := range rules {
+		err := dt.AddRule(rule)
+		assert.Nil(t, err)
+	}
+
+	for _, u := range testMatch {
+		u, _ := url.Parse(u)
+		assert.True(t, dt.CheckURL(u), fmt.Sprintf("should have matched: %s", u))
+	}
+	for _, u := range testNoMatch {
+		u, _ := url.Parse(u)
+		assert.False(t, dt.CheckURL(u), fmt.Sprintf("should not have matched: %s", u))
+	}
+
+	// scheme scoped rules do not apply to bare hostnames
+	assert.False(t, dt.CheckHostname("insecure.example.com"))
+	assert.True(t, dt.CheckHostname("example.net"))
+
+	for _, rule := range []string{
+		"||ftp://example.com||*",
+		"||://example.com||*",
+		"||https://||*",
+	} {
+		assert.NotNil(t, dt.AddRule(rule), "rule should have failed: %s", rule)
+	}
+}
+
 func BenchmarkHTrieCreate(b *testing.B) {
 	dt := NewURLMatcher()
 	urls := []string{
@@ -0,0 +1,434 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package htrie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// binary serialization format
+//
+// Each marshaled blob starts with a 3 byte magic value identifying the type
+// (`GPC` for GlobPathChecker, `URM` for URLMatcher), followed by a single
+// format version byte. Integers are encoded as uvarints, strings as a uvarint
+// length followed by the bytes. Trees are encoded depth first, with children
+// ordered by key. A URLMatcher root with scheme scoped rules is followed by
+// its per scheme trees, ordered by scheme.
+//
+// Version 2 added per scheme trees. Unknown node flags are rejected, so a
+// newer format is never silently misread.
+const binaryFormatVersion byte = 2
+
+// maxUnmarshalDepth limits tree depth when decoding, to guard against
+// malicious or corrupt input.
+const maxUnmarshalDepth = 16 * 1024
+
+var (
+	globPathCheckerMagic = []byte("GPC")
+	urlMatcherMagic      = []byte("URM")
+)
+
+const (
+	flagIsGlob byte = 1 << iota
+	flagCanMatch
+	flagHasGlobChild
+
+	globPathFlags = flagIsGlob | flagCanMatch | flagHasGlobChild
+)
+
+const (
+	flagIsWild byte = 1 << iota
+	flagHasWildChild
+	flagURLCanMatch
+	flagHasRules
+	flagHasPathChecker
+	flagHasSchemes
+
+	urlMatcherFlags = flagIsWild | flagHasWildChild | flagURLCanMatch |
+		flagHasRules | flagHasPathChecker | flagHasSchemes
+)
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	buf.Write(b[:n])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func writeHeader(buf *bytes.Buffer, magic []byte) {
+	buf.Write(magic)
+	buf.WriteByte(binaryFormatVersion)
+}
+
+func readHeader(r *bytes.Reader, magic []byte) error {
+	hdr := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return fmt.Errorf("bad binary format: short header")
+	}
+	if !bytes.Equal(hdr[:len(magic)], magic) {
+		return fmt.Errorf("bad binary format: unexpected type %q", hdr[:len(magic)])
+	}
+	if v := hdr[len(magic)]; v != binaryFormatVersion {
+		return fmt.Errorf("bad binary format: unsupported version %d", v)
+	}
+	return nil
+}
+
+func (gpn *globPathNode) marshal(buf *bytes.Buffer) {
+	writeUvarint(buf, uint64(gpn.nodeChar))
+	var flags byte
+	if gpn.isGlob {
+		flags |= flagIsGlob
+	}
+	if gpn.canMatch {
+		flags |= flagCanMatch
+	}
+	if gpn.hasGlobChild {
+		flags |= flagHasGlobChild
+	}
+	buf.WriteByte(flags)
+
+	keys := make([]int, 0, len(gpn.subtrees))
+	for k := range gpn.subtrees {
+		keys = append(keys, int(k))
+	}
+	sort.Ints(keys)
+
+	writeUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		writeUvarint(buf, uint64(k))
+		gpn.subtrees[uint32(k)].marshal(buf)
+	}
+}
+
+func unmarshalGlobPathNode(r *bytes.Reader, icase bool, depth int) (*globPathNode, error) {
+	if depth > maxUnmarshalDepth {
+		return nil, fmt.Errorf("tree too deep")
+	}
+
+	gpn := newGlobPathNode(icase)
+	nodeChar, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if nodeChar > 0xff {
+		return nil, fmt.Errorf("invalid node char")
+	}
+	gpn.nodeChar = uint32(nodeChar)
+
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if flags&^globPathFlags != 0 {
+		return nil, fmt.Errorf("unknown node flags %#x", flags)
+	}
+	gpn.isGlob = flags&flagIsGlob != 0
+	gpn.canMatch = flags&flagCanMatch != 0
+	gpn.hasGlobChild = flags&flagHasGlobChild != 0
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > 256 {
+		return nil, fmt.Errorf("too many children")
+	}
+	for i := uint64(0); i < count; i++ {
+		k, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if k > 0xff {
+			return nil, fmt.Errorf("invalid child key")
+		}
+		child, err := unmarshalGlobPathNode(r, icase, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		gpn.subtrees[uint32(k)] = child
+	}
+
+	// addPath maintains oneShot as the sole child, when there is only one
+	if len(gpn.subtrees) == 1 {
+		for _, v := range gpn.subtrees {
+			gpn.oneShot = v
+		}
+	}
+	return gpn, nil
+}
+
+func (gpc *GlobPathChecker) marshal(buf *bytes.Buffer) {
+	for _, node := range []*globPathNode{gpc.csNode, gpc.ciNode} {
+		if node == nil {
+			buf.WriteByte(0)
+			continue
+		}
+		buf.WriteByte(1)
+		node.marshal(buf)
+	}
+}
+
+func (gpc *GlobPathChecker) unmarshal(r *bytes.Reader) error {
+	nodes := make([]*globPathNode, 2)
+	for i, icase := range []bool{false, true} {
+		present, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if present == 0 {
+			continue
+		}
+		nodes[i], err = unmarshalGlobPathNode(r, icase, 0)
+		if err != nil {
+			return err
+		}
+	}
+	gpc.csNode, gpc.ciNode = nodes[0], nodes[1]
+	return nil
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+// The output is versioned, and can be loaded with UnmarshalBinary.
+func (gpc *GlobPathChecker) MarshalBinary() ([]byte, error) {
+	if gpc == nil {
+		return nil, fmt.Errorf("got nil <gpc> in receiver")
+	}
+	var buf bytes.Buffer
+	writeHeader(&buf, globPathCheckerMagic)
+	gpc.marshal(&buf)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface,
+// replacing any existing rules with those from data. The default case
+// sensitivity of the receiver (for subsequently added rules) is preserved.
+func (gpc *GlobPathChecker) UnmarshalBinary(data []byte) error {
+	if gpc == nil {
+		return fmt.Errorf("got nil <gpc> in receiver")
+	}
+	r := bytes.NewReader(data)
+	if err := readHeader(r, globPathCheckerMagic); err != nil {
+		return err
+	}
+	tmp := &GlobPathChecker{defaultICase: gpc.defaultICase}
+	if err := tmp.unmarshal(r); err != nil {
+		return fmt.Errorf("bad binary format: %s", err)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("bad binary format: trailing data")
+	}
+	*gpc = *tmp
+	return nil
+}
+
+func (dt *URLMatcher) marshal(buf *bytes.Buffer) error {
+	writeString(buf, dt.pathPart)
+
+	var flags byte
+	if dt.isWild {
+		flags |= flagIsWild
+	}
+	if dt.hasWildChild {
+		flags |= flagHasWildChild
+	}
+	if dt.canMatch {
+		flags |= flagURLCanMatch
+	}
+	if dt.hasRules {
+		flags |= flagHasRules
+	}
+	if len(dt.schemes) > 0 {
+		flags |= flagHasSchemes
+	}
+
+	var gpc *GlobPathChecker
+	if dt.pathChecker != nil {
+		var ok bool
+		gpc, ok = dt.pathChecker.(*GlobPathChecker)
+		if !ok {
+			return fmt.Errorf("unsupported path checker type %T", dt.pathChecker)
+		}
+		flags |= flagHasPathChecker
+	}
+	buf.WriteByte(flags)
+	if gpc != nil {
+		gpc.marshal(buf)
+	}
+
+	keys := make([]string, 0, len(dt.subtrees))
+	for k := range dt.subtrees {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writeUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		writeString(buf, k)
+		if err := dt.subtrees[k].marshal(buf); err != nil {
+			return err
+		}
+	}
+
+	if flags&flagHasSchemes == 0 {
+		return nil
+	}
+	schemes := make([]string, 0, len(dt.schemes))
+	for k := range dt.schemes {
+		schemes = append(schemes, k)
+	}
+	sort.Strings(schemes)
+
+	writeUvarint(buf, uint64(len(schemes)))
+	for _, k := range schemes {
+		writeString(buf, k)
+		if err := dt.schemes[k].marshal(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalURLMatcher(r *bytes.Reader, depth int) (*URLMatcher, error) {
+	if depth > maxUnmarshalDepth {
+		return nil, fmt.Errorf("tree too deep")
+	}
+
+	pathPart, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	dt := &URLMatcher{
+		subtrees: make(map[string]*URLMatcher),
+		pathPart: pathPart,
+	}
+
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if flags&^urlMatcherFlags != 0 {
+		return nil, fmt.Errorf("unknown node flags %#x", flags)
+	}
+	dt.isWild = flags&flagIsWild != 0
+	dt.hasWildChild = flags&flagHasWildChild != 0
+	dt.canMatch = flags&flagURLCanMatch != 0
+	dt.hasRules = flags&flagHasRules != 0
+
+	if flags&flagHasPathChecker != 0 {
+		gpc := NewGlobPathChecker()
+		if err := gpc.unmarshal(r); err != nil {
+			return nil, err
+		}
+		dt.pathChecker = gpc
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	for i := uint64(0); i < count; i++ {
+		k, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		child, err := unmarshalURLMatcher(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		dt.subtrees[k] = child
+	}
+
+	if flags&flagHasSchemes == 0 {
+		return dt, nil
+	}
+	// scheme trees only hang off the root
+	if depth != 0 {
+		return nil, fmt.Errorf("unexpected scheme trees")
+	}
+	count, err = binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	dt.schemes = make(map[string]*URLMatcher, count)
+	for i := uint64(0); i < count; i++ {
+		k, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		child, err := unmarshalURLMatcher(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		dt.schemes[k] = child
+	}
+	return dt, nil
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+// The output is versioned, and can be loaded with UnmarshalBinary.
+// Only URLMatchers using the default GlobPathChecker path checker
+// are supported.
+func (dt *URLMatcher) MarshalBinary() ([]byte, error) {
+	if dt == nil {
+		return nil, fmt.Errorf("node is nil")
+	}
+	var buf bytes.Buffer
+	writeHeader(&buf, urlMatcherMagic)
+	if err := dt.marshal(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface,
+// replacing any existing rules with those from data.
+func (dt *URLMatcher) UnmarshalBinary(data []byte) error {
+	if dt == nil {
+		return fmt.Errorf("node is nil")
+	}
+	r := bytes.NewReader(data)
+	if err := readHeader(r, urlMatcherMagic); err != nil {
+		return err
+	}
+	tmp, err := unmarshalURLMatcher(r, 0)
+	if err != nil {
+		return fmt.Errorf("bad binary format: %s", err)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("bad binary format: trailing data")
+	}
+	*dt = *tmp
+	return nil
+}
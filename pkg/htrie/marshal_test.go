@@ -0,0 +1,187 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package htrie
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func largeRuleSet(n int) []string {
+	rules := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		switch i % 4 {
+		case 0:
+			rules = append(rules, fmt.Sprintf("|s|host%d.example.com||", i))
+		case 1:
+			rules = append(rules, fmt.Sprintf("||*.host%d.example.net|i|/Images/*/%d.png", i, i))
+		case 2:
+			rules = append(rules, fmt.Sprintf("||host%d.example.org||/path%d/*", i, i))
+		case 3:
+			rules = append(rules, fmt.Sprintf("|s|host%d.example.com|i|*/file%d.*", i, i))
+		}
+	}
+	return rules
+}
+
+func largeURLSet(n int) []*url.URL {
+	urls := make([]*url.URL, 0, n*4)
+	for i := 0; i < n; i++ {
+		for _, s := range []string{
+			fmt.Sprintf("http://sub.host%d.example.com/any.png", i),
+			fmt.Sprintf("http://a.host%d.example.net/images/x/%d.png", i, i),
+			fmt.Sprintf("http://host%d.example.org/path%d/a/b.png", i, i),
+			fmt.Sprintf("http://host%d.example.com/a/FILE%d.gif", i, i),
+		} {
+			u, _ := url.Parse(s)
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func TestURLMatcherBinaryRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	n := 2000
+	dt, err := NewURLMatcherWithRules(largeRuleSet(n))
+	assert.Nil(t, err)
+
+	data, err := dt.MarshalBinary()
+	assert.Nil(t, err)
+
+	loaded := NewURLMatcher()
+	assert.Nil(t, loaded.UnmarshalBinary(data))
+
+	hits := 0
+	for _, u := range largeURLSet(n) {
+		expected := dt.CheckURL(u)
+		if expected {
+			hits++
+		}
+		assert.Equal(t, expected, loaded.CheckURL(u), "mismatch for %s", u)
+	}
+	// sanity check that the url set exercised both hits and misses
+	assert.True(t, hits > 0 && hits < n*4)
+
+	// output is deterministic
+	data2, err := loaded.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, data, data2)
+}
+
+func TestURLMatcherBinaryRoundTripSchemes(t *testing.T) {
+	t.Parallel()
+
+	dt, err := NewURLMatcherWithRules([]string{
+		"||http://example.com||*",
+		"||https://example.org|i|/images/*",
+		"||example.net||*",
+	})
+	assert.Nil(t, err)
+
+	data, err := dt.MarshalBinary()
+	assert.Nil(t, err)
+
+	loaded := NewURLMatcher()
+	assert.Nil(t, loaded.UnmarshalBinary(data))
+
+	for _, s := range []string{
+		"http://example.com/a.png",
+		"https://example.com/a.png",
+		"https://example.org/IMAGES/a.png",
+		"http://example.org/images/a.png",
+		"https://example.net/a.png",
+	} {
+		u, _ := url.Parse(s)
+		assert.Equal(t, dt.CheckURL(u), loaded.CheckURL(u), "mismatch for %s", u)
+	}
+
+	data2, err := loaded.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, data, data2)
+}
+
+func TestGlobPathCheckerBinaryRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	gpc := NewGlobPathChecker()
+	paths := make([]string, 0)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, gpc.AddRule(fmt.Sprintf("||/a%d/*/b%d.png", i, i)))
+		assert.Nil(t, gpc.AddRule(fmt.Sprintf("|i|/C%d/*", i)))
+		paths = append(paths,
+			fmt.Sprintf("/a%d/x/y/b%d.png", i, i),
+			fmt.Sprintf("/a%d/x/y/b%d.gif", i, i),
+			fmt.Sprintf("/c%d/anything", i),
+			fmt.Sprintf("/d%d/anything", i),
+		)
+	}
+
+	data, err := gpc.MarshalBinary()
+	assert.Nil(t, err)
+
+	loaded := NewGlobPathChecker()
+	assert.Nil(t, loaded.UnmarshalBinary(data))
+
+	for _, p := range paths {
+		assert.Equal(t, gpc.CheckPath(p), loaded.CheckPath(p), "mismatch for %s", p)
+	}
+
+	// empty checker round trips too
+	data, err = NewGlobPathChecker().MarshalBinary()
+	assert.Nil(t, err)
+	assert.Nil(t, loaded.UnmarshalBinary(data))
+	assert.False(t, loaded.CheckPath("/a1/x/y/b1.png"))
+}
+
+func TestBinaryFormatErrors(t *testing.T) {
+	t.Parallel()
+
+	dt := MustNewURLMatcherWithRules([]string{"|s|example.com|i|/foo/*"})
+	data, err := dt.MarshalBinary()
+	assert.Nil(t, err)
+
+	// wrong version
+	bad := append([]byte{}, data...)
+	bad[3] = binaryFormatVersion + 1
+	assert.NotNil(t, NewURLMatcher().UnmarshalBinary(bad))
+
+	// wrong type
+	assert.NotNil(t, NewGlobPathChecker().UnmarshalBinary(data))
+
+	// unknown node flags (root flags follow the header, and the empty root
+	// path part)
+	bad = append([]byte{}, data...)
+	bad[5] |= 0x80
+	assert.NotNil(t, NewURLMatcher().UnmarshalBinary(bad))
+
+	gpc := NewGlobPathChecker()
+	assert.Nil(t, gpc.AddRule("|i|/foo/*"))
+	gpcData, err := gpc.MarshalBinary()
+	assert.Nil(t, err)
+	// root flags follow the header, the presence bytes of the (empty) case
+	// sensitive and case insensitive trees, and the root node char
+	bad = append([]byte{}, gpcData...)
+	bad[7] |= 0x80
+	assert.NotNil(t, NewGlobPathChecker().UnmarshalBinary(bad))
+	assert.Nil(t, NewGlobPathChecker().UnmarshalBinary(gpcData))
+
+	// truncated
+	for i := 0; i < len(data); i++ {
+		assert.NotNil(t, NewURLMatcher().UnmarshalBinary(data[:i]), "truncated at %d", i)
+	}
+
+	// trailing data
+	assert.NotNil(t, NewURLMatcher().UnmarshalBinary(append(data, 0)))
+
+	// failed unmarshal leaves existing rules intact
+	u, _ := url.Parse("http://www.example.com/foo/bar.png")
+	assert.NotNil(t, dt.UnmarshalBinary(bad))
+	assert.True(t, dt.CheckURL(u))
+}
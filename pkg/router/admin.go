@@ -0,0 +1,201 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cactus/go-camo/pkg/htrie"
+)
+
+// StatsPath is the path of the admin stats endpoint.
+const StatsPath = "/_camo/stats"
+
+// maxAdminBodySize caps the size of admin request bodies.
+const maxAdminBodySize = 1024 * 1024
+
+// RuleTestRequest is the request body for the rule test endpoint.
+type RuleTestRequest struct {
+	Rules []string `json:"rules"`
+	URLs  []string `json:"urls"`
+}
+
+// RuleTestResult is the result for a single rule from the rule test endpoint.
+type RuleTestResult struct {
+	Rule    string   `json:"rule"`
+	Error   string   `json:"error,omitempty"`
+	Matches []string `json:"matches"`
+}
+
+// RuleTestResponse is the response body for the rule test endpoint.
+type RuleTestResponse struct {
+	Results []RuleTestResult `json:"results"`
+	// URLs that could not be parsed, and so were not tested
+	InvalidURLs []string `json:"invalid_urls,omitempty"`
+}
+
+// MaintenanceState is the request and response body for the maintenance
+// endpoint.
+type MaintenanceState struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// isAdmin returns true if the request carries the configured admin token as a
+// bearer token. Always false if no admin token is configured.
+func (dr *DumbRouter) isAdmin(r *http.Request) bool {
+	if dr.AdminToken == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(dr.AdminToken)) == 1
+}
+
+// testRules evaluates each rule, in isolation, against each url.
+// Rules use the filter-ruleset format, with an optional leading `allow`,
+// `deny`, or `legal` rule type (which is ignored).
+func testRules(rules []string, urls []string) *RuleTestResponse {
+	resp := &RuleTestResponse{Results: make([]RuleTestResult, 0, len(rules))}
+
+	parsed := make([]*url.URL, 0, len(urls))
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil || u.Hostname() == "" {
+			resp.InvalidURLs = append(resp.InvalidURLs, s)
+			continue
+		}
+		parsed = append(parsed, u)
+	}
+
+	for _, rule := range rules {
+		result := RuleTestResult{Rule: rule, Matches: make([]string, 0)}
+		line := rule
+		for _, ruleType := range []string{"allow", "deny", "legal"} {
+			line = strings.TrimPrefix(line, ruleType)
+		}
+		matcher, err := htrie.NewURLMatcherWithRules([]string{line})
+		if err != nil {
+			result.Error = err.Error()
+			resp.Results = append(resp.Results, result)
+			continue
+		}
+		for _, u := range parsed {
+			if matcher.CheckURL(u) {
+				result.Matches = append(result.Matches, u.String())
+			}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp
+}
+
+// RuleTestHandler is an admin HTTP handler that accepts a set of filter rules
+// and a set of urls (as json), and returns which urls each rule matches. It
+// does not modify any live filter configuration.
+func (dr *DumbRouter) RuleTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var rtr RuleTestRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxAdminBodySize))
+	if err := dec.Decode(&rtr); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(testRules(rtr.Rules, rtr.URLs)); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// MaintenanceHandler is an admin HTTP handler that reports (GET), or sets
+// (POST), the maintenance mode state.
+func (dr *DumbRouter) MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if dr.Maintenance == nil {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var ms MaintenanceState
+		dec := json.NewDecoder(io.LimitReader(r.Body, maxAdminBodySize))
+		if err := dec.Decode(&ms); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		dr.Maintenance.SetMaintenance(ms.Maintenance)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	state := MaintenanceState{Maintenance: dr.Maintenance.InMaintenance()}
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// StatsHandler is an admin HTTP handler that returns a json snapshot of
+// handler stats.
+func (dr *DumbRouter) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	if dr.Stats == nil {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(dr.Stats()); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// serveAdmin routes admin requests. Returns false if the request was not an
+// admin request.
+func (dr *DumbRouter) serveAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if dr.AdminToken == "" {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, "/admin/") && r.URL.Path != StatsPath {
+		return false
+	}
+
+	if !dr.isAdmin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	}
+
+	switch r.URL.Path {
+	case "/admin/rules/test":
+		dr.RuleTestHandler(w, r)
+	case "/admin/maintenance":
+		dr.MaintenanceHandler(w, r)
+	case StatsPath:
+		dr.StatsHandler(w, r)
+	default:
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+	}
+	return true
+}
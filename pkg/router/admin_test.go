@@ -0,0 +1,198 @@
+// Copyright (c) 2012-2019 Eli Janssen
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func adminReq(method, path, token, body string) *http.Request {
+	req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestAdminTokenRequired(t *testing.T) {
+	t.Parallel()
+
+	dr := &DumbRouter{AdminToken: "sekrit"}
+	body := `{"rules":[],"urls":[]}`
+
+	var tests = []struct {
+		token  string
+		status int
+	}{
+		{"", 403},
+		{"wrong", 403},
+		{"sekrit", 200},
+	}
+	for _, tt := range tests {
+		record := httptest.NewRecorder()
+		dr.ServeHTTP(record, adminReq("POST", "/admin/rules/test", tt.token, body))
+		assert.Equal(t, tt.status, record.Code, "token %q", tt.token)
+	}
+
+	// admin endpoints are not exposed without a configured token
+	dr = &DumbRouter{}
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("POST", "/admin/rules/test", "", body))
+	assert.Equal(t, 405, record.Code)
+}
+
+func TestAdminRuleTest(t *testing.T) {
+	t.Parallel()
+
+	dr := &DumbRouter{AdminToken: "sekrit"}
+	body := `{
+		"rules": [
+			"deny|s|example.com||",
+			"|i|example.net|i|/images/*",
+			"deny|s|*.example.org||",
+			"deny|bogus"
+		],
+		"urls": [
+			"http://example.com/a.png",
+			"http://sub.example.com/a.png",
+			"http://example.net/images/a.png",
+			"http://example.net/other/a.png",
+			"http://www.example.org/a.png",
+			"not a url"
+		]
+	}`
+
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("POST", "/admin/rules/test", "sekrit", body))
+	assert.Equal(t, 200, record.Code)
+	assert.Equal(t, "application/json", record.Header().Get("Content-Type"))
+
+	var resp RuleTestResponse
+	assert.Nil(t, json.NewDecoder(record.Body).Decode(&resp))
+	if assert.Len(t, resp.Results, 4) {
+		assert.Equal(t, []string{
+			"http://example.com/a.png",
+			"http://sub.example.com/a.png",
+		}, resp.Results[0].Matches)
+		assert.Equal(t, []string{"http://example.net/images/a.png"}, resp.Results[1].Matches)
+		assert.Equal(t, []string{"http://www.example.org/a.png"}, resp.Results[2].Matches)
+		assert.NotEmpty(t, resp.Results[3].Error)
+		assert.Empty(t, resp.Results[3].Matches)
+	}
+	assert.Equal(t, []string{"not a url"}, resp.InvalidURLs)
+}
+
+func TestAdminRuleTestBadRequest(t *testing.T) {
+	t.Parallel()
+
+	dr := &DumbRouter{AdminToken: "sekrit"}
+
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("POST", "/admin/rules/test", "sekrit", "{"))
+	assert.Equal(t, 400, record.Code)
+
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("GET", "/admin/rules/test", "sekrit", ""))
+	assert.Equal(t, 405, record.Code)
+
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("GET", "/admin/nope", "sekrit", ""))
+	assert.Equal(t, 404, record.Code)
+}
+
+type testMaintenance struct {
+	enabled bool
+}
+
+func (m *testMaintenance) InMaintenance() bool         { return m.enabled }
+func (m *testMaintenance) SetMaintenance(enabled bool) { m.enabled = enabled }
+
+func TestAdminMaintenance(t *testing.T) {
+	t.Parallel()
+
+	m := &testMaintenance{}
+	dr := &DumbRouter{AdminToken: "sekrit", Maintenance: m}
+
+	state := func(record *httptest.ResponseRecorder) MaintenanceState {
+		var ms MaintenanceState
+		assert.Nil(t, json.NewDecoder(record.Body).Decode(&ms))
+		return ms
+	}
+	healthcheck := func() int {
+		record := httptest.NewRecorder()
+		dr.ServeHTTP(record, httptest.NewRequest("GET", "http://example.com/healthcheck", nil))
+		return record.Code
+	}
+
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("GET", "/admin/maintenance", "sekrit", ""))
+	assert.Equal(t, 200, record.Code)
+	assert.False(t, state(record).Maintenance)
+	assert.Equal(t, 200, healthcheck())
+
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("POST", "/admin/maintenance", "sekrit", `{"maintenance":true}`))
+	assert.Equal(t, 200, record.Code)
+	assert.True(t, state(record).Maintenance)
+	assert.True(t, m.enabled)
+	assert.Equal(t, 503, healthcheck())
+
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("POST", "/admin/maintenance", "sekrit", `{"maintenance":false}`))
+	assert.Equal(t, 200, record.Code)
+	assert.False(t, state(record).Maintenance)
+	assert.Equal(t, 200, healthcheck())
+
+	// token required
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("POST", "/admin/maintenance", "", `{"maintenance":true}`))
+	assert.Equal(t, 403, record.Code)
+	assert.False(t, m.enabled)
+
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("POST", "/admin/maintenance", "sekrit", `bogus`))
+	assert.Equal(t, 400, record.Code)
+
+	// not available without a maintenance switch
+	dr = &DumbRouter{AdminToken: "sekrit"}
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("GET", "/admin/maintenance", "sekrit", ""))
+	assert.Equal(t, 404, record.Code)
+}
+
+func TestAdminStats(t *testing.T) {
+	t.Parallel()
+
+	stats := map[string]int{"requests": 3}
+	dr := &DumbRouter{
+		AdminToken:  "sekrit",
+		CamoHandler: http.NotFoundHandler(),
+		Stats:       func() interface{} { return stats },
+	}
+
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("GET", StatsPath, "sekrit", ""))
+	assert.Equal(t, 200, record.Code)
+	assert.Equal(t, "application/json", record.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"requests":3}`, record.Body.String())
+
+	// token required
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("GET", StatsPath, "wrong", ""))
+	assert.Equal(t, 403, record.Code)
+
+	// not an admin endpoint without an admin token
+	dr.AdminToken = ""
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, adminReq("GET", StatsPath, "", ""))
+	assert.Equal(t, 404, record.Code)
+	assert.NotEqual(t, "application/json", record.Header().Get("Content-Type"))
+}
@@ -14,6 +14,29 @@ type DumbRouter struct {
 	ServerName  string
 	CamoHandler http.Handler
 	AddHeaders  map[string]string
+	// AdminToken enables the admin endpoints (under /admin/) when set.
+	// Admin requests must supply it as a bearer token.
+	AdminToken string
+	// Maintenance, if set, is reflected by the healthcheck endpoint, and can
+	// be toggled via the admin endpoints.
+	Maintenance MaintenanceSwitch
+	// Stats, if set, returns a json encodable snapshot of handler stats
+	// (such as camo.Proxy.Stats), served to admin requests at StatsPath.
+	Stats func() interface{}
+	// QueryStringURLs routes query string format urls (eg.
+	// `/?url=<url>&digest=<hmac>`, or `/<hmac>?url=<url>`) to CamoHandler.
+	QueryStringURLs bool
+	// PathPrefix, if set, is the base path (eg. `/camo`) camo requests are
+	// routed under. Requests outside of it 404. The healthcheck and admin
+	// endpoints are not affected.
+	PathPrefix string
+}
+
+// MaintenanceSwitch is implemented by handlers supporting a maintenance
+// (drain) mode, such as camo.Proxy.
+type MaintenanceSwitch interface {
+	InMaintenance() bool
+	SetMaintenance(enabled bool)
 }
 
 // SetHeaders sets the headers on the response
@@ -27,8 +50,13 @@ func (dr *DumbRouter) SetHeaders(w http.ResponseWriter) {
 }
 
 // HealthCheckHandler is HTTP handler for confirming the backend service
-// is available from an external client, such as a load balancer.
+// is available from an external client, such as a load balancer. It responds
+// with a 503 in maintenance mode, so load balancers drain the instance.
 func (dr *DumbRouter) HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if dr.Maintenance != nil && dr.Maintenance.InMaintenance() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -37,6 +65,10 @@ func (dr *DumbRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// set some default headers
 	dr.SetHeaders(w)
 
+	if dr.serveAdmin(w, r) {
+		return
+	}
+
 	if r.Method != "HEAD" && r.Method != "GET" {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
@@ -47,11 +79,24 @@ func (dr *DumbRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	components := strings.Split(r.URL.Path, "/")
+	path := r.URL.Path
+	if prefix := strings.TrimRight(dr.PathPrefix, "/"); prefix != "" {
+		if !strings.HasPrefix(path, prefix+"/") {
+			http.Error(w, "404 Not Found", http.StatusNotFound)
+			return
+		}
+		path = path[len(prefix):]
+	}
+
+	components := strings.Split(path, "/")
 	if len(components) == 3 {
 		dr.CamoHandler.ServeHTTP(w, r)
 		return
 	}
+	if dr.QueryStringURLs && len(components) == 2 && r.URL.Query().Get("url") != "" {
+		dr.CamoHandler.ServeHTTP(w, r)
+		return
+	}
 
 	http.Error(w, "404 Not Found", http.StatusNotFound)
 }